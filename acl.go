@@ -0,0 +1,117 @@
+package sudoku_go
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+	"sudoku_go/sudoku"
+)
+
+// 出站访问控制的动作
+const (
+	ACLAllow = "allow"
+	ACLDeny  = "deny"
+)
+
+// 默认拒绝的内部网段，除了 netip 能识别的回环、私有和链路本地地址之外的部分
+// 云服务的元数据地址 169.254.169.254 和 fd00:ec2::254 分别属于链路本地和私有地址
+var privatePrefixes = []netip.Prefix{
+	// 本网络
+	netip.MustParsePrefix("0.0.0.0/8"),
+	// 运营商级 NAT
+	netip.MustParsePrefix("100.64.0.0/10"),
+	// 基准测试
+	netip.MustParsePrefix("198.18.0.0/15"),
+	// 保留和广播
+	netip.MustParsePrefix("240.0.0.0/4"),
+	// NAT64 可以把任意 IPv4 地址包装成 IPv6 地址
+	netip.MustParsePrefix("64:ff9b::/96"),
+	netip.MustParsePrefix("64:ff9b:1::/48"),
+}
+
+// 服务端的出站访问控制，在解析域名之后、连接目标之前检查
+//
+// 规则和 Router 的格式相同，为 类型,值,动作，动作为 allow 或 deny，例如:
+//
+//	domain-suffix,internal.example.com,deny
+//	ip-cidr,10.1.2.0/24,allow
+//	port,25,deny
+//	final,deny
+//
+// 规则按顺序匹配，域名类规则匹配客户端请求的域名，ip-cidr 匹配解析之后实际要连接的 IP，
+// 因此指向内网的域名不能绕过 IP 规则。都不匹配时，拒绝私有网段后允许其它地址
+type ACL struct {
+	rules []*rule
+	// 是否拒绝回环、私有、链路本地等内部网段，规则中显式允许的地址不受影响
+	blockPrivate bool
+}
+
+// 解析规则，allowPrivate 为 false 时拒绝规则没有允许的内部网段
+func NewACL(rules []string, allowPrivate bool) (*ACL, error) {
+	acl := &ACL{blockPrivate: !allowPrivate}
+	for _, line := range rules {
+		r, err := parseRule(line, ACLAllow, ACLDeny)
+		if err != nil {
+			return nil, err
+		}
+		// 服务端总是先解析域名，geoip 和 no-resolve 没有意义
+		if r.kind == RuleGeoIP || r.noResolve {
+			return nil, fmt.Errorf("%w: %q is not supported in acl", ErrBadRule, line)
+		}
+		acl.rules = append(acl.rules, r)
+	}
+	return acl, nil
+}
+
+// 从 addr 解析出的地址中选出允许连接的地址
+// 都不允许时返回第一个地址被拒绝的原因 deniedRule 或 deniedPrivate
+func (acl *ACL) filter(addr *sudoku.Addr, ips []netip.Addr) ([]netip.Addr, string) {
+	var allowed []netip.Addr
+	var reason string
+	for _, ip := range ips {
+		if denied := acl.check(addr, ip); denied == "" {
+			allowed = append(allowed, ip)
+		} else if reason == "" {
+			reason = denied
+		}
+	}
+	return allowed, reason
+}
+
+// 检查是否允许连接 addr，ip 为 addr 解析之后要连接的 IP
+// 允许时返回空字符串，拒绝时返回原因 deniedRule 或 deniedPrivate，acl 为 nil 时全部允许
+func (acl *ACL) check(addr *sudoku.Addr, ip netip.Addr) string {
+	if acl == nil {
+		return ""
+	}
+	host := strings.ToLower(strings.TrimSuffix(addr.Host, "."))
+	dst := ip.Unmap()
+
+	for _, r := range acl.rules {
+		if !r.matchResolved(addr, host, dst) {
+			continue
+		}
+		if r.action == ACLDeny {
+			return deniedRule
+		}
+		return ""
+	}
+	if acl.blockPrivate && isPrivate(dst) {
+		return deniedPrivate
+	}
+	return ""
+}
+
+// 是否是不应该从外部访问的内部地址，无效的地址也视为内部地址
+func isPrivate(ip netip.Addr) bool {
+	if !ip.IsValid() || ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() {
+		return true
+	}
+	for _, prefix := range privatePrefixes {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,130 @@
+package sudoku_go
+
+import (
+	"errors"
+	"net/netip"
+	"testing"
+)
+
+func TestIsPrivate(t *testing.T) {
+	for ip, want := range map[string]bool{
+		"127.0.0.1":        true,
+		"127.255.0.1":      true,
+		"::1":              true,
+		"10.0.0.1":         true,
+		"172.16.0.1":       true,
+		"172.31.255.255":   true,
+		"192.168.1.1":      true,
+		"fd00:ec2::254":    true,
+		"169.254.169.254":  true,
+		"fe80::1":          true,
+		"0.0.0.0":          true,
+		"0.1.2.3":          true,
+		"::":               true,
+		"100.64.0.1":       true,
+		"198.18.0.1":       true,
+		"255.255.255.255":  true,
+		"64:ff9b::a00:1":   true,
+		"64:ff9b::808:808": true,
+		"64:ff9b:1::1":     true,
+		"8.8.8.8":          false,
+		"172.32.0.1":       false,
+		"100.128.0.1":      false,
+		"2001:4860::8888":  false,
+	} {
+		if got := isPrivate(netip.MustParseAddr(ip)); got != want {
+			t.Errorf("isPrivate(%s) = %v, want %v", ip, got, want)
+		}
+	}
+	if !isPrivate(netip.Addr{}) {
+		t.Error("invalid address is not private")
+	}
+}
+
+func TestACLCheck(t *testing.T) {
+	acl, err := NewACL([]string{
+		"domain,allowed.test,allow",
+		"domain-suffix,internal.test,deny",
+		"ip-cidr,10.1.2.0/24,allow",
+		"ip-cidr,10.0.0.0/8,deny",
+		"ip-cidr,203.0.113.0/24,deny",
+		"port,25,deny",
+	}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		addr string
+		ip   string
+		want string
+	}{
+		{"example.com:443", "93.184.216.34", ""},
+		{"93.184.216.34:25", "93.184.216.34", deniedRule},
+		// 先出现的规则优先，显式允许的私有地址不受默认拒绝的影响
+		{"10.1.2.3:80", "10.1.2.3", ""},
+		{"10.9.9.9:80", "10.9.9.9", deniedRule},
+		{"allowed.test:80", "10.9.9.9", ""},
+		{"allowed.test:25", "10.9.9.9", ""},
+		{"Allowed.Test.:80", "127.0.0.1", ""},
+		{"db.internal.test:80", "93.184.216.34", deniedRule},
+		// ip-cidr 匹配解析之后的 IP，指向被拒绝网段的域名不能绕过
+		{"evil.test:80", "203.0.113.5", deniedRule},
+		{"evil.test:80", "::ffff:203.0.113.5", deniedRule},
+		{"evil.test:80", "::ffff:10.1.2.3", ""},
+		// 规则都不匹配时拒绝内部网段
+		{"localhost:80", "127.0.0.1", deniedPrivate},
+		{"localhost:80", "::1", deniedPrivate},
+		{"lan.test:80", "192.168.1.1", deniedPrivate},
+		{"metadata.test:80", "169.254.169.254", deniedPrivate},
+		{"nat64.test:80", "64:ff9b::a9fe:a9fe", deniedPrivate},
+		{"mapped.test:80", "::ffff:127.0.0.1", deniedPrivate},
+		{"mapped.test:80", "::ffff:169.254.169.254", deniedPrivate},
+		{"mapped.test:80", "::ffff:8.8.8.8", ""},
+	} {
+		if got := acl.check(mustAddr(t, tc.addr), netip.MustParseAddr(tc.ip)); got != tc.want {
+			t.Errorf("check(%s, %s) = %q, want %q", tc.addr, tc.ip, got, tc.want)
+		}
+	}
+
+	// allowPrivate 时只按规则检查
+	open, err := NewACL([]string{"ip-cidr,10.0.0.0/8,deny"}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ip, want := range map[string]string{"127.0.0.1": "", "169.254.169.254": "", "10.0.0.1": deniedRule} {
+		if got := open.check(mustAddr(t, "host.test:80"), netip.MustParseAddr(ip)); got != want {
+			t.Errorf("allow private: check(%s) = %q, want %q", ip, got, want)
+		}
+	}
+	// 最后一条 final 规则拒绝所有其它地址
+	closed, err := NewACL([]string{"domain,example.com,allow", "final,deny"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := closed.check(mustAddr(t, "other.test:80"), netip.MustParseAddr("8.8.8.8")); got != deniedRule {
+		t.Errorf("final deny: check = %q", got)
+	}
+	var nilACL *ACL
+	if got := nilACL.check(mustAddr(t, "localhost:80"), netip.MustParseAddr("127.0.0.1")); got != "" {
+		t.Errorf("nil acl: check = %q", got)
+	}
+
+	// 只连接允许的地址，都不允许时返回第一个地址被拒绝的原因
+	allowed, reason := acl.filter(mustAddr(t, "dual.test:80"), []netip.Addr{
+		netip.MustParseAddr("127.0.0.1"), netip.MustParseAddr("10.9.9.9"), netip.MustParseAddr("93.184.216.34"),
+	})
+	if len(allowed) != 1 || allowed[0] != netip.MustParseAddr("93.184.216.34") || reason != deniedPrivate {
+		t.Errorf("filter = %v, %q", allowed, reason)
+	}
+	if allowed, reason := acl.filter(mustAddr(t, "dual.test:80"), []netip.Addr{
+		netip.MustParseAddr("10.9.9.9"), netip.MustParseAddr("127.0.0.1"),
+	}); len(allowed) != 0 || reason != deniedRule {
+		t.Errorf("filter = %v, %q", allowed, reason)
+	}
+
+	for _, line := range []string{"geoip,cn,deny", "ip-cidr,10.0.0.0/8,deny,no-resolve", "domain,example.com,proxy"} {
+		if _, err := NewACL([]string{line}, false); !errors.Is(err, ErrBadRule) {
+			t.Errorf("%q: err = %v, want ErrBadRule", line, err)
+		}
+	}
+}
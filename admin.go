@@ -0,0 +1,284 @@
+package sudoku_go
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 管理接口，只能监听在本机回环地址或者 unix socket 上
+//
+//	GET    /sessions       列出正在转发的会话
+//	DELETE /sessions/{id}  断开一个会话
+//	GET    /stats          汇总统计
+//
+// 返回 JSON
+
+var ErrAdminNotLocal = errors.New("admin: must listen on a loopback address or a unix socket")
+
+// 一个正在转发的会话，即一条到目标的连接或者一个 UDP 关联
+type session struct {
+	*traffic
+	id     uint64
+	source string
+	target string
+	start  time.Time
+
+	closers []io.Closer
+}
+
+// source 为客户端地址，user 为认证的用户，没有认证时为空
+func newSession(source, user string) *session {
+	return &session{
+		traffic: newTraffic(user),
+		source:  source,
+		start:   time.Now(),
+	}
+}
+
+func (sess *session) close() {
+	for _, closer := range sess.closers {
+		closer.Close()
+	}
+}
+
+// 正在转发的会话，会话开始转发时加入，结束时移除
+type sessionTable struct {
+	nextID atomic.Uint64
+	start  time.Time
+
+	lock     sync.Mutex
+	sessions map[uint64]*session
+}
+
+func newSessionTable() *sessionTable {
+	return &sessionTable{
+		start:    time.Now(),
+		sessions: make(map[uint64]*session),
+	}
+}
+
+// 加入会话，断开会话时关闭 closers
+func (table *sessionTable) add(sess *session, target string, closers ...io.Closer) {
+	sess.id = table.nextID.Add(1)
+	sess.target = target
+	sess.closers = closers
+	table.lock.Lock()
+	table.sessions[sess.id] = sess
+	table.lock.Unlock()
+}
+
+func (table *sessionTable) remove(sess *session) {
+	table.lock.Lock()
+	delete(table.sessions, sess.id)
+	table.lock.Unlock()
+}
+
+// 断开会话，会话不存在时返回 false
+func (table *sessionTable) kill(id uint64) bool {
+	table.lock.Lock()
+	sess, ok := table.sessions[id]
+	table.lock.Unlock()
+	if !ok {
+		return false
+	}
+	sess.close()
+	return true
+}
+
+// 断开所有会话，用于排空连接超时之后
+func (table *sessionTable) killAll() {
+	table.lock.Lock()
+	sessions := make([]*session, 0, len(table.sessions))
+	for _, sess := range table.sessions {
+		sessions = append(sessions, sess)
+	}
+	table.lock.Unlock()
+	for _, sess := range sessions {
+		sess.close()
+	}
+}
+
+// ctx 结束并且经过 timeout 之后断开所有会话
+// 只关闭接受的连接不够，转发另一个方向的 goroutine 可能还在等待目标的数据
+func (table *sessionTable) killAfter(ctx context.Context, timeout time.Duration) (stop func() bool) {
+	return context.AfterFunc(ctx, func() {
+		time.AfterFunc(timeout, table.killAll)
+	})
+}
+
+type sessionInfo struct {
+	ID      uint64    `json:"id"`
+	Source  string    `json:"source"`
+	Target  string    `json:"target"`
+	User    string    `json:"user,omitempty"`
+	Start   time.Time `json:"start"`
+	TxBytes uint64    `json:"tx_bytes"`
+	RxBytes uint64    `json:"rx_bytes"`
+}
+
+func (table *sessionTable) list() []sessionInfo {
+	table.lock.Lock()
+	defer table.lock.Unlock()
+	infos := make([]sessionInfo, 0, len(table.sessions))
+	for _, sess := range table.sessions {
+		infos = append(infos, sessionInfo{
+			ID:      sess.id,
+			Source:  sess.source,
+			Target:  sess.target,
+			User:    sess.user,
+			Start:   sess.start,
+			TxBytes: sess.tx.Load(),
+			RxBytes: sess.rx.Load(),
+		})
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ID < infos[j].ID
+	})
+	return infos
+}
+
+type adminStats struct {
+	Uptime            float64           `json:"uptime_seconds"`
+	ActiveConnections int64             `json:"active_connections"`
+	Connections       uint64            `json:"connections_total"`
+	Sessions          int               `json:"sessions"`
+	TxBytes           uint64            `json:"tx_bytes"`
+	RxBytes           uint64            `json:"rx_bytes"`
+	HandshakeFailures map[string]uint64 `json:"handshake_failures"`
+	CodecErrors       map[string]uint64 `json:"codec_errors"`
+	OutboundDenied    map[string]uint64 `json:"outbound_denied"`
+}
+
+func (table *sessionTable) stats() *adminStats {
+	table.lock.Lock()
+	sessions := len(table.sessions)
+	table.lock.Unlock()
+	return &adminStats{
+		Uptime:            time.Since(table.start).Seconds(),
+		ActiveConnections: metricActiveConns.v.Load(),
+		Connections:       metricConns.get(),
+		Sessions:          sessions,
+		TxBytes:           metricBytes.get(directionTx),
+		RxBytes:           metricBytes.get(directionRx),
+		HandshakeFailures: metricHandshakeFailures.snapshot(),
+		CodecErrors:       metricCodecErrors.snapshot(),
+		OutboundDenied:    metricOutboundDenied.snapshot(),
+	}
+}
+
+// 在 addr 上启动管理接口，以 unix: 开头或者包含 / 时为 unix socket 路径，ctx 结束时关闭
+func serveAdmin(ctx context.Context, addr string, table *sessionTable) error {
+	listener, err := listenAdmin(addr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/sessions", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, table.list())
+	})
+	mux.HandleFunc("/sessions/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		id, err := strconv.ParseUint(strings.TrimPrefix(r.URL.Path, "/sessions/"), 10, 64)
+		if err != nil {
+			http.Error(w, "bad session id", http.StatusBadRequest)
+			return
+		}
+		if !table.kill(id) {
+			http.Error(w, "session not found", http.StatusNotFound)
+			return
+		}
+		slog.Info("Session killed by admin", "session", id)
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, table.stats())
+	})
+	slog.Info("Admin API listening", "addr", listener.Addr().String())
+	context.AfterFunc(ctx, func() {
+		listener.Close()
+	})
+	go func() {
+		if err := http.Serve(listener, mux); err != nil && ctx.Err() == nil {
+			slog.Error("Admin API stopped", "err", err)
+		}
+	}()
+	return nil
+}
+
+func listenAdmin(addr string) (net.Listener, error) {
+	if path, ok := strings.CutPrefix(addr, "unix:"); ok || strings.Contains(addr, "/") {
+		if !ok {
+			path = addr
+		}
+		// 清理上次运行留下的 socket 文件
+		if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+			os.Remove(path)
+		}
+		listener, err := net.Listen("unix", path)
+		if err != nil {
+			return nil, err
+		}
+		// 只有当前用户可以访问
+		if err := os.Chmod(path, 0o600); err != nil {
+			listener.Close()
+			return nil, err
+		}
+		return listener, nil
+	}
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if host != "localhost" {
+		ip := net.ParseIP(host)
+		if ip == nil || !ip.IsLoopback() {
+			return nil, ErrAdminNotLocal
+		}
+	}
+	return net.Listen("tcp", addr)
+}
+
+// 连接的对端地址，取不到时为空
+func remoteAddrOf(conn io.ReadWriteCloser) string {
+	if httpConn, ok := conn.(*httpRequestConn); ok {
+		conn = httpConn.SecureTCPConn
+	}
+	if secureConn, ok := conn.(*SecureTCPConn); ok {
+		conn = secureConn.ReadWriteCloser
+	}
+	if conn, ok := conn.(interface{ RemoteAddr() net.Addr }); ok {
+		return conn.RemoteAddr().String()
+	}
+	return ""
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(v)
+}
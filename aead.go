@@ -0,0 +1,188 @@
+package sudoku_go
+
+import (
+	"crypto/aes"
+	stdcipher "crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// AEAD 记录层
+//
+// 在数独编码之前对原数据加密并认证，每条记录的格式为：
+//
+// +------------------+--------------+----------------------+--------------+
+// | LEN (sealed)     | LEN TAG      | PAYLOAD (sealed)     | PAYLOAD TAG  |
+// +------------------+--------------+----------------------+--------------+
+// | 2                | 16           | LEN                  | 16           |
+// +------------------+--------------+----------------------+--------------+
+//
+// 长度和负载分别加密，nonce 为 12 字节小端计数器，每次加密后加一。
+// 每个方向使用独立的密钥，由预共享密钥和握手时交换的随机数派生：
+//
+// 上行 = HMAC-SHA256(PSK, "sudoku aead c2s" | 客户端随机数 | 服务端随机数)
+// 下行 = HMAC-SHA256(PSK, "sudoku aead s2c" | 客户端随机数 | 服务端随机数)
+//
+// 两个方向的密钥都包含服务端随机数，重放录下的会话时服务端派生出不同的密钥，第一条记录就会认证失败。
+
+const (
+	maxRecordPayload = 0x3fff
+	aeadTagSize      = 16
+)
+
+var ErrAuthFailed = errors.New("aead: message authentication failed")
+
+// 派生上行方向的 AEAD
+func clientAEAD(psk string, clientNonce, serverNonce []byte) (stdcipher.AEAD, error) {
+	return deriveAEAD(psk, "sudoku aead c2s", clientNonce, serverNonce)
+}
+
+// 派生下行方向的 AEAD
+func serverAEAD(psk string, clientNonce, serverNonce []byte) (stdcipher.AEAD, error) {
+	return deriveAEAD(psk, "sudoku aead s2c", clientNonce, serverNonce)
+}
+
+func deriveAEAD(psk, label string, nonces ...[]byte) (stdcipher.AEAD, error) {
+	h := hmac.New(sha256.New, []byte(psk))
+	h.Write([]byte(label))
+	for _, nonce := range nonces {
+		h.Write(nonce)
+	}
+	block, err := aes.NewCipher(h.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return stdcipher.NewGCM(block)
+}
+
+// 一个方向上的 AEAD 状态，同方向的所有读写共享同一个 nonce 计数器
+type aeadState struct {
+	aead  stdcipher.AEAD
+	nonce [12]byte
+}
+
+func newAEADState(aead stdcipher.AEAD) *aeadState {
+	return &aeadState{aead: aead}
+}
+
+func (state *aeadState) increment() {
+	for i := range state.nonce {
+		state.nonce[i]++
+		if state.nonce[i] != 0 {
+			return
+		}
+	}
+}
+
+func (state *aeadState) seal(dst, plaintext []byte) []byte {
+	dst = state.aead.Seal(dst, state.nonce[:], plaintext, nil)
+	state.increment()
+	return dst
+}
+
+func (state *aeadState) open(dst, ciphertext []byte) ([]byte, error) {
+	dst, err := state.aead.Open(dst, state.nonce[:], ciphertext, nil)
+	if err != nil {
+		metricCodecErrors.add(1, "aead")
+		return nil, ErrAuthFailed
+	}
+	state.increment()
+	return dst, nil
+}
+
+// 把原数据切分成记录加密后写入 w
+type aeadWriter struct {
+	w     io.Writer
+	state *aeadState
+	buf   []byte
+}
+
+func newAEADWriter(w io.Writer, state *aeadState) *aeadWriter {
+	return &aeadWriter{
+		w:     w,
+		state: state,
+		buf:   make([]byte, 0, 2+aeadTagSize+maxRecordPayload+aeadTagSize),
+	}
+}
+
+func (aw *aeadWriter) Write(bs []byte) (n int, err error) {
+	for len(bs) > 0 {
+		chunk := bs
+		if len(chunk) > maxRecordPayload {
+			chunk = chunk[:maxRecordPayload]
+		}
+		var length [2]byte
+		binary.BigEndian.PutUint16(length[:], uint16(len(chunk)))
+		record := aw.state.seal(aw.buf[:0], length[:])
+		record = aw.state.seal(record, chunk)
+		if _, err = aw.w.Write(record); err != nil {
+			return
+		}
+		n += len(chunk)
+		bs = bs[len(chunk):]
+	}
+	return
+}
+
+// 从 r 中读取记录，校验并解密
+// 任何一条记录认证失败都会返回 ErrAuthFailed，此后连接应当被关闭
+type aeadReader struct {
+	r     io.Reader
+	state *aeadState
+	buf   []byte
+	out   []byte
+	err   error
+}
+
+func newAEADReader(r io.Reader, state *aeadState) *aeadReader {
+	return &aeadReader{
+		r:     r,
+		state: state,
+		buf:   make([]byte, maxRecordPayload+aeadTagSize),
+	}
+}
+
+func (ar *aeadReader) Read(bs []byte) (int, error) {
+	if len(bs) == 0 {
+		return 0, nil
+	}
+	if len(ar.out) == 0 {
+		if ar.err != nil {
+			return 0, ar.err
+		}
+		if ar.err = ar.readRecord(); ar.err != nil {
+			return 0, ar.err
+		}
+	}
+	n := copy(bs, ar.out)
+	ar.out = ar.out[n:]
+	return n, nil
+}
+
+func (ar *aeadReader) readRecord() error {
+	header := ar.buf[:2+aeadTagSize]
+	if _, err := io.ReadFull(ar.r, header); err != nil {
+		return err
+	}
+	length, err := ar.state.open(header[:0], header)
+	if err != nil {
+		return err
+	}
+	size := int(binary.BigEndian.Uint16(length))
+	if size > maxRecordPayload {
+		metricCodecErrors.add(1, "aead")
+		return ErrAuthFailed
+	}
+	payload := ar.buf[:size+aeadTagSize]
+	if _, err := io.ReadFull(ar.r, payload); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	ar.out, err = ar.state.open(payload[:0], payload)
+	return err
+}
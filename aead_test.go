@@ -0,0 +1,126 @@
+package sudoku_go
+
+import (
+	"bytes"
+	stdcipher "crypto/cipher"
+	"errors"
+	"io"
+	"math/rand"
+	"sudoku_go/sudoku"
+	"testing"
+	"testing/iotest"
+)
+
+var (
+	testClientNonce = bytes.Repeat([]byte{0xc1}, sudoku.NonceSize)
+	testServerNonce = bytes.Repeat([]byte{0x5e}, sudoku.NonceSize)
+)
+
+func testAEAD(t *testing.T, derive func(string, []byte, []byte) (stdcipher.AEAD, error), serverNonce []byte) *aeadState {
+	aead, err := derive("psk", testClientNonce, serverNonce)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newAEADState(aead)
+}
+
+// 每次 Write 都是单独的记录，返回每条记录
+func sealRecords(t *testing.T, state *aeadState, chunks ...[]byte) [][]byte {
+	var records [][]byte
+	for _, chunk := range chunks {
+		var buf bytes.Buffer
+		if _, err := newAEADWriter(&buf, state).Write(chunk); err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, buf.Bytes())
+	}
+	return records
+}
+
+func openAll(state *aeadState, wire []byte) ([]byte, error) {
+	return io.ReadAll(newAEADReader(bytes.NewReader(wire), state))
+}
+
+func TestAEADRoundTrip(t *testing.T) {
+	src := make([]byte, 3*maxRecordPayload+5)
+	rand.New(rand.NewSource(1)).Read(src)
+	for _, size := range []int{1, 100, maxRecordPayload, maxRecordPayload + 1, len(src)} {
+		var wire bytes.Buffer
+		w := newAEADWriter(&wire, testAEAD(t, clientAEAD, testServerNonce))
+		// 分两次写入，计数器在记录之间连续
+		if _, err := w.Write(src[:size/2]); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(src[size/2 : size]); err != nil {
+			t.Fatal(err)
+		}
+		r := newAEADReader(iotest.OneByteReader(bytes.NewReader(wire.Bytes())), testAEAD(t, clientAEAD, testServerNonce))
+		got, err := io.ReadAll(r)
+		if err != nil || !bytes.Equal(got, src[:size]) {
+			t.Fatalf("size %d: read %d bytes, err = %v", size, len(got), err)
+		}
+	}
+}
+
+func TestAEADRejects(t *testing.T) {
+	chunks := [][]byte{[]byte("first record"), []byte("second record"), []byte("third record")}
+	records := sealRecords(t, testAEAD(t, clientAEAD, testServerNonce), chunks...)
+	join := func(parts ...[]byte) []byte { return bytes.Join(parts, nil) }
+	tamper := func(record []byte, i int) []byte {
+		record = append([]byte(nil), record...)
+		record[i] ^= 1
+		return record
+	}
+
+	for _, tc := range []struct {
+		name string
+		wire []byte
+		// 出错之前应当读出的数据
+		before []byte
+		want   error
+	}{
+		{"tampered length", tamper(records[0], 0), nil, ErrAuthFailed},
+		{"tampered length tag", tamper(records[0], 2), nil, ErrAuthFailed},
+		{"tampered payload", join(records[0], tamper(records[1], 2+aeadTagSize)), chunks[0], ErrAuthFailed},
+		{"tampered payload tag", tamper(records[0], len(records[0])-1), nil, ErrAuthFailed},
+		{"reordered", join(records[1], records[0]), nil, ErrAuthFailed},
+		{"replayed", join(records[0], records[0]), chunks[0], ErrAuthFailed},
+		{"dropped", join(records[0], records[2]), chunks[0], ErrAuthFailed},
+		{"truncated", records[0][:len(records[0])-1], nil, io.ErrUnexpectedEOF},
+	} {
+		got, err := openAll(testAEAD(t, clientAEAD, testServerNonce), tc.wire)
+		if !errors.Is(err, tc.want) || !bytes.Equal(got, tc.before) {
+			t.Errorf("%s: read %q, err = %v, want %q and %v", tc.name, got, err, tc.before, tc.want)
+		}
+	}
+
+	// 认证失败之后的读取都返回同一个错误
+	r := newAEADReader(bytes.NewReader(join(tamper(records[0], 0), records[1])), testAEAD(t, clientAEAD, testServerNonce))
+	for i := 0; i < 2; i++ {
+		if _, err := r.Read(make([]byte, 64)); !errors.Is(err, ErrAuthFailed) {
+			t.Fatalf("read %d after failure: err = %v", i, err)
+		}
+	}
+}
+
+func TestAEADKeys(t *testing.T) {
+	wire := bytes.Join(sealRecords(t, testAEAD(t, clientAEAD, testServerNonce), []byte("request")), nil)
+
+	// 重放录下的上行数据时服务端使用新的随机数，派生出不同的密钥
+	otherNonce := bytes.Repeat([]byte{0x77}, sudoku.NonceSize)
+	if _, err := openAll(testAEAD(t, clientAEAD, otherNonce), wire); !errors.Is(err, ErrAuthFailed) {
+		t.Fatalf("upstream keyed with another server nonce: err = %v", err)
+	}
+	// 两个方向的密钥不同，上行数据不能被当作下行数据
+	if _, err := openAll(testAEAD(t, serverAEAD, testServerNonce), wire); !errors.Is(err, ErrAuthFailed) {
+		t.Fatalf("upstream opened with the downstream key: err = %v", err)
+	}
+	// 不同的预共享密钥
+	aead, _ := clientAEAD("other", testClientNonce, testServerNonce)
+	if _, err := openAll(newAEADState(aead), wire); !errors.Is(err, ErrAuthFailed) {
+		t.Fatalf("opened with another psk: err = %v", err)
+	}
+	if got, err := openAll(testAEAD(t, clientAEAD, testServerNonce), wire); err != nil || string(got) != "request" {
+		t.Fatalf("read %q, err = %v", got, err)
+	}
+}
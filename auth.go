@@ -0,0 +1,113 @@
+package sudoku_go
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"sudoku_go/sudoku"
+	"sync"
+	"time"
+)
+
+const (
+	// 客户端和服务端允许的最大时钟偏差
+	authMaxSkew = 120 * time.Second
+	// 防重放缓存最多记录的随机数数量
+	replayCacheSize = 64 * 1024
+)
+
+var (
+	ErrAuthRequired   = errors.New("auth: authentication required")
+	ErrUnknownUser    = errors.New("auth: unknown user")
+	ErrBadMAC         = errors.New("auth: bad mac")
+	ErrStaleTimestamp = errors.New("auth: stale timestamp")
+	ErrReplay         = errors.New("auth: replayed nonce")
+)
+
+// 为 Version2 请求填写认证信息并签名，请求的其它部分必须已经填好
+func signRequest(req *sudoku.Request, user, secret string) {
+	req.Version = sudoku.Version2
+	req.UserID = []byte(user)
+	req.Timestamp = time.Now().Unix()
+	req.MAC = nil
+	req.MAC = requestMAC(req, secret)
+}
+
+func requestMAC(req *sudoku.Request, secret string) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(req.AuthBytes())
+	return mac.Sum(nil)
+}
+
+// 校验请求的用户认证信息
+// 服务端没有配置用户时只接受 Version1 请求，否则只接受认证通过的 Version2 请求
+func (lsServer *LsServer) authenticate(req *sudoku.Request) error {
+	if req.Version != sudoku.Version2 {
+		if len(lsServer.Users) == 0 {
+			return nil
+		}
+		return ErrAuthRequired
+	}
+	secret, ok := lsServer.Users[string(req.UserID)]
+	if !ok {
+		return ErrUnknownUser
+	}
+	if !hmac.Equal(req.MAC, requestMAC(req, secret)) {
+		return ErrBadMAC
+	}
+	skew := time.Since(time.Unix(req.Timestamp, 0))
+	if skew > authMaxSkew || skew < -authMaxSkew {
+		return ErrStaleTimestamp
+	}
+	// 时间戳超出范围的请求已经被拒绝，缓存只需要覆盖时间窗口内的随机数
+	if !lsServer.replay.add(req.Nonce, time.Now()) {
+		return ErrReplay
+	}
+	return nil
+}
+
+// 有界的防重放缓存
+// 记录认证通过的请求随机数，超过时间窗口的记录视为过期，缓存满时淘汰最早的记录
+type replayCache struct {
+	lock  sync.Mutex
+	seen  map[[sudoku.NonceSize]byte]time.Time
+	order []replayEntry
+	head  int
+}
+
+type replayEntry struct {
+	nonce [sudoku.NonceSize]byte
+	at    time.Time
+}
+
+func newReplayCache(size int) *replayCache {
+	return &replayCache{
+		seen:  make(map[[sudoku.NonceSize]byte]time.Time, size),
+		order: make([]replayEntry, 0, size),
+	}
+}
+
+// 记录随机数，随机数在时间窗口内出现过时返回 false
+func (cache *replayCache) add(nonce []byte, now time.Time) bool {
+	entry := replayEntry{at: now}
+	copy(entry.nonce[:], nonce)
+
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	if at, ok := cache.seen[entry.nonce]; ok && now.Sub(at) <= 2*authMaxSkew {
+		return false
+	}
+	if len(cache.order) < cap(cache.order) {
+		cache.order = append(cache.order, entry)
+	} else {
+		// 过期后重新记录的随机数在 order 中出现多次，只有最新的记录对应 seen 中的值
+		oldest := cache.order[cache.head]
+		if cache.seen[oldest.nonce].Equal(oldest.at) {
+			delete(cache.seen, oldest.nonce)
+		}
+		cache.order[cache.head] = entry
+		cache.head = (cache.head + 1) % len(cache.order)
+	}
+	cache.seen[entry.nonce] = now
+	return true
+}
@@ -0,0 +1,230 @@
+package sudoku_go
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"sudoku_go/sudoku"
+	"testing"
+	"time"
+)
+
+func authServer(t *testing.T) *LsServer {
+	server, err := NewLsServer("127.0.0.1:0", "auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.Users = map[string]string{"alice": "secret", "Bob": "other"}
+	return server
+}
+
+func signedRequest(user, secret string, mutate func(req *sudoku.Request)) *sudoku.Request {
+	req := *sudoku.DefaultRequest
+	req.Nonce = make([]byte, sudoku.NonceSize)
+	rand.Read(req.Nonce)
+	signRequest(&req, user, secret)
+	if mutate != nil {
+		mutate(&req)
+	}
+	return &req
+}
+
+// 修改时间戳之后重新签名
+func at(skew time.Duration, secret string) func(req *sudoku.Request) {
+	return func(req *sudoku.Request) {
+		req.Timestamp = time.Now().Add(skew).Unix()
+		req.MAC = nil
+		req.MAC = requestMAC(req, secret)
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	server := authServer(t)
+	for _, tc := range []struct {
+		name string
+		req  *sudoku.Request
+		want error
+	}{
+		{"valid", signedRequest("alice", "secret", nil), nil},
+		{"user id is case sensitive", signedRequest("Bob", "other", nil), nil},
+		{"version1", func() *sudoku.Request { req := *sudoku.DefaultRequest; return &req }(), ErrAuthRequired},
+		{"unknown user", signedRequest("mallory", "secret", nil), ErrUnknownUser},
+		{"lowercased user", signedRequest("bob", "other", nil), ErrUnknownUser},
+		{"wrong secret", signedRequest("alice", "guess", nil), ErrBadMAC},
+		{"tampered code", signedRequest("alice", "secret", func(req *sudoku.Request) { req.Code ^= 1 }), ErrBadMAC},
+		{"tampered nonce", signedRequest("alice", "secret", func(req *sudoku.Request) { req.Nonce[0] ^= 1 }), ErrBadMAC},
+		{"tampered timestamp", signedRequest("alice", "secret", func(req *sudoku.Request) { req.Timestamp++ }), ErrBadMAC},
+		{"truncated mac", signedRequest("alice", "secret", func(req *sudoku.Request) { req.MAC = req.MAC[:16] }), ErrBadMAC},
+		{"skew within window", signedRequest("alice", "secret", at(-100*time.Second, "secret")), nil},
+		{"ahead within window", signedRequest("alice", "secret", at(100*time.Second, "secret")), nil},
+		{"too old", signedRequest("alice", "secret", at(-authMaxSkew-5*time.Second, "secret")), ErrStaleTimestamp},
+		{"too far ahead", signedRequest("alice", "secret", at(authMaxSkew+5*time.Second, "secret")), ErrStaleTimestamp},
+	} {
+		if err := server.authenticate(tc.req); !errors.Is(err, tc.want) {
+			t.Errorf("%s: err = %v, want %v", tc.name, err, tc.want)
+		}
+	}
+
+	// 同一个请求第二次出现时被拒绝
+	req := signedRequest("alice", "secret", nil)
+	if err := server.authenticate(req); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.authenticate(req); !errors.Is(err, ErrReplay) {
+		t.Fatalf("replayed request: err = %v, want ErrReplay", err)
+	}
+	// 被拒绝的请求不占用随机数，签名正确的同一个随机数仍然可以使用
+	bad := signedRequest("alice", "guess", nil)
+	server.authenticate(bad)
+	good := signedRequest("alice", "secret", func(req *sudoku.Request) {
+		req.Nonce = bad.Nonce
+		req.MAC = nil
+		req.MAC = requestMAC(req, "secret")
+	})
+	if err := server.authenticate(good); err != nil {
+		t.Fatalf("nonce of a rejected request: %v", err)
+	}
+
+	// 没有配置用户时只接受 Version1 请求
+	server.Users = nil
+	if err := server.authenticate(sudoku.DefaultRequest); err != nil {
+		t.Fatalf("version1 without users: %v", err)
+	}
+	if err := server.authenticate(signedRequest("alice", "secret", nil)); !errors.Is(err, ErrUnknownUser) {
+		t.Fatalf("version2 without users: err = %v", err)
+	}
+}
+
+func nonce(b byte) []byte {
+	return bytes.Repeat([]byte{b}, sudoku.NonceSize)
+}
+
+func TestReplayCache(t *testing.T) {
+	now := time.Now()
+	cache := newReplayCache(3)
+	for _, tc := range []struct {
+		name  string
+		nonce byte
+		at    time.Duration
+		want  bool
+	}{
+		{"first", 1, 0, true},
+		{"replay", 1, time.Second, false},
+		{"replay at the edge of the window", 1, 2 * authMaxSkew, false},
+		{"second", 2, 0, true},
+		{"third", 3, 0, true},
+		// 缓存已满，淘汰最早的随机数 1
+		{"fourth evicts the oldest", 4, time.Second, true},
+		{"evicted nonce", 1, time.Second, true},
+		{"kept nonce", 3, time.Second, false},
+		// 超出时间窗口的记录视为过期
+		{"expired", 3, 2*authMaxSkew + time.Second, true},
+	} {
+		if got := cache.add(nonce(tc.nonce), now.Add(tc.at)); got != tc.want {
+			t.Errorf("%s: add(%d) = %v, want %v", tc.name, tc.nonce, got, tc.want)
+		}
+	}
+	if len(cache.seen) > 3 || len(cache.order) != 3 {
+		t.Fatalf("cache holds %d nonces in %d slots", len(cache.seen), len(cache.order))
+	}
+
+	// 过期后重新记录的随机数，淘汰旧的记录时不能删除新的记录
+	cache = newReplayCache(2)
+	cache.add(nonce(1), now)
+	later := now.Add(2*authMaxSkew + time.Second)
+	if !cache.add(nonce(1), later) {
+		t.Fatal("expired nonce was not accepted")
+	}
+	cache.add(nonce(2), later)
+	if cache.add(nonce(1), later) {
+		t.Fatal("evicting the stale entry forgot the newer one")
+	}
+}
+
+// 握手一个认证失败的请求，返回客户端收到的全部数据
+func failedHandshake(t *testing.T, server *LsServer, req *sudoku.Request) []byte {
+	clientConn, serverConn := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		server.handleConn(&SecureTCPConn{ReadWriteCloser: serverConn}, slog.Default())
+	}()
+	defer func() {
+		clientConn.Close()
+		<-done
+	}()
+	clientConn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := req.WriteTo(clientConn); err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(clientConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return got
+}
+
+// 诱饵服务读完握手之后返回一个 HTTP 响应
+func decoy(t *testing.T) (string, chan []byte) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	handshakes := make(chan []byte, 4)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			buf := make([]byte, 4096)
+			n, _ := conn.Read(buf)
+			handshakes <- buf[:n]
+			conn.Write([]byte("HTTP/1.1 400 Bad Request\r\n\r\n"))
+			conn.Close()
+		}
+	}()
+	return listener.Addr().String(), handshakes
+}
+
+func TestAuthFailureResponse(t *testing.T) {
+	req := signedRequest("alice", "guess", nil)
+
+	// 默认返回 StatusUnauthorized
+	server := authServer(t)
+	resp := &sudoku.Response{}
+	if _, err := resp.ReadFrom(bytes.NewReader(failedHandshake(t, server, req))); err != nil || resp.Status != sudoku.StatusUnauthorized {
+		t.Fatalf("status = %#x, err = %v", resp.Status, err)
+	}
+
+	// 静默时直接断开，不返回任何数据
+	server.Silent = true
+	if got := failedHandshake(t, server, req); len(got) != 0 {
+		t.Fatalf("silent server sent %q", got)
+	}
+
+	// 静默并且设置了诱饵服务时，客户端只收到诱饵服务的数据，诱饵服务收到完整的握手
+	addr, handshakes := decoy(t)
+	server.Fallback = addr
+	want := "HTTP/1.1 400 Bad Request\r\n\r\n"
+	if got := failedHandshake(t, server, req); string(got) != want {
+		t.Fatalf("client received %q, want the decoy response", got)
+	}
+	if got := <-handshakes; !bytes.Equal(got, req.Bytes()) {
+		t.Fatalf("decoy received %d bytes, want the %d byte handshake", len(got), len(req.Bytes()))
+	}
+
+	// 要求 AEAD 而客户端没有提议时，设置了诱饵服务也不返回 StatusUnauthorized
+	server = authServer(t)
+	server.Key = "auth"
+	server.AEAD = true
+	server.Fallback = addr
+	if got := failedHandshake(t, server, signedRequest("alice", "secret", nil)); string(got) != want {
+		t.Fatalf("client without AEAD received %q, want the decoy response", got)
+	}
+	<-handshakes
+}
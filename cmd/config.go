@@ -2,10 +2,11 @@ package cmd
 
 import (
 	"errors"
-	"fmt"
 	"log"
+	"log/slog"
 	"os"
 	"path"
+	"strings"
 
 	"github.com/mitchellh/go-homedir"
 	"github.com/spf13/viper"
@@ -17,9 +18,80 @@ var (
 )
 
 type Config struct {
-	ListenAddr string   `mapstructure:"listen"`
-	RemoteAddr string   `mapstructure:"remote"`
-	ObfDomain  []string `mapstructure:"obf_domain"`
+	ListenAddr string `mapstructure:"listen"`
+	RemoteAddr string `mapstructure:"remote"`
+	// 客户端的多个服务端地址，不为空时代替 RemoteAddr
+	Remotes []string `mapstructure:"remotes"`
+	// 多个服务端的选择策略 failover、round-robin 或 latency
+	Strategy string `mapstructure:"strategy"`
+	// 多个服务端时健康检查的间隔秒数
+	HealthCheck int      `mapstructure:"health_check"`
+	ObfDomain   []string `mapstructure:"obf_domain"`
+	// 预共享密钥，客户端和服务端必须一致
+	Key string `mapstructure:"key"`
+	// 是否在数独编码之下启用 AEAD 加密，需要设置 Key
+	AEAD bool `mapstructure:"aead"`
+	// 编码器的 SB CODE，客户端用于提议，服务端在客户端提议不受支持时使用
+	Codec uint8 `mapstructure:"codec"`
+	// 客户端多路复用的隧道数量，为 0 时不启用多路复用
+	Mux int `mapstructure:"mux"`
+	// 服务端握手失败时转交连接的诱饵服务地址
+	Fallback string `mapstructure:"fallback"`
+	// 客户端的用户 ID 和用户密钥
+	User   string `mapstructure:"user"`
+	Secret string `mapstructure:"secret"`
+	// 服务端的用户列表，不为空时要求客户端认证
+	// 用列表而不是映射，viper 会把映射的键转换成小写
+	Users []UserConfig `mapstructure:"users"`
+	// 服务端认证失败时不返回错误状态
+	AuthSilent bool `mapstructure:"auth_silent"`
+	// 客户端使用 TLS 握手模式，服务端自动识别
+	TLS bool `mapstructure:"tls"`
+	// 客户端透明代理模式 redirect 或 tproxy，以及透明代理的监听地址
+	Transparent       string `mapstructure:"transparent"`
+	TransparentListen string `mapstructure:"transparent_listen"`
+	// 客户端的路由规则，按顺序匹配，格式见 sudoku_go.Router
+	Rules []string `mapstructure:"rules"`
+	// GeoIP 数据库文件路径，每行为 CIDR 和国家代码
+	GeoIP string `mapstructure:"geoip"`
+	// 服务端的出站访问控制规则，格式见 sudoku_go.ACL
+	ACL []string `mapstructure:"acl"`
+	// 服务端是否允许连接回环、私有等内部网段
+	AllowPrivate bool `mapstructure:"allow_private"`
+	// 服务端解析目标域名的上游 DNS 服务器，格式见 sudoku_go.Resolver，为空时使用系统解析器
+	DNS []string `mapstructure:"dns"`
+	// 服务端的地址族偏好 ipv4 或 ipv6
+	DNSPrefer string `mapstructure:"dns_prefer"`
+	// 客户端的反向隧道，格式为 服务端监听地址=本地目标地址
+	Reverse []string `mapstructure:"reverse"`
+	// 服务端允许客户端注册反向隧道的监听地址，只能在没有设置用户时使用
+	ReverseListen []string `mapstructure:"reverse_listen"`
+	// 服务端的上游代理名字到 URL 的映射，格式见 sudoku_go.ParseProxy
+	Proxies map[string]string `mapstructure:"proxies"`
+	// 服务端选择直连或上游代理的规则，格式见 sudoku_go.Outbounds
+	ProxyRules []string `mapstructure:"proxy_rules"`
+	// 日志级别 debug、info、warn 或 error，只有 debug 级别输出目标地址
+	LogLevel string `mapstructure:"log_level"`
+	// 日志格式 text 或 json
+	LogFormat string `mapstructure:"log_format"`
+	// 导出 Prometheus 指标的 HTTP 地址，例如 127.0.0.1:9100，为空时不启用
+	Metrics string `mapstructure:"metrics"`
+	// 管理接口的地址，只能是回环地址，或者以 unix: 开头的 unix socket 路径
+	Admin string `mapstructure:"admin"`
+	// 收到退出信号后等待连接结束的秒数，超时后强制关闭
+	DrainTimeout int `mapstructure:"drain_timeout"`
+	// 握手、建立出站连接和转发空闲的超时秒数，为 0 时不限制
+	HandshakeTimeout int `mapstructure:"handshake_timeout"`
+	DialTimeout      int `mapstructure:"dial_timeout"`
+	IdleTimeout      int `mapstructure:"idle_timeout"`
+}
+
+// 服务端的一个用户
+type UserConfig struct {
+	ID     string `mapstructure:"id"`
+	Secret string `mapstructure:"secret"`
+	// 只有这个用户可以注册的反向隧道监听地址
+	Reverse []string `mapstructure:"reverse"`
 }
 
 func init() {
@@ -27,7 +99,8 @@ func init() {
 	// 默认的配置文件名称
 	configFilename := ".lightsocks.yaml"
 	// 如果用户有传配置文件，就使用用户传入的配置文件
-	if len(os.Args) == 2 {
+	// 以 - 开头的是命令行参数，例如只传了 -aead，不能当作配置文件名
+	if len(os.Args) == 2 && !strings.HasPrefix(os.Args[1], "-") {
 		configFilename = os.Args[1]
 	}
 	configPath = path.Join(home, configFilename)
@@ -37,15 +110,54 @@ func init() {
 }
 
 // 保存配置到配置文件
+// 命令行传入的密钥、用户密钥和带密码的上游代理不写入配置文件，配置文件中已有的保持不变
+// 配置文件可能含有这些密钥，只允许当前用户读写
 func (config *Config) SaveConfig() {
 	viper.Set("listen", config.ListenAddr)
 	viper.Set("remote", config.RemoteAddr)
+	viper.Set("remotes", config.Remotes)
+	viper.Set("strategy", config.Strategy)
+	viper.Set("health_check", config.HealthCheck)
 	viper.Set("obf_domain", config.ObfDomain)
-	err := viper.WriteConfigAs(configPath)
+	viper.Set("aead", config.AEAD)
+	viper.Set("codec", config.Codec)
+	viper.Set("mux", config.Mux)
+	viper.Set("fallback", config.Fallback)
+	viper.Set("user", config.User)
+	viper.Set("auth_silent", config.AuthSilent)
+	viper.Set("tls", config.TLS)
+	viper.Set("transparent", config.Transparent)
+	viper.Set("transparent_listen", config.TransparentListen)
+	viper.Set("rules", config.Rules)
+	viper.Set("geoip", config.GeoIP)
+	viper.Set("acl", config.ACL)
+	viper.Set("allow_private", config.AllowPrivate)
+	viper.Set("dns", config.DNS)
+	viper.Set("dns_prefer", config.DNSPrefer)
+	viper.Set("reverse", config.Reverse)
+	viper.Set("reverse_listen", config.ReverseListen)
+	viper.Set("proxy_rules", config.ProxyRules)
+	viper.Set("log_level", config.LogLevel)
+	viper.Set("log_format", config.LogFormat)
+	viper.Set("metrics", config.Metrics)
+	viper.Set("admin", config.Admin)
+	viper.Set("drain_timeout", config.DrainTimeout)
+	viper.Set("handshake_timeout", config.HandshakeTimeout)
+	viper.Set("dial_timeout", config.DialTimeout)
+	viper.Set("idle_timeout", config.IdleTimeout)
+	// viper 写入已有的文件时保留文件的权限
+	file, err := os.OpenFile(configPath, os.O_CREATE|os.O_WRONLY, 0600)
+	if err == nil {
+		file.Close()
+		err = os.Chmod(configPath, 0600)
+	}
+	if err == nil {
+		err = viper.WriteConfigAs(configPath)
+	}
 	if err != nil {
-		fmt.Errorf("保存配置到文件 %s 出错: %s", configPath, err)
+		slog.Warn("保存配置出错", "path", configPath, "err", err)
 	} else {
-		log.Printf("保存配置到文件 %s 成功\n", configPath)
+		slog.Info("保存配置成功", "path", configPath)
 	}
 }
 
@@ -55,10 +167,10 @@ func (config *Config) ReadConfig() {
 	if err := viper.ReadInConfig(); err != nil {
 		var configFileNotFoundError viper.ConfigFileNotFoundError
 		if errors.As(err, &configFileNotFoundError) {
-			log.Printf("配置文件 %s 不存在，使用默认配置\n", configPath)
+			slog.Info("配置文件不存在，使用默认配置", "path", configPath)
 		}
 	} else {
-		log.Printf("从文件 %s 中读取配置\n", configPath)
+		slog.Info("读取配置文件", "path", configPath)
 		err := viper.Unmarshal(config)
 		if err != nil {
 			log.Fatalf("格式不合法的 YAML 配置文件: %s", err)
@@ -1,56 +1,225 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
+	"log/slog"
 	"net"
+	"os"
+	"os/signal"
+	"strings"
 	"sudoku_go"
 	"sudoku_go/cmd"
-	"sudoku_go/global"
 	"sudoku_go/sudoku"
+	"syscall"
+	"time"
 )
 
 const (
 	DefaultListenAddr = "127.0.0.1:7789"
 	//DefaultRemoteAddr = "172.245.242.86:17789"
 	DefaultRemoteAddr = "127.0.0.1:17789"
+	// 透明代理默认监听地址
+	DefaultTransparentAddr = ":7790"
 )
 
-func init() {
-	sudoku.GenByteMap()
-	sudoku.AllPuzzle()
-	global.ByteList = &[256][]string{}
-	for i := 0; i < 256; i++ {
-		global.ByteList[i] = sudoku.ByteToSudokuList(byte(i))
-	}
-}
-
 func main() {
-	log.SetFlags(log.Lshortfile)
-
 	listenAddr := flag.String("l", DefaultListenAddr, "Local listen address")
-	remoteAddr := flag.String("r", DefaultRemoteAddr, "Remote server address")
+	remoteAddr := flag.String("r", DefaultRemoteAddr, "Remote server address, or a comma-separated list of them")
+	strategy := flag.String("strategy", sudoku_go.StrategyFailover, "How to pick among remote servers: failover, round-robin or latency")
+	healthCheck := flag.Int("health-check", 30, "Seconds between health checks of remote servers, 0 disables them")
+	key := flag.String("k", "", "Pre-shared key, must match the server")
+	aead := flag.Bool("aead", false, "Encrypt and authenticate traffic with a key derived from -k")
+	codec := flag.Uint("codec", uint(sudoku.DefaultRequest.Code), "SB CODE of the codec offered to the server")
+	user := flag.String("u", "", "User ID, enables per-user authentication")
+	secret := flag.String("secret", "", "Secret of the user given by -u")
+	useTLS := flag.Bool("tls", false, "Hide the handshake in a TLS 1.3 ClientHello and send data in application_data records")
+	transparent := flag.String("transparent", "", "Transparent proxy mode for iptables, redirect or tproxy")
+	transparentListen := flag.String("transparent-listen", DefaultTransparentAddr, "Transparent proxy listen address")
+	mux := flag.Int("mux", 0, "Number of tunnels to multiplex connections over, 0 disables multiplexing")
+	reverse := flag.String("reverse", "", "Comma-separated reverse tunnels listen=target, e.g. 127.0.0.1:8022=192.168.1.10:22; the server must allow the listen address")
+	logLevel := flag.String("log-level", "info", "Log level: debug, info, warn or error; target hosts are only logged at debug")
+	logFormat := flag.String("log-format", sudoku_go.LogFormatText, "Log format: text or json")
+	metrics := flag.String("metrics", "", "Address to serve Prometheus metrics on at /metrics, e.g. 127.0.0.1:9101")
+	admin := flag.String("admin", "", "Loopback address or unix:/path socket for the admin API")
+	drain := flag.Int("drain", 30, "Seconds to wait for connections to finish after SIGINT or SIGTERM before closing them")
+	handshakeTimeout := flag.Int("handshake-timeout", int(sudoku_go.DefaultHandshakeTimeout/time.Second), "Seconds allowed for reading a proxy request and for the handshake with the server, 0 disables it")
+	dialTimeout := flag.Int("dial-timeout", int(sudoku_go.DefaultDialTimeout/time.Second), "Seconds allowed for connecting to the server or a direct target, 0 disables it")
+	idleTimeout := flag.Int("idle-timeout", int(sudoku_go.DefaultIdleTimeout/time.Second), "Seconds a connection may stay idle in both directions before it is closed, 0 disables it")
 
 	flag.Parse()
 
 	// 默认配置
 	config := &cmd.Config{
-		ListenAddr: *listenAddr,
-		RemoteAddr: *remoteAddr,
+		ListenAddr:  *listenAddr,
+		RemoteAddr:  *remoteAddr,
+		Strategy:    *strategy,
+		HealthCheck: *healthCheck,
+		Key:         *key,
+		AEAD:        *aead,
+		Codec:       uint8(*codec),
+		Mux:         *mux,
+		User:        *user,
+		Secret:      *secret,
+		TLS:         *useTLS,
+		LogLevel:    *logLevel,
+		LogFormat:   *logFormat,
+		Metrics:     *metrics,
+		Admin:       *admin,
+
+		DrainTimeout:     *drain,
+		HandshakeTimeout: *handshakeTimeout,
+		DialTimeout:      *dialTimeout,
+		IdleTimeout:      *idleTimeout,
+
+		Transparent:       *transparent,
+		TransparentListen: *transparentListen,
+	}
+	config.ReadConfig()
+	// 命令行显式指定的参数优先于配置文件
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "l":
+			config.ListenAddr = *listenAddr
+		case "r":
+			// 命令行给出的服务端列表替换配置文件中的列表
+			config.RemoteAddr = *remoteAddr
+			config.Remotes = nil
+		case "strategy":
+			config.Strategy = *strategy
+		case "health-check":
+			config.HealthCheck = *healthCheck
+		case "k":
+			config.Key = *key
+		case "aead":
+			config.AEAD = *aead
+		case "codec":
+			config.Codec = uint8(*codec)
+		case "mux":
+			config.Mux = *mux
+		case "u":
+			config.User = *user
+		case "secret":
+			config.Secret = *secret
+		case "tls":
+			config.TLS = *useTLS
+		case "transparent":
+			config.Transparent = *transparent
+		case "transparent-listen":
+			config.TransparentListen = *transparentListen
+		case "reverse":
+			config.Reverse = strings.Split(*reverse, ",")
+		case "log-level":
+			config.LogLevel = *logLevel
+		case "log-format":
+			config.LogFormat = *logFormat
+		case "metrics":
+			config.Metrics = *metrics
+		case "admin":
+			config.Admin = *admin
+		case "drain":
+			config.DrainTimeout = *drain
+		case "handshake-timeout":
+			config.HandshakeTimeout = *handshakeTimeout
+		case "dial-timeout":
+			config.DialTimeout = *dialTimeout
+		case "idle-timeout":
+			config.IdleTimeout = *idleTimeout
+		}
+	})
+	if err := sudoku_go.SetupLogger(os.Stderr, config.LogLevel, config.LogFormat); err != nil {
+		log.Fatalln(err)
+	}
+	if len(config.User) > 255 {
+		log.Fatalln("用户 ID 过长")
+	}
+	for _, domain := range config.ObfDomain {
+		if len(domain) == 0 || len(domain) > 255 {
+			log.Fatalf("混淆域名不合法: %q", domain)
+		}
+	}
+	if config.AEAD && config.Key == "" {
+		log.Fatalln("启用 AEAD 需要设置预共享密钥")
+	}
+
+	// 启动时预先构建码本
+	if _, err := sudoku_go.NewCodec(config.Codec, config.Key); err != nil {
+		log.Fatalf("编码器 %#x: %v", config.Codec, err)
+	}
+
+	// 配置文件中的 remotes 优先于 remote
+	remoteList := config.Remotes
+	if len(remoteList) == 0 {
+		remoteList = strings.Split(config.RemoteAddr, ",")
+	}
+	var remoteAddrs []string
+	for _, addr := range remoteList {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			remoteAddrs = append(remoteAddrs, addr)
+		}
 	}
 
 	// 启动 local 端并监听
-	lsLocal, err := sudoku_go.NewLsLocal(config.ListenAddr, config.RemoteAddr)
+	lsLocal, err := sudoku_go.NewLsLocal(config.ListenAddr, remoteAddrs, config.Key)
 	if err != nil {
 		log.Fatalln(err)
 	}
-	log.Println()
-	log.Fatalln(lsLocal.Listen(func(listenAddr net.Addr) {
+	lsLocal.Strategy = config.Strategy
+	lsLocal.HealthCheckInterval = time.Duration(config.HealthCheck) * time.Second
+	lsLocal.AEAD = config.AEAD
+	lsLocal.Code = config.Codec
+	lsLocal.Mux = config.Mux
+	lsLocal.User = config.User
+	lsLocal.Secret = config.Secret
+	lsLocal.TLS = config.TLS
+	lsLocal.ObfDomains = config.ObfDomain
+	lsLocal.MetricsAddr = config.Metrics
+	lsLocal.AdminAddr = config.Admin
+	lsLocal.DrainTimeout = time.Duration(config.DrainTimeout) * time.Second
+	lsLocal.HandshakeTimeout = time.Duration(config.HandshakeTimeout) * time.Second
+	lsLocal.DialTimeout = time.Duration(config.DialTimeout) * time.Second
+	lsLocal.IdleTimeout = time.Duration(config.IdleTimeout) * time.Second
+	if len(config.Rules) > 0 {
+		lsLocal.Router, err = sudoku_go.NewRouter(config.Rules, config.GeoIP)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+	for _, forward := range config.Reverse {
+		if forward = strings.TrimSpace(forward); forward == "" {
+			continue
+		}
+		reverseForward, err := sudoku_go.ParseReverse(forward)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		lsLocal.Reverse = append(lsLocal.Reverse, reverseForward)
+	}
+	if config.Transparent != "" {
+		lsLocal.Transparent = config.Transparent
+		lsLocal.TransparentAddr, err = net.ResolveTCPAddr("tcp", config.TransparentListen)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	// 收到 SIGINT 或 SIGTERM 后停止监听并排空连接，再次收到时直接退出
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+	err = lsLocal.Listen(ctx, func(listenAddr net.Addr) {
 		fmt.Println(fmt.Sprintf(`
 sudosocks-local 启动成功，配置如下：
 本地监听地址：%s
 远程服务地址：%s
-`, listenAddr, config.RemoteAddr))
-	}))
+`, listenAddr, strings.Join(remoteAddrs, ", ")))
+	})
+	if err != nil {
+		log.Fatalln(err)
+	}
+	slog.Info("sudosocks-local stopped")
 }
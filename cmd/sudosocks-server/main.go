@@ -1,31 +1,26 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
+	"log/slog"
 	"net"
+	"os"
+	"os/signal"
 	"strconv"
+	"strings"
 	"sudoku_go"
 	"sudoku_go/cmd"
-	"sudoku_go/global"
 	"sudoku_go/sudoku"
+	"syscall"
+	"time"
 )
 
 var version = "master"
 
-func init() {
-	sudoku.GenByteMap()
-	sudoku.AllPuzzle()
-	global.ByteList = &[256][]string{}
-	for i := 0; i < 256; i++ {
-		global.ByteList[i] = sudoku.ByteToSudokuList(byte(i))
-	}
-}
-
 func main() {
-	log.SetFlags(log.Lshortfile)
-
 	// 优先从环境变量中获取监听端口
 	//port, err := strconv.Atoi(os.Getenv("LIGHTSOCKS_SERVER_PORT"))
 	//if err != nil {
@@ -37,26 +32,190 @@ func main() {
 	//	port, err = freeport.GetFreePort()
 	//}
 	argPort := flag.String("p", "17789", "Port")
+	argKey := flag.String("k", "", "Pre-shared key, must match the client")
+	argAEAD := flag.Bool("aead", false, "Require clients to encrypt and authenticate traffic")
+	argCodec := flag.Uint("codec", uint(sudoku.DefaultRequest.Code), "SB CODE of the codec used when the client offers an unsupported one")
+	argFallback := flag.String("fallback", "", "Decoy address that connections failing the handshake are spliced to, e.g. 127.0.0.1:80")
+	argSilent := flag.Bool("silent", false, "Close or fall back silently instead of answering unauthorized clients")
+	argAllowPrivate := flag.Bool("allow-private", false, "Allow clients to reach loopback, private and link-local addresses")
+	argDNS := flag.String("dns", "", "Comma-separated upstream DNS servers, e.g. 1.1.1.1,tcp://8.8.8.8,tls://1.1.1.1#cloudflare-dns.com; empty uses the system resolver")
+	argDNSPrefer := flag.String("dns-prefer", sudoku_go.PreferIPv4, "Address family tried first when a target has both: ipv4 or ipv6")
+	argReverseListen := flag.String("reverse-listen", "", "Comma-separated addresses clients may register reverse tunnels on, e.g. 127.0.0.1:8022; empty disables reverse tunnels")
+	argLogLevel := flag.String("log-level", "info", "Log level: debug, info, warn or error; target hosts are only logged at debug")
+	argLogFormat := flag.String("log-format", sudoku_go.LogFormatText, "Log format: text or json")
+	argMetrics := flag.String("metrics", "", "Address to serve Prometheus metrics on at /metrics, e.g. 127.0.0.1:9100")
+	argAdmin := flag.String("admin", "", "Loopback address or unix:/path socket for the admin API")
+	argDrain := flag.Int("drain", 30, "Seconds to wait for connections to finish after SIGINT or SIGTERM before closing them")
+	argHandshakeTimeout := flag.Int("handshake-timeout", int(sudoku_go.DefaultHandshakeTimeout/time.Second), "Seconds allowed for a client to complete the handshake and send its tunnel request, 0 disables it")
+	argDialTimeout := flag.Int("dial-timeout", int(sudoku_go.DefaultDialTimeout/time.Second), "Seconds allowed for connecting to a target, 0 disables it")
+	argIdleTimeout := flag.Int("idle-timeout", int(sudoku_go.DefaultIdleTimeout/time.Second), "Seconds a connection may stay idle in both directions before it is closed, 0 disables it")
+	flag.Parse()
 	port, _ := strconv.Atoi(*argPort)
 
 	fmt.Println("Port: ", port)
 
 	// 默认配置
 	config := &cmd.Config{
-		ListenAddr: fmt.Sprintf(":%d", port),
+		ListenAddr:   fmt.Sprintf(":%d", port),
+		Key:          *argKey,
+		AEAD:         *argAEAD,
+		Codec:        uint8(*argCodec),
+		Fallback:     *argFallback,
+		AuthSilent:   *argSilent,
+		AllowPrivate: *argAllowPrivate,
+		DNSPrefer:    *argDNSPrefer,
+		LogLevel:     *argLogLevel,
+		LogFormat:    *argLogFormat,
+		Metrics:      *argMetrics,
+		Admin:        *argAdmin,
+
+		DrainTimeout:     *argDrain,
+		HandshakeTimeout: *argHandshakeTimeout,
+		DialTimeout:      *argDialTimeout,
+		IdleTimeout:      *argIdleTimeout,
 	}
 	config.ReadConfig()
+	// 命令行显式指定的参数优先于配置文件
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "p":
+			config.ListenAddr = fmt.Sprintf(":%d", port)
+		case "k":
+			config.Key = *argKey
+		case "aead":
+			config.AEAD = *argAEAD
+		case "codec":
+			config.Codec = uint8(*argCodec)
+		case "fallback":
+			config.Fallback = *argFallback
+		case "silent":
+			config.AuthSilent = *argSilent
+		case "allow-private":
+			config.AllowPrivate = *argAllowPrivate
+		case "dns":
+			config.DNS = splitList(*argDNS)
+		case "dns-prefer":
+			config.DNSPrefer = *argDNSPrefer
+		case "reverse-listen":
+			config.ReverseListen = splitList(*argReverseListen)
+		case "log-level":
+			config.LogLevel = *argLogLevel
+		case "log-format":
+			config.LogFormat = *argLogFormat
+		case "metrics":
+			config.Metrics = *argMetrics
+		case "admin":
+			config.Admin = *argAdmin
+		case "drain":
+			config.DrainTimeout = *argDrain
+		case "handshake-timeout":
+			config.HandshakeTimeout = *argHandshakeTimeout
+		case "dial-timeout":
+			config.DialTimeout = *argDialTimeout
+		case "idle-timeout":
+			config.IdleTimeout = *argIdleTimeout
+		}
+	})
+	if err := sudoku_go.SetupLogger(os.Stderr, config.LogLevel, config.LogFormat); err != nil {
+		log.Fatalln(err)
+	}
+	if config.AEAD && config.Key == "" {
+		log.Fatalln("启用 AEAD 需要设置预共享密钥")
+	}
 	config.SaveConfig()
 
+	// 启动时预先构建码本
+	if _, err := sudoku_go.NewCodec(config.Codec, config.Key); err != nil {
+		log.Fatalf("编码器 %#x: %v", config.Codec, err)
+	}
+
 	// 启动 server 端并监听
-	lsServer, err := sudoku_go.NewLsServer(config.ListenAddr)
+	lsServer, err := sudoku_go.NewLsServer(config.ListenAddr, config.Key)
 	if err != nil {
 		log.Fatalln(err)
 	}
-	lsServer.Listen(func(listenAddr net.Addr) {
-		log.Println(fmt.Sprintf(`
+	lsServer.AEAD = config.AEAD
+	lsServer.Code = config.Codec
+	lsServer.Fallback = config.Fallback
+	if len(config.Users) > 0 {
+		lsServer.Users = make(map[string]string)
+	}
+	for _, user := range config.Users {
+		if user.ID == "" {
+			log.Fatalln("用户 ID 不能为空")
+		}
+		if _, ok := lsServer.Users[user.ID]; ok {
+			log.Fatalf("重复的用户 ID %s", user.ID)
+		}
+		lsServer.Users[user.ID] = user.Secret
+	}
+	// 设置了用户时反向隧道的地址属于某个用户，其他用户不能占用
+	if len(config.Users) > 0 && len(config.ReverseListen) > 0 {
+		log.Fatalln("设置了用户时在用户的 reverse 中设置反向隧道的监听地址")
+	}
+	lsServer.ReverseAddrs = make(map[string]string)
+	for _, addr := range config.ReverseListen {
+		lsServer.ReverseAddrs[addr] = ""
+	}
+	for _, user := range config.Users {
+		for _, addr := range user.Reverse {
+			if owner, ok := lsServer.ReverseAddrs[addr]; ok {
+				log.Fatalf("反向隧道地址 %s 已经属于用户 %s", addr, owner)
+			}
+			lsServer.ReverseAddrs[addr] = user.ID
+		}
+	}
+	lsServer.Silent = config.AuthSilent
+	lsServer.ACL, err = sudoku_go.NewACL(config.ACL, config.AllowPrivate)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	lsServer.Resolver, err = sudoku_go.NewResolver(config.DNS, config.DNSPrefer)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	proxies := make(map[string]sudoku_go.Outbound)
+	for name, proxyURL := range config.Proxies {
+		if proxies[name], err = sudoku_go.ParseProxy(proxyURL); err != nil {
+			log.Fatalf("上游代理 %s: %v", name, err)
+		}
+	}
+	lsServer.Outbounds, err = sudoku_go.NewOutbounds(proxies, config.ProxyRules)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	lsServer.MetricsAddr = config.Metrics
+	lsServer.AdminAddr = config.Admin
+	lsServer.DrainTimeout = time.Duration(config.DrainTimeout) * time.Second
+	lsServer.HandshakeTimeout = time.Duration(config.HandshakeTimeout) * time.Second
+	lsServer.DialTimeout = time.Duration(config.DialTimeout) * time.Second
+	lsServer.IdleTimeout = time.Duration(config.IdleTimeout) * time.Second
+
+	// 收到 SIGINT 或 SIGTERM 后停止监听并排空连接，再次收到时直接退出
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+	err = lsServer.Listen(ctx, func(listenAddr net.Addr) {
+		fmt.Println(fmt.Sprintf(`
 sudosocks-server:%s 启动成功，配置如下：
 服务监听地址：
 %s`, version, listenAddr))
 	})
+	if err != nil {
+		log.Fatalln(err)
+	}
+	slog.Info("sudosocks-server stopped")
+}
+
+// 逗号分隔的列表，忽略空项
+func splitList(s string) []string {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
 }
@@ -0,0 +1,69 @@
+package sudoku_go
+
+import (
+	"errors"
+	"sort"
+	"sudoku_go/sudoku"
+	"sync"
+)
+
+// Codec 原数据和线上数据之间的编码方式
+// 编码器按 SB CODE 注册，客户端在 sudoku.Request.Code 中提议，服务端在 sudoku.Response.Code 中确认
+type Codec interface {
+	// 把 src 编码后写入 dst，dst 的长度至少为 len(src)*Ratio()，返回写入的字节数
+	Encode(dst, src []byte) int
+	// 把 src 中完整的分组解码后写入 dst，末尾不足一个分组的部分会被忽略
+	// dst 的长度至少为 len(src)/Ratio()，返回写入的字节数
+	Decode(dst, src []byte) (int, error)
+	// 膨胀比，即一个原字节编码后的长度
+	Ratio() int
+}
+
+// 用预共享密钥创建编码器
+type CodecFactory func(key string) Codec
+
+var ErrUnsupportedCodec = errors.New("unsupported codec")
+
+var (
+	codecsLock sync.RWMutex
+	codecs     = make(map[uint8]CodecFactory)
+)
+
+// 注册编码器，SB CODE 的最高位保留给 sudoku.CodeAEAD
+func RegisterCodec(code uint8, factory CodecFactory) {
+	if code&sudoku.CodeAEAD != 0 {
+		panic("codec code conflicts with CodeAEAD")
+	}
+	codecsLock.Lock()
+	defer codecsLock.Unlock()
+	codecs[code] = factory
+}
+
+func NewCodec(code uint8, key string) (Codec, error) {
+	codecsLock.RLock()
+	factory, ok := codecs[code]
+	codecsLock.RUnlock()
+	if !ok {
+		return nil, ErrUnsupportedCodec
+	}
+	return factory(key), nil
+}
+
+func SupportedCodec(code uint8) bool {
+	codecsLock.RLock()
+	defer codecsLock.RUnlock()
+	_, ok := codecs[code]
+	return ok
+}
+
+// 所有已注册的 SB CODE，按从小到大排序
+func SupportedCodecs() []uint8 {
+	codecsLock.RLock()
+	defer codecsLock.RUnlock()
+	list := make([]uint8, 0, len(codecs))
+	for code := range codecs {
+		list = append(list, code)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i] < list[j] })
+	return list
+}
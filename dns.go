@@ -0,0 +1,170 @@
+package sudoku_go
+
+import (
+	"encoding/binary"
+	"errors"
+	"net/netip"
+	"strings"
+	"time"
+)
+
+// 只用于查询 A 和 AAAA 记录的 DNS 报文，见 RFC 1035
+
+const (
+	dnsTypeA    = 1
+	dnsTypeAAAA = 28
+	dnsClassIN  = 1
+
+	dnsHeaderSize = 12
+	// 报文头第三、四字节中的标志位
+	dnsFlagResponse  = 1 << 15
+	dnsFlagTruncated = 1 << 9
+	dnsFlagRecursion = 1 << 8
+	dnsRcodeMask     = 0x0f
+
+	dnsRcodeSuccess  = 0
+	dnsRcodeNXDomain = 3
+
+	// UDP 报文的最大长度，超过时服务端设置截断标志，改用 TCP 查询
+	dnsMaxUDPSize = 512
+)
+
+var (
+	ErrDNSBadName     = errors.New("dns: bad name")
+	ErrDNSBadMessage  = errors.New("dns: bad message")
+	ErrDNSMismatch    = errors.New("dns: response does not match query")
+	ErrDNSServerError = errors.New("dns: server failure")
+)
+
+// 构建查询报文，id 为报文 ID，qtype 为 dnsTypeA 或 dnsTypeAAAA
+func dnsQuery(id uint16, name string, qtype uint16) ([]byte, error) {
+	name = strings.TrimSuffix(name, ".")
+	if name == "" || len(name) > 253 {
+		return nil, ErrDNSBadName
+	}
+	msg := make([]byte, dnsHeaderSize, dnsHeaderSize+len(name)+6)
+	binary.BigEndian.PutUint16(msg[0:], id)
+	binary.BigEndian.PutUint16(msg[2:], dnsFlagRecursion)
+	// QDCOUNT
+	binary.BigEndian.PutUint16(msg[4:], 1)
+	for _, label := range strings.Split(name, ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return nil, ErrDNSBadName
+		}
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	msg = append(msg, 0)
+	msg = binary.BigEndian.AppendUint16(msg, qtype)
+	msg = binary.BigEndian.AppendUint16(msg, dnsClassIN)
+	return msg, nil
+}
+
+// DNS 响应中的地址和最短的 TTL
+type dnsAnswer struct {
+	addrs     []netip.Addr
+	ttl       time.Duration
+	nxdomain  bool
+	truncated bool
+}
+
+// 解析 query 对应的响应，取出回答中所有查询类型的记录
+// 响应的 ID 和问题都必须和查询一致，否则返回 ErrDNSMismatch
+// 递归服务器会在同一个回答中返回 CNAME 链和最终的地址，这里不逐级追踪 CNAME
+func dnsParse(msg, query []byte) (*dnsAnswer, error) {
+	if len(msg) < dnsHeaderSize {
+		return nil, ErrDNSBadMessage
+	}
+	flags := binary.BigEndian.Uint16(msg[2:])
+	if binary.BigEndian.Uint16(msg[0:]) != binary.BigEndian.Uint16(query[0:]) || flags&dnsFlagResponse == 0 {
+		return nil, ErrDNSMismatch
+	}
+	// 查询报文中只有一个问题，域名之后是 QTYPE 和 QCLASS
+	question := query[dnsHeaderSize:]
+	qtype := binary.BigEndian.Uint16(question[len(question)-4:])
+	if binary.BigEndian.Uint16(msg[4:]) != 1 || len(msg) < dnsHeaderSize+len(question) ||
+		!dnsEqualQuestion(msg[dnsHeaderSize:dnsHeaderSize+len(question)], question) {
+		return nil, ErrDNSMismatch
+	}
+	answer := &dnsAnswer{truncated: flags&dnsFlagTruncated != 0}
+	switch flags & dnsRcodeMask {
+	case dnsRcodeSuccess:
+	case dnsRcodeNXDomain:
+		answer.nxdomain = true
+		return answer, nil
+	default:
+		return nil, ErrDNSServerError
+	}
+	if answer.truncated {
+		return answer, nil
+	}
+
+	ancount := int(binary.BigEndian.Uint16(msg[6:]))
+	off := dnsHeaderSize + len(question)
+	for i := 0; i < ancount; i++ {
+		var ok bool
+		if off, ok = dnsSkipName(msg, off); !ok || off+10 > len(msg) {
+			return nil, ErrDNSBadMessage
+		}
+		rtype := binary.BigEndian.Uint16(msg[off:])
+		class := binary.BigEndian.Uint16(msg[off+2:])
+		ttl := time.Duration(binary.BigEndian.Uint32(msg[off+4:])) * time.Second
+		length := int(binary.BigEndian.Uint16(msg[off+8:]))
+		off += 10
+		if off+length > len(msg) {
+			return nil, ErrDNSBadMessage
+		}
+		rdata := msg[off : off+length]
+		off += length
+		if rtype != qtype || class != dnsClassIN {
+			continue
+		}
+		addr, ok := netip.AddrFromSlice(rdata)
+		if !ok || (rtype == dnsTypeA) != addr.Is4() {
+			return nil, ErrDNSBadMessage
+		}
+		answer.addrs = append(answer.addrs, addr)
+		if len(answer.addrs) == 1 || ttl < answer.ttl {
+			answer.ttl = ttl
+		}
+	}
+	return answer, nil
+}
+
+// 比较两个问题，域名不区分大小写，服务器可能改变域名的大小写
+func dnsEqualQuestion(a, b []byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	name := len(b) - 4
+	for i := 0; i < name; i++ {
+		if dnsLower(a[i]) != dnsLower(b[i]) {
+			return false
+		}
+	}
+	return string(a[name:]) == string(b[name:])
+}
+
+func dnsLower(c byte) byte {
+	if 'A' <= c && c <= 'Z' {
+		return c + 'a' - 'A'
+	}
+	return c
+}
+
+// 跳过 off 处的域名，返回域名之后的位置，域名可能以压缩指针结束
+func dnsSkipName(msg []byte, off int) (int, bool) {
+	for off < len(msg) {
+		length := int(msg[off])
+		switch {
+		case length == 0:
+			return off + 1, true
+		case length&0xc0 == 0xc0:
+			return off + 2, off+2 <= len(msg)
+		case length&0xc0 != 0:
+			return 0, false
+		}
+		off += 1 + length
+	}
+	return 0, false
+}
@@ -0,0 +1,65 @@
+package sudoku_go
+
+import (
+	"io"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// 正在处理的连接或者流，停止监听之后等待它们结束，超时后强制关闭
+type connTracker struct {
+	lock  sync.Mutex
+	conns map[io.Closer]struct{}
+	wg    sync.WaitGroup
+}
+
+func newConnTracker() *connTracker {
+	return &connTracker{conns: make(map[io.Closer]struct{})}
+}
+
+func (tracker *connTracker) add(conn io.Closer) {
+	tracker.lock.Lock()
+	tracker.conns[conn] = struct{}{}
+	tracker.lock.Unlock()
+	tracker.wg.Add(1)
+}
+
+func (tracker *connTracker) done(conn io.Closer) {
+	tracker.lock.Lock()
+	delete(tracker.conns, conn)
+	tracker.lock.Unlock()
+	tracker.wg.Done()
+}
+
+func (tracker *connTracker) count() int {
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+	return len(tracker.conns)
+}
+
+// 等待所有连接处理完，超过 timeout 时关闭剩下的连接并等待它们的处理结束
+func (tracker *connTracker) drain(timeout time.Duration) {
+	done := make(chan struct{})
+	go func() {
+		tracker.wg.Wait()
+		close(done)
+	}()
+	if n := tracker.count(); n > 0 {
+		slog.Info("Draining connections", "count", n, "timeout", timeout.String())
+	}
+
+	select {
+	case <-done:
+		return
+	case <-time.After(timeout):
+	}
+
+	tracker.lock.Lock()
+	slog.Warn("Drain timed out, closing connections", "count", len(tracker.conns))
+	for conn := range tracker.conns {
+		conn.Close()
+	}
+	tracker.lock.Unlock()
+	<-done
+}
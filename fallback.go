@@ -0,0 +1,29 @@
+package sudoku_go
+
+import (
+	"io"
+	"log/slog"
+	"net"
+)
+
+// 把握手失败的连接转交给诱饵服务，使端口在主动探测者看来是一个普通的服务
+// handshake 是握手阶段已经读到的数据，先原样发给诱饵服务
+// 没有设置诱饵服务时直接返回，由调用方关闭连接
+func (lsServer *LsServer) fallback(conn io.ReadWriteCloser, handshake []byte, logger *slog.Logger) {
+	if lsServer.Fallback == "" {
+		return
+	}
+	decoy, err := net.DialTimeout("tcp", lsServer.Fallback, lsServer.DialTimeout)
+	if err != nil {
+		logger.Warn("Failed to connect to fallback", "err", err)
+		return
+	}
+	defer decoy.Close()
+	logger.Info("Fallback to decoy", "fallback", lsServer.Fallback)
+
+	if _, err := decoy.Write(handshake); err != nil {
+		logger.Warn("Failed to write to fallback", "err", err)
+		return
+	}
+	relay(conn, decoy, nil, lsServer.IdleTimeout, logger)
+}
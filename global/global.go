@@ -1,8 +0,0 @@
-package global
-
-var (
-	ByteMap  *map[int]string
-	StrByte  *map[string]int
-	ByteList *[256][]string
-	AllPuzz  *map[string]int
-)
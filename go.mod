@@ -1,11 +1,10 @@
 module sudoku_go
 
-go 1.20
+go 1.21
 
 require (
 	github.com/mitchellh/go-homedir v1.1.0
 	github.com/spf13/viper v1.19.0
-	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
@@ -27,4 +26,5 @@ require (
 	golang.org/x/sys v0.18.0 // indirect
 	golang.org/x/text v0.14.0 // indirect
 	gopkg.in/ini.v1 v1.67.0 // indirect
+	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
@@ -0,0 +1,238 @@
+package sudoku_go
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strings"
+	"sudoku_go/sudoku"
+	"time"
+)
+
+// 本地端的 HTTP 代理处理，支持 CONNECT 和绝对 URI 形式的普通 HTTP 请求
+// 以及服务端通过 CONNECT 连接上游 HTTP 代理
+
+// 读取时先读 bufio.Reader 中缓存的数据
+type bufferedConn struct {
+	*bufio.Reader
+	net.Conn
+}
+
+func (conn *bufferedConn) Read(bs []byte) (int, error) {
+	return conn.Reader.Read(bs)
+}
+
+func (conn *bufferedConn) CloseWrite() error {
+	return closeWrite(conn.Conn)
+}
+
+// 逐跳的头部，不转发给目标服务器，Connection 中列出的头部也是逐跳的，见 RFC 7230 6.1
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Proxy-Authorization",
+	"Proxy-Authenticate",
+	"Keep-Alive",
+	"Te",
+	"Trailer",
+	"Upgrade",
+}
+
+func (local *LsLocal) handleHTTP(userConn *SecureTCPConn, reader *bufio.Reader, logger *slog.Logger) {
+	req, err := http.ReadRequest(reader)
+	if err != nil {
+		logger.Warn("Failed to read HTTP request", "err", err)
+		return
+	}
+	setDeadline(userConn, time.Time{})
+
+	host, ok := httpTarget(req)
+	if !ok {
+		logger.Warn("Can't handle HTTP request", "uri", redact(req.RequestURI))
+		httpWriteError(userConn, http.StatusBadRequest)
+		return
+	}
+	dstAddr, err := sudoku.ParseAddr(host)
+	if err != nil {
+		logger.Warn("Bad HTTP proxy target", "host", redact(host), "err", err)
+		httpWriteError(userConn, http.StatusBadRequest)
+		return
+	}
+
+	tunnel, status, err := local.dial(dstAddr, logger)
+	if err != nil {
+		logger.Error("Failed to open tunnel", "err", err)
+		httpWriteError(userConn, http.StatusBadGateway)
+		return
+	}
+	if status != sudoku.StatusOK {
+		logger.Info("Failed to connect", "dst", redact(dstAddr), "status", status)
+		httpWriteError(userConn, httpStatus(status))
+		return
+	}
+	defer tunnel.Close()
+
+	if req.Method == http.MethodConnect {
+		if _, err := io.WriteString(userConn, "HTTP/1.1 200 Connection Established\r\n\r\n"); err != nil {
+			logger.Warn("Failed to write HTTP response", "err", err)
+			return
+		}
+		local.relaySession(userConn, tunnel, dstAddr, logger)
+		return
+	}
+
+	// 普通 HTTP 请求逐个改写后转发，客户端读到的是改写之后的请求
+	requests, forward := io.Pipe()
+	go forwardHTTPRequests(forward, req, reader, host, logger)
+	local.relaySession(&httpRequestConn{requests: requests, SecureTCPConn: userConn}, tunnel, dstAddr, logger)
+}
+
+// 请求的目标地址，CONNECT 请求为 Host，普通 HTTP 代理请求必须是绝对 URI，没有端口时使用默认端口
+func httpTarget(req *http.Request) (string, bool) {
+	host := req.Host
+	if req.Method != http.MethodConnect {
+		if req.URL.Scheme != "http" || req.URL.Host == "" {
+			return "", false
+		}
+		host = req.URL.Host
+	}
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		if req.Method == http.MethodConnect {
+			host = net.JoinHostPort(host, "443")
+		} else {
+			host = net.JoinHostPort(strings.Trim(host, "[]"), "80")
+		}
+	}
+	return host, true
+}
+
+func removeHopHeaders(header http.Header) {
+	for _, value := range header.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			if name = textproto.TrimString(name); name != "" {
+				header.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		header.Del(name)
+	}
+}
+
+// 把同一个连接上的普通 HTTP 请求转换为源站形式写入 w，去掉逐跳的头部
+// 每个请求都带上 Connection: close，目标响应之后关闭连接，客户端不会在这个连接上发送其它目标的请求
+// 客户端仍然发送了 CONNECT 或者其它目标的请求时不再转发，连接关闭后由客户端重试没有响应的请求
+func forwardHTTPRequests(w *io.PipeWriter, req *http.Request, reader *bufio.Reader, host string, logger *slog.Logger) {
+	for {
+		removeHopHeaders(req.Header)
+		req.Close = true
+		if err := req.Write(w); err != nil {
+			logger.Debug("Failed to forward HTTP request", "err", err)
+			w.CloseWithError(err)
+			return
+		}
+		next, err := http.ReadRequest(reader)
+		if err != nil {
+			if err == io.EOF {
+				err = nil
+			}
+			w.CloseWithError(err)
+			return
+		}
+		if target, ok := httpTarget(next); !ok || next.Method == http.MethodConnect || target != host {
+			logger.Info("HTTP request for another target on a closing connection", "uri", redact(next.RequestURI))
+			w.Close()
+			return
+		}
+		req = next
+	}
+}
+
+// 普通 HTTP 代理的客户端连接，读取改写之后的请求，写入和关闭作用在原来的连接上
+type httpRequestConn struct {
+	requests *io.PipeReader
+	*SecureTCPConn
+}
+
+func (conn *httpRequestConn) Read(bs []byte) (int, error) {
+	return conn.requests.Read(bs)
+}
+
+func (conn *httpRequestConn) Close() error {
+	conn.requests.Close()
+	return conn.SecureTCPConn.Close()
+}
+
+func httpWriteError(conn io.Writer, code int) error {
+	_, err := fmt.Fprintf(conn, "HTTP/1.1 %d %s\r\nContent-Length: 0\r\nConnection: close\r\n\r\n", code, http.StatusText(code))
+	return err
+}
+
+// 把服务端返回的 sudoku 状态码转换为 HTTP 状态码
+func httpStatus(status uint8) int {
+	switch status {
+	case sudoku.StatusOK:
+		return http.StatusOK
+	case sudoku.StatusBadRequest:
+		return http.StatusBadRequest
+	case sudoku.StatusUnauthorized, sudoku.StatusForbidden:
+		return http.StatusForbidden
+	case sudoku.StatusTimeout:
+		return http.StatusGatewayTimeout
+	case sudoku.StatusServiceUnavailable:
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusBadGateway
+	}
+}
+
+// 作为客户端向上游 HTTP 代理发送 CONNECT 请求，返回代理的状态码
+// user 不为空时使用 Basic 认证，返回的连接会先读出代理在响应之后已经发来的数据
+func httpConnect(conn net.Conn, addr *sudoku.Addr, user, password string) (net.Conn, int, error) {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr.String()},
+		Host:   addr.String(),
+		Header: make(http.Header),
+	}
+	if user != "" {
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(user+":"+password)))
+	}
+	if err := req.Write(conn); err != nil {
+		return nil, 0, err
+	}
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		return nil, 0, err
+	}
+	// 成功的 CONNECT 响应没有响应体，之后的数据都属于隧道，失败时由调用方关闭连接
+	if reader.Buffered() > 0 {
+		conn = &bufferedConn{Reader: reader, Conn: conn}
+	}
+	return conn, resp.StatusCode, nil
+}
+
+// 把上游 HTTP 代理返回的状态码转换为 sudoku 状态码
+func statusFromHTTP(code int) uint8 {
+	switch {
+	case code >= 200 && code < 300:
+		return sudoku.StatusOK
+	case code == http.StatusBadRequest:
+		return sudoku.StatusBadRequest
+	case code == http.StatusForbidden, code == http.StatusProxyAuthRequired:
+		return sudoku.StatusForbidden
+	case code == http.StatusBadGateway:
+		return sudoku.StatusHostUnreachable
+	case code == http.StatusGatewayTimeout:
+		return sudoku.StatusTimeout
+	default:
+		return sudoku.StatusServiceUnavailable
+	}
+}
@@ -0,0 +1,60 @@
+package sudoku_go
+
+import (
+	"bufio"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestForwardHTTPRequests(t *testing.T) {
+	client := strings.Join([]string{
+		"POST http://example.test/a HTTP/1.1\r\nHost: example.test\r\nConnection: keep-alive, X-Hop\r\nX-Hop: 1\r\nX-Keep: 1\r\n" +
+			"Proxy-Connection: keep-alive\r\nProxy-Authorization: Basic eDp5\r\nKeep-Alive: timeout=5\r\nContent-Length: 4\r\n\r\nbody",
+		"GET http://example.test/b HTTP/1.1\r\nHost: example.test\r\n\r\n",
+		"GET http://other.test/c HTTP/1.1\r\nHost: other.test\r\n\r\n",
+	}, "")
+	reader := bufio.NewReader(strings.NewReader(client))
+	first, err := http.ReadRequest(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	host, _ := httpTarget(first)
+
+	requests, forward := io.Pipe()
+	go forwardHTTPRequests(forward, first, reader, host, slog.Default())
+	forwarded := bufio.NewReader(requests)
+
+	for _, path := range []string{"/a", "/b"} {
+		req, err := http.ReadRequest(forwarded)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if req.RequestURI != path {
+			t.Errorf("request uri = %q, want origin form %q", req.RequestURI, path)
+		}
+		// 每个请求都要求目标在响应后关闭连接
+		if !req.Close {
+			t.Errorf("%s: forwarded without Connection: close", path)
+		}
+		for _, name := range []string{"X-Hop", "Proxy-Connection", "Proxy-Authorization", "Keep-Alive"} {
+			if value := req.Header.Get(name); value != "" {
+				t.Errorf("%s: hop-by-hop header %s: %s was forwarded", path, name, value)
+			}
+		}
+		if path == "/a" {
+			if req.Header.Get("X-Keep") != "1" {
+				t.Error("end-to-end header was removed")
+			}
+			if body, _ := io.ReadAll(req.Body); string(body) != "body" {
+				t.Errorf("body = %q", body)
+			}
+		}
+	}
+	// 其它目标的请求不转发给这个目标
+	if rest, err := io.ReadAll(forwarded); err != nil || len(rest) != 0 {
+		t.Fatalf("forwarded %q, err = %v after the target changed", rest, err)
+	}
+}
@@ -1,104 +1,483 @@
 package sudoku_go
 
 import (
+	"bufio"
+	"context"
+	"crypto/rand"
 	"encoding/binary"
+	"errors"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
+	mathrand "math/rand"
 	"net"
 	"sudoku_go/sudoku"
+	"sync"
 	"time"
 )
 
+// 服务端拒绝握手，或者服务端的选择和本地的设置不一致
+var ErrHandshakeRejected = errors.New("handshake rejected by server")
+
 type LsLocal struct {
 	ListenAddr *net.TCPAddr
-	RemoteAddr *net.TCPAddr
+	// 服务端地址列表，按 Strategy 选择
+	RemoteAddrs []*net.TCPAddr
+	// 多个服务端的选择策略，默认 StrategyFailover
+	Strategy string
+	// 健康检查的间隔，每次检查对每个服务端做一次完整的握手
+	HealthCheckInterval time.Duration
+	// 预共享密钥，用于派生码本和 AEAD 密钥
+	Key string
+	// 是否启用 AEAD
+	AEAD bool
+	// 向服务端提议的编码器 SB CODE
+	Code uint8
+	// 多路复用的隧道数量，为 0 时每个连接单独建立一条隧道
+	Mux int
+	// 用户 ID 和用户密钥，设置 User 时使用 Version2 握手进行认证
+	User   string
+	Secret string
+	// 是否使用 TLS 握手模式
+	TLS bool
+	// 混淆域名列表，每次握手随机选择一个作为 OBF ADDR 和 SNI
+	ObfDomains []string
+	// 透明代理模式和监听地址，模式为空时不启用
+	Transparent     string
+	TransparentAddr *net.TCPAddr
+	// 路由规则，为 nil 时所有连接都走代理
+	Router *Router
+	// 反向隧道，服务端在各自的地址上监听，把接受的连接经过隧道转发给本地的目标
+	Reverse []*ReverseForward
+	// 导出 /metrics 的 HTTP 地址，为空时不启用
+	MetricsAddr string
+	// 管理接口的地址，只能是回环地址或者 unix socket，为空时不启用
+	AdminAddr string
+	// 停止监听之后等待连接结束的时长，超时后强制关闭
+	DrainTimeout time.Duration
+	// 读完 SOCKS5 或 HTTP 请求以及和服务端握手的超时，连接服务端和直连目标的超时，
+	// 以及转发时两个方向都没有数据的超时，为 0 时不限制
+	HandshakeTimeout time.Duration
+	DialTimeout      time.Duration
+	IdleTimeout      time.Duration
+
+	muxPool  *muxPool
+	remotes  *remoteGroup
+	sessions *sessionTable
 }
 
 // 新建一个本地端
 // 本地端的职责是:
-// 1. 监听来自本机浏览器的代理请求
+// 1. 监听来自本机浏览器的代理请求，在本地完成 SOCKS5 协商
 // 2. 转发前加密数据
 // 3. 转发socket数据到墙外代理服务端
 // 4. 把服务端返回的数据转发给用户的浏览器
-func NewLsLocal(listenAddr, remoteAddr string) (*LsLocal, error) {
+func NewLsLocal(listenAddr string, remoteAddrs []string, key string) (*LsLocal, error) {
 	structListenAddr, err := net.ResolveTCPAddr("tcp", listenAddr)
 	if err != nil {
 		return nil, err
 	}
-	structRemoteAddr, err := net.ResolveTCPAddr("tcp", remoteAddr)
-	if err != nil {
-		return nil, err
+	if len(remoteAddrs) == 0 {
+		return nil, ErrNoRemote
+	}
+	var structRemoteAddrs []*net.TCPAddr
+	for _, remoteAddr := range remoteAddrs {
+		structRemoteAddr, err := net.ResolveTCPAddr("tcp", remoteAddr)
+		if err != nil {
+			return nil, err
+		}
+		structRemoteAddrs = append(structRemoteAddrs, structRemoteAddr)
 	}
 	return &LsLocal{
-		ListenAddr: structListenAddr,
-		RemoteAddr: structRemoteAddr,
+		ListenAddr:          structListenAddr,
+		RemoteAddrs:         structRemoteAddrs,
+		Strategy:            StrategyFailover,
+		HealthCheckInterval: 30 * time.Second,
+		DrainTimeout:        30 * time.Second,
+		HandshakeTimeout:    DefaultHandshakeTimeout,
+		DialTimeout:         DefaultDialTimeout,
+		IdleTimeout:         DefaultIdleTimeout,
+		Key:                 key,
+		Code:                sudoku.DefaultRequest.Code,
+		sessions:            newSessionTable(),
 	}, nil
 }
 
 // 本地端启动监听，接收来自本机浏览器的连接
-func (local *LsLocal) Listen(didListen func(listenAddr net.Addr)) error {
-	trafficStat()
-	return ListenSecureTCP(local.ListenAddr, sudoku.DefaultRequest.Code, local.handleConn, didListen)
+// ctx 结束后停止接受新连接，排空正在处理的连接后返回
+func (local *LsLocal) Listen(ctx context.Context, didListen func(listenAddr net.Addr)) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	defer local.sessions.killAfter(ctx, local.DrainTimeout)()
+
+	trafficStat(ctx)
+	if local.MetricsAddr != "" {
+		if err := serveMetrics(ctx, local.MetricsAddr); err != nil {
+			return err
+		}
+	}
+	if local.AdminAddr != "" {
+		if err := serveAdmin(ctx, local.AdminAddr, local.sessions); err != nil {
+			return err
+		}
+	}
+	remotes, err := newRemoteGroup(local.RemoteAddrs, local.Strategy, local.probe)
+	if err != nil {
+		return err
+	}
+	local.remotes = remotes
+	// 只有一个服务端时没有可以切换的服务端，不需要健康检查
+	if len(local.RemoteAddrs) > 1 && local.HealthCheckInterval > 0 {
+		remotes.healthCheck(ctx, local.HealthCheckInterval)
+	}
+	if local.Mux > 0 {
+		local.muxPool = newMuxPool(local.Mux, local.dialMux)
+	}
+	var transparentDone <-chan struct{}
+	if local.Transparent != "" {
+		if transparentDone, err = local.listenTransparent(ctx); err != nil {
+			return err
+		}
+	}
+	// 同一个地址上的两条反向隧道会在服务端互相替换
+	listens := make(map[string]bool)
+	for _, forward := range local.Reverse {
+		if listens[forward.Listen.String()] {
+			return fmt.Errorf("%w: duplicate listen address %s", ErrReverseForward, forward.Listen)
+		}
+		listens[forward.Listen.String()] = true
+	}
+	var reverses sync.WaitGroup
+	for _, forward := range local.Reverse {
+		forward := forward
+		reverses.Add(1)
+		go func() {
+			defer reverses.Done()
+			local.runReverse(ctx, forward)
+		}()
+	}
+	err = ListenSecureTCP(ctx, local.ListenAddr, local.DrainTimeout, local.handleConn, didListen)
+	// 监听出错时同时停止透明代理和反向隧道
+	cancel()
+	if transparentDone != nil {
+		<-transparentDone
+	}
+	reverses.Wait()
+	return err
 }
 
-func (local *LsLocal) handleConn(userConn *SecureTCPConn) {
+// 根据第一个字节区分 SOCKS5 和 HTTP 代理请求，两者共用同一个端口
+func (local *LsLocal) handleConn(userConn *SecureTCPConn, logger *slog.Logger) {
 	defer userConn.Close()
-	proxyServer, err := DialTCPSecure(local.RemoteAddr, sudoku.DefaultRequest.Code)
-	log.Print("Connected to Server : ", local.RemoteAddr)
+
+	conn, ok := userConn.ReadWriteCloser.(net.Conn)
+	if !ok {
+		return
+	}
+	// 代理请求必须在 HandshakeTimeout 内读完，读完之后由各个处理函数取消期限
+	setDeadline(conn, deadlineAfter(local.HandshakeTimeout))
+	reader := bufio.NewReader(conn)
+	first, err := reader.Peek(1)
 	if err != nil {
-		log.Println(err)
 		return
 	}
-	defer proxyServer.Close()
+	// 已经读入缓冲区的数据之后也要经过 reader 读取
+	userConn.ReadWriteCloser = &bufferedConn{Reader: reader, Conn: conn}
 
-	// Encode traffic received from the local client and forward it to the remote proxy server
-	go func() {
+	if first[0] == socks5Version {
+		local.handleSocks5(userConn, logger)
+	} else {
+		local.handleHTTP(userConn, reader, logger)
+	}
+}
 
-		// Create a sudoku request
-		sudokuReq := sudoku.DefaultRequest
+// 在本地处理 SOCKS5 协议，只把目标地址通过隧道发给服务端
+func (local *LsLocal) handleSocks5(userConn *SecureTCPConn, logger *slog.Logger) {
+	if err := socks5Negotiate(userConn); err != nil {
+		logger.Warn("SOCKS5 negotiation failed", "err", err)
+		return
+	}
+	cmd, dstAddr, err := socks5ReadRequest(userConn)
+	if err != nil {
+		logger.Warn("Failed to read SOCKS5 request", "err", err)
+		return
+	}
+	setDeadline(userConn, time.Time{})
+	switch cmd {
+	case sudoku.CmdConnect:
+	case sudoku.CmdUDPAssociate:
+		local.handleUDPAssociate(userConn, dstAddr, logger)
+		return
+	default:
+		logger.Warn("Can't handle command", "cmd", cmd)
+		socks5WriteReply(userConn, socks5CommandNotSupported)
+		return
+	}
 
-		// 在Encode之前以sudoku作为header，但不Encode
-		if _, err := sudokuReq.WriteTo(proxyServer); err != nil {
-			log.Print(err)
-		}
+	// 连接目标地址，并把连接结果转换为 SOCKS5 响应
+	tunnel, status, err := local.dial(dstAddr, logger)
+	if err != nil {
+		logger.Error("Failed to open tunnel", "err", err)
+		socks5WriteReply(userConn, socks5GeneralFailure)
+		return
+	}
+	if status != sudoku.StatusOK {
+		logger.Info("Failed to connect", "dst", redact(dstAddr), "status", status)
+		socks5WriteReply(userConn, socks5Rep(status))
+		return
+	}
+	defer tunnel.Close()
+	if err := socks5WriteReply(userConn, socks5Succeeded); err != nil {
+		logger.Warn("Failed to write SOCKS5 reply", "err", err)
+		return
+	}
+
+	// 本地的流量编码后发给服务端，服务端返回的流量直接发回本地
+	local.relaySession(userConn, tunnel, dstAddr, logger)
+}
 
-		//err := userConn.DirectEncodeCopy(proxyServer)
-		err := userConn.EncodeCopy(proxyServer)
+// 把转发登记为会话后在用户连接和隧道之间转发
+func (local *LsLocal) relaySession(userConn, tunnel io.ReadWriteCloser, dstAddr *sudoku.Addr, logger *slog.Logger) {
+	sess := newSession(remoteAddrOf(userConn), local.User)
+	local.sessions.add(sess, dstAddr.String(), userConn, tunnel)
+	defer local.sessions.remove(sess)
+	relay(userConn, tunnel, sess.traffic, local.IdleTimeout, logger)
+}
+
+// 按路由规则连接目标地址，直连或者请求服务端连接，返回和服务端一致的状态码
+// 状态码不为 StatusOK 时连接已经关闭
+func (local *LsLocal) dial(dstAddr *sudoku.Addr, logger *slog.Logger) (io.ReadWriteCloser, uint8, error) {
+	switch local.Router.Route(dstAddr) {
+	case ActionReject:
+		logger.Info("Rejected by rule", "dst", redact(dstAddr))
+		return nil, sudoku.StatusForbidden, nil
+	case ActionDirect:
+		start := time.Now()
+		conn, err := dialProtected("tcp", dstAddr.String(), local.DialTimeout)
+		observeDial(dialDirect, start, err)
 		if err != nil {
-			log.Print(err)
-			userConn.Close()
-			proxyServer.Close()
+			logger.Info("Failed to connect directly", "dst", redact(dstAddr), "err", redact(err))
+			return nil, dialStatus(err), nil
 		}
-	}()
+		logger.Info("Connected directly", "dst", redact(dstAddr))
+		return conn, sudoku.StatusOK, nil
+	default:
+		tunnel, status, err := local.requestTunnel(&sudoku.TunnelRequest{Cmd: sudoku.CmdConnect, Addr: *dstAddr})
+		if err == nil && status == sudoku.StatusOK {
+			logger.Info("Connected through tunnel", "dst", redact(dstAddr))
+		}
+		return tunnel, status, err
+	}
+}
+
+// 打开一条隧道并发送隧道请求，返回服务端的状态码
+// 状态码不为 StatusOK 时隧道已经关闭
+func (local *LsLocal) requestTunnel(tunnelReq *sudoku.TunnelRequest) (io.ReadWriteCloser, uint8, error) {
+	tunnel, err := local.openTunnel()
+	if err != nil {
+		return nil, 0, err
+	}
+	// 服务端收到请求后才开始连接目标，等待响应的时间包括服务端连接目标的时间
+	if local.HandshakeTimeout > 0 && local.DialTimeout > 0 {
+		setDeadline(tunnel, deadlineAfter(local.HandshakeTimeout+local.DialTimeout))
+	}
+	if _, err := tunnelReq.WriteTo(tunnel); err != nil {
+		tunnel.Close()
+		return nil, 0, err
+	}
+	tunnelResp := &sudoku.TunnelResponse{}
+	if _, err := tunnelResp.ReadFrom(tunnel); err != nil {
+		tunnel.Close()
+		return nil, 0, err
+	}
+	if tunnelResp.Status != sudoku.StatusOK {
+		tunnel.Close()
+		return nil, tunnelResp.Status, nil
+	}
+	setDeadline(tunnel, time.Time{})
+	return tunnel, tunnelResp.Status, nil
+}
+
+// 打开一条到服务端的隧道
+// 启用多路复用时在已有的隧道上打开一个流，否则建立一条新的连接
+func (local *LsLocal) openTunnel() (io.ReadWriteCloser, error) {
+	if local.muxPool != nil {
+		return local.muxPool.OpenStream()
+	}
+	proxyServer, err := local.dialTunnel()
+	if err != nil {
+		return nil, err
+	}
+	return proxyServer.ClientStream(), nil
+}
+
+// 建立一条多路复用的隧道
+func (local *LsLocal) dialMux() (*muxSession, error) {
+	proxyServer, err := local.dialTunnel()
+	if err != nil {
+		return nil, err
+	}
+	tunnel := proxyServer.ClientStream()
+	setDeadline(tunnel, deadlineAfter(local.HandshakeTimeout))
+	tunnelReq := &sudoku.TunnelRequest{Cmd: sudoku.CmdMux}
+	if _, err := tunnelReq.WriteTo(tunnel); err != nil {
+		tunnel.Close()
+		return nil, err
+	}
+	tunnelResp := &sudoku.TunnelResponse{}
+	if _, err := tunnelResp.ReadFrom(tunnel); err != nil {
+		tunnel.Close()
+		return nil, err
+	}
+	if tunnelResp.Status != sudoku.StatusOK {
+		tunnel.Close()
+		return nil, fmt.Errorf("server refused mux, status: %#x", tunnelResp.Status)
+	}
+	setDeadline(tunnel, time.Time{})
+	return newMuxSession(tunnel, true, nil), nil
+}
+
+// 按策略选择服务端，连接并完成 sudoku 握手，返回的连接已经设置好编码器和 AEAD
+// 连接失败的服务端被排除，依次尝试下一个
+func (local *LsLocal) dialTunnel() (*SecureTCPConn, error) {
+	var lastErr error
+	for _, remoteAddr := range local.remotes.candidates() {
+		proxyServer, err := local.dialRemote(remoteAddr)
+		local.remotes.report(remoteAddr, err)
+		if err == nil {
+			return proxyServer, nil
+		}
+		lastErr = err
+	}
+	return nil, fmt.Errorf("%w: %v", ErrAllRemoteDown, lastErr)
+}
+
+// 连接一个服务端并完成握手
+func (local *LsLocal) dialRemote(remoteAddr *net.TCPAddr) (*SecureTCPConn, error) {
+	proxyServer, err := DialTCPSecure(remoteAddr, local.DialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	slog.Debug("Connected to server", "remote", remoteAddr.String())
+	proxyServer.SetDeadline(deadlineAfter(local.HandshakeTimeout))
+	if err := local.handshake(proxyServer); err != nil {
+		proxyServer.Close()
+		if errors.Is(err, ErrHandshakeRejected) {
+			metricHandshakeFailures.add(1, handshakeRejected)
+		} else {
+			metricHandshakeFailures.add(1, handshakeIO)
+		}
+		return nil, err
+	}
+	proxyServer.SetDeadline(time.Time{})
+	return proxyServer, nil
+}
+
+// 健康检查，握手成功即认为服务端可用，之后直接关闭连接
+func (local *LsLocal) probe(remoteAddr *net.TCPAddr) error {
+	proxyServer, err := DialTCPSecure(remoteAddr, local.DialTimeout)
+	if err != nil {
+		return err
+	}
+	defer proxyServer.Close()
+	// 健康检查不能一直等待没有响应的服务端
+	timeout := local.HandshakeTimeout
+	if timeout <= 0 {
+		timeout = DefaultHandshakeTimeout
+	}
+	proxyServer.SetDeadline(deadlineAfter(timeout))
+	return local.handshake(proxyServer)
+}
+
+func (local *LsLocal) handshake(proxyServer *SecureTCPConn) error {
+	// Create a sudoku request
+	sudokuReq := *sudoku.DefaultRequest
+	// 提议使用的编码器
+	sudokuReq.Code = local.Code
+	if len(local.ObfDomains) > 0 {
+		domain := local.ObfDomains[mathrand.Intn(len(local.ObfDomains))]
+		sudokuReq.ObfAddr = []byte(domain)
+		sudokuReq.ObfLen = uint8(len(domain))
+	}
+	if local.TLS {
+		sudokuReq.ObfPort = 443
+	}
+	if local.AEAD {
+		sudokuReq.Code |= sudoku.CodeAEAD
+	}
+	if local.AEAD || local.User != "" {
+		sudokuReq.Nonce = make([]byte, sudoku.NonceSize)
+		if _, err := rand.Read(sudokuReq.Nonce); err != nil {
+			return err
+		}
+	}
+	if local.User != "" {
+		signRequest(&sudokuReq, local.User, local.Secret)
+	}
 
-	// 接收sudoku响应
+	// 接收sudoku响应，服务端确认编码器之后才能开始编码
 	sudokuResp := &sudoku.Response{}
-	if _, err := sudokuResp.ReadFrom(proxyServer); err != nil {
-		log.Print(err)
+	if local.TLS {
+		// 请求和响应藏在 TLS 握手里，此后的数据都放在 application_data 记录里
+		clientHello, err := writeClientHello(proxyServer.ReadWriteCloser, &sudokuReq, local.Key, string(sudokuReq.ObfAddr))
+		if err != nil {
+			return err
+		}
+		if sudokuResp, err = readServerHello(proxyServer.ReadWriteCloser, local.Key, clientHello); err != nil {
+			return err
+		}
+		proxyServer.ReadWriteCloser = newRecordConn(proxyServer.ReadWriteCloser, true)
+	} else {
+		// 在Encode之前以sudoku作为header，但不Encode
+		if _, err := sudokuReq.WriteTo(proxyServer.ReadWriteCloser); err != nil {
+			return err
+		}
+		if _, err := sudokuResp.ReadFrom(proxyServer); err != nil {
+			return err
+		}
 	}
 
+	slog.Debug("Sudoku response", "response", redact(sudokuResp.Bytes()))
 	if sudokuResp.Status != sudoku.StatusOK {
-		log.Print("sudoku status not ok")
-		return
+		return fmt.Errorf("%w: status %#x", ErrHandshakeRejected, sudokuResp.Status)
 	}
 
-	// Decode traffic received from the remote proxy server and send it back to the local client
-	//err = proxyServer.DecodeCopy(userConn)
-	err = proxyServer.DirectDEcodeCopy(userConn)
+	codec, err := NewCodec(sudokuResp.Code&^sudoku.CodeAEAD, local.Key)
 	if err != nil {
-		log.Print(err)
-		// 在 copy 的过程中可能会存在网络超时等 error 被 return，只要有一个发生了错误就退出本次工作
-		userConn.Close()
-		proxyServer.Close()
+		return fmt.Errorf("%w: server picked codec %#x: %v", ErrHandshakeRejected, sudokuResp.Code&^sudoku.CodeAEAD, err)
+	}
+	proxyServer.setCodec(codec)
+
+	if local.AEAD {
+		if sudokuResp.Code&sudoku.CodeAEAD == 0 {
+			return fmt.Errorf("%w: server did not accept AEAD", ErrHandshakeRejected)
+		}
+		sealAEAD, err := clientAEAD(local.Key, sudokuReq.Nonce, sudokuResp.Nonce)
+		if err != nil {
+			return err
+		}
+		openAEAD, err := serverAEAD(local.Key, sudokuReq.Nonce, sudokuResp.Nonce)
+		if err != nil {
+			return err
+		}
+		proxyServer.enableSeal(sealAEAD)
+		proxyServer.enableOpen(openAEAD)
 	}
+	return nil
 }
 
-func trafficStat() {
+// 定时输出和发送流量统计，ctx 结束后停止
+func trafficStat(ctx context.Context) {
 	printTicker := time.NewTicker(10 * time.Second)
 	statTicker := time.NewTicker(1 * time.Second)
 	go func() {
+		defer printTicker.Stop()
+		defer statTicker.Stop()
 		for {
 			select {
+			case <-ctx.Done():
+				return
 			case _ = <-printTicker.C:
 				printTrafficStat()
 			case _ = <-statTicker.C:
@@ -109,11 +488,7 @@ func trafficStat() {
 }
 
 func printTrafficStat() {
-	RxLock.RLock()
-	TxLock.RLock()
-	fmt.Printf("Receive: %dM Send: %dM\n", Rx/1024/1024, Tx/1024/1024)
-	RxLock.RUnlock()
-	TxLock.RUnlock()
+	slog.Debug("Traffic", "receive_mb", metricBytes.get(directionRx)/1024/1024, "send_mb", metricBytes.get(directionTx)/1024/1024)
 }
 
 func sendTrafficStat() {
@@ -131,17 +506,13 @@ func sendTrafficStat() {
 	defer conn.Close()
 
 	bs := make([]byte, 8)
-	TxLock.RLock()
-	binary.LittleEndian.PutUint64(bs, Tx)
-	TxLock.RUnlock()
+	binary.LittleEndian.PutUint64(bs, metricBytes.get(directionTx))
 	conn.Write(bs)
-	RxLock.RLock()
-	binary.LittleEndian.PutUint64(bs, Rx)
-	RxLock.RUnlock()
+	binary.LittleEndian.PutUint64(bs, metricBytes.get(directionRx))
 	conn.Write(bs)
 
 	if err != nil {
-		log.Printf("Failed to report stat: %v\n", err)
+		slog.Warn("Failed to report stat", "err", err)
 		return
 	}
 }
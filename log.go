@@ -0,0 +1,81 @@
+package sudoku_go
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"sync/atomic"
+)
+
+// 日志输出格式
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+var (
+	ErrLogLevel  = errors.New("log: unknown level")
+	ErrLogFormat = errors.New("log: unknown format")
+)
+
+var (
+	// debug 级别时才输出目标地址和数据内容
+	logDebug atomic.Bool
+	// 每个连接的日志都带有递增的连接 ID
+	nextConnID atomic.Uint64
+)
+
+// 设置全局日志，level 为 debug、info、warn 或 error，format 为 text 或 json，为空时使用 info 和 text
+// 标准库 log 包的输出也会经过这里设置的日志
+func SetupLogger(w io.Writer, level, format string) error {
+	lvl := slog.LevelInfo
+	if level != "" {
+		if err := lvl.UnmarshalText([]byte(level)); err != nil {
+			return ErrLogLevel
+		}
+	}
+	opts := &slog.HandlerOptions{Level: lvl}
+
+	var handler slog.Handler
+	switch strings.ToLower(format) {
+	case LogFormatText, "":
+		handler = slog.NewTextHandler(w, opts)
+	case LogFormatJSON:
+		handler = slog.NewJSONHandler(w, opts)
+	default:
+		return ErrLogFormat
+	}
+	logDebug.Store(lvl <= slog.LevelDebug)
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
+
+// 为新连接分配 ID，返回带有连接 ID 的日志
+func newConnLogger() *slog.Logger {
+	return slog.Default().With("conn", nextConnID.Add(1))
+}
+
+// 敏感字段，例如目标地址和数据内容，非 debug 级别时输出为 [redacted]
+type sensitive struct {
+	v any
+}
+
+func (s sensitive) LogValue() slog.Value {
+	if !logDebug.Load() {
+		return slog.StringValue("[redacted]")
+	}
+	switch v := s.v.(type) {
+	case []byte:
+		return slog.StringValue(hex.EncodeToString(v))
+	case fmt.Stringer:
+		return slog.StringValue(v.String())
+	}
+	return slog.AnyValue(s.v)
+}
+
+func redact(v any) slog.LogValuer {
+	return sensitive{v}
+}
@@ -0,0 +1,327 @@
+package sudoku_go
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Prometheus 文本格式的指标，由 MetricsAddr 上的 /metrics 导出
+// 指标在整个进程内共享，本地端和服务端各自只更新与自己有关的部分
+
+// 流量方向，tx 为客户端发往服务端的方向，rx 为服务端返回的方向
+const (
+	directionTx = "tx"
+	directionRx = "rx"
+)
+
+// 握手失败的原因
+const (
+	// 服务端读取握手失败，包括主动探测和格式错误的请求
+	handshakeBadRequest   = "bad_request"
+	handshakeUnauthorized = "unauthorized"
+	handshakeReplay       = "replay"
+	handshakeAEADRequired = "aead_required"
+	handshakeCodec        = "codec"
+	// 读写握手数据时出错
+	handshakeIO = "io"
+	// 本地端收到服务端的拒绝，或者服务端的选择和本地不一致
+	handshakeRejected = "rejected"
+)
+
+// 服务端拒绝出站连接的原因
+const (
+	// 匹配了 deny 规则
+	deniedRule = "rule"
+	// 内部网段
+	deniedPrivate = "private"
+)
+
+// 连接耗时的种类
+const (
+	// 本地端连接服务端
+	dialRemote = "remote"
+	// 本地端按路由规则直连目标
+	dialDirect = "direct"
+	// 服务端连接目标
+	dialTarget = "target"
+	// 服务端经过上游代理连接目标，包括和代理的握手
+	dialUpstream = "upstream"
+	// 本地端为反向隧道连接本地目标
+	dialReverse = "reverse"
+)
+
+var (
+	metricActiveConns = newGauge("sudoku_active_connections",
+		"Connections currently being handled.")
+	metricConns = newCounterVec("sudoku_connections_total",
+		"Connections accepted.")
+	metricBytes = newCounterVec("sudoku_bytes_total",
+		"Relayed payload bytes, tx is the client to server direction.", "direction")
+	metricUserBytes = newCounterVec("sudoku_user_bytes_total",
+		"Relayed payload bytes of authenticated users.", "user", "direction")
+	metricHandshakeFailures = newCounterVec("sudoku_handshake_failures_total",
+		"Failed sudoku handshakes.", "reason")
+	metricDialSeconds = newHistogramVec("sudoku_dial_duration_seconds",
+		"Time spent establishing outbound TCP connections.",
+		[]float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}, "kind", "result")
+	metricCodecErrors = newCounterVec("sudoku_codec_errors_total",
+		"Streams that failed to decode or authenticate.", "kind")
+	metricOutboundDenied = newCounterVec("sudoku_outbound_denied_total",
+		"Outbound connections and UDP destinations refused by the server ACL.", "reason")
+	metricDNSLookups = newCounterVec("sudoku_dns_lookups_total",
+		"Domain lookups by the server resolver, answered from cache, by an upstream, or failed.", "result")
+
+	allMetrics = []metric{
+		metricActiveConns,
+		metricConns,
+		metricBytes,
+		metricUserBytes,
+		metricHandshakeFailures,
+		metricDialSeconds,
+		metricCodecErrors,
+		metricOutboundDenied,
+		metricDNSLookups,
+	}
+)
+
+type metric interface {
+	writeTo(w io.Writer)
+}
+
+// 一个连接或者隧道的流量，同时计入全局和按用户的指标
+type traffic struct {
+	user string
+	tx   atomic.Uint64
+	rx   atomic.Uint64
+}
+
+func newTraffic(user string) *traffic {
+	return &traffic{user: user}
+}
+
+// 为 nil 时不计入，例如转交给诱饵服务的连接
+func (t *traffic) addTx(n int) {
+	if t == nil {
+		return
+	}
+	t.tx.Add(uint64(n))
+	metricBytes.add(uint64(n), directionTx)
+	if t.user != "" {
+		metricUserBytes.add(uint64(n), t.user, directionTx)
+	}
+}
+
+func (t *traffic) addRx(n int) {
+	if t == nil {
+		return
+	}
+	t.rx.Add(uint64(n))
+	metricBytes.add(uint64(n), directionRx)
+	if t.user != "" {
+		metricUserBytes.add(uint64(n), t.user, directionRx)
+	}
+}
+
+// 记录一次连接的耗时
+func observeDial(kind string, start time.Time, err error) {
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+	metricDialSeconds.observe(time.Since(start).Seconds(), kind, result)
+}
+
+// 在 addr 上启动 HTTP 服务导出 /metrics，ctx 结束时关闭
+func serveMetrics(ctx context.Context, addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		for _, m := range allMetrics {
+			m.writeTo(w)
+		}
+	})
+	slog.Info("Metrics listening", "addr", listener.Addr().String())
+	context.AfterFunc(ctx, func() {
+		listener.Close()
+	})
+	go func() {
+		if err := http.Serve(listener, mux); err != nil && ctx.Err() == nil {
+			slog.Error("Metrics server stopped", "err", err)
+		}
+	}()
+	return nil
+}
+
+type gauge struct {
+	name, help string
+	v          atomic.Int64
+}
+
+func newGauge(name, help string) *gauge {
+	return &gauge{name: name, help: help}
+}
+
+func (g *gauge) add(n int64) {
+	g.v.Add(n)
+}
+
+func (g *gauge) writeTo(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %d\n", g.name, g.help, g.name, g.name, g.v.Load())
+}
+
+// 带标签的计数器，标签值按顺序对应 labels
+type counterVec struct {
+	name, help string
+	labels     []string
+
+	lock   sync.Mutex
+	values map[string]*atomic.Uint64
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{name: name, help: help, labels: labels, values: make(map[string]*atomic.Uint64)}
+}
+
+func (c *counterVec) counter(values ...string) *atomic.Uint64 {
+	key := strings.Join(values, "\xff")
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	v, ok := c.values[key]
+	if !ok {
+		v = &atomic.Uint64{}
+		c.values[key] = v
+	}
+	return v
+}
+
+func (c *counterVec) add(n uint64, values ...string) {
+	c.counter(values...).Add(n)
+}
+
+func (c *counterVec) get(values ...string) uint64 {
+	return c.counter(values...).Load()
+}
+
+// 按标签值返回当前的计数，只用于单个标签的计数器
+func (c *counterVec) snapshot() map[string]uint64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	values := make(map[string]uint64, len(c.values))
+	for key, v := range c.values {
+		values[key] = v.Load()
+	}
+	return values
+}
+
+func (c *counterVec) writeTo(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if len(c.labels) == 0 && len(c.values) == 0 {
+		fmt.Fprintf(w, "%s 0\n", c.name)
+		return
+	}
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %d\n", c.name, formatLabels(c.labels, key, ""), c.values[key].Load())
+	}
+}
+
+// 带标签的直方图，buckets 为各个桶的上界
+type histogramVec struct {
+	name, help string
+	labels     []string
+	buckets    []float64
+
+	lock   sync.Mutex
+	values map[string]*histogram
+}
+
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{name: name, help: help, labels: labels, buckets: buckets, values: make(map[string]*histogram)}
+}
+
+func (h *histogramVec) observe(v float64, values ...string) {
+	key := strings.Join(values, "\xff")
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	hist, ok := h.values[key]
+	if !ok {
+		hist = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.values[key] = hist
+	}
+	for i, upper := range h.buckets {
+		if v <= upper {
+			hist.counts[i]++
+		}
+	}
+	hist.sum += v
+	hist.count++
+}
+
+func (h *histogramVec) writeTo(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	for _, key := range sortedKeys(h.values) {
+		hist := h.values[key]
+		for i, upper := range h.buckets {
+			le := strconv.FormatFloat(upper, 'g', -1, 64)
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, key, le), hist.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, key, "+Inf"), hist.count)
+		fmt.Fprintf(w, "%s_sum%s %g\n", h.name, formatLabels(h.labels, key, ""), hist.sum)
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, key, ""), hist.count)
+	}
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// 把标签名和以 \xff 连接的标签值格式化为 {a="x",b="y"}，le 不为空时追加直方图的桶标签
+func formatLabels(labels []string, key, le string) string {
+	var pairs []string
+	if len(labels) > 0 {
+		for i, value := range strings.Split(key, "\xff") {
+			pairs = append(pairs, labels[i]+`="`+escapeLabel(value)+`"`)
+		}
+	}
+	if le != "" {
+		pairs = append(pairs, `le="`+le+`"`)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(value string) string {
+	return labelEscaper.Replace(value)
+}
@@ -0,0 +1,540 @@
+package sudoku_go
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"sudoku_go/sudoku"
+	"sync"
+	"time"
+)
+
+var (
+	ErrSessionClosed = errors.New("mux: session closed")
+	ErrStreamClosed  = errors.New("mux: stream closed")
+	ErrBadFrame      = errors.New("mux: bad frame")
+	ErrFlowControl   = errors.New("mux: stream window exceeded")
+	ErrBadStreamID   = errors.New("mux: bad stream id")
+)
+
+// 一个会话上对端同时打开的流的上限，超出时拒绝新的流
+const maxMuxStreams = 1024
+
+// 多路复用会话，在一条隧道上承载多个流，帧格式见 sudoku.Frame
+type muxSession struct {
+	conn io.ReadWriteCloser
+
+	// 帧必须完整写出，多个流的写入需要串行
+	writeLock sync.Mutex
+
+	lock    sync.Mutex
+	streams map[uint32]*muxStream
+	nextID  uint32
+	// 对端最后打开的流，对端打开的流必须和本端奇偶不同并且递增
+	remoteID uint32
+	// 对端打开并且还没有关闭的流的数量
+	remoteStreams int
+	err           error
+	done          chan struct{}
+
+	// 对端打开新的流时调用，为 nil 时拒绝对端打开的流
+	onStream func(stream *muxStream)
+}
+
+func newMuxSession(conn io.ReadWriteCloser, client bool, onStream func(stream *muxStream)) *muxSession {
+	session := &muxSession{
+		conn:     conn,
+		streams:  make(map[uint32]*muxStream),
+		done:     make(chan struct{}),
+		onStream: onStream,
+	}
+	// 客户端打开的流为奇数，服务端打开的流为偶数
+	if client {
+		session.nextID = 1
+	} else {
+		session.nextID = 2
+	}
+	go session.recvLoop()
+	return session
+}
+
+// 打开一个新的流
+func (session *muxSession) OpenStream() (*muxStream, error) {
+	session.lock.Lock()
+	if session.err != nil {
+		session.lock.Unlock()
+		return nil, session.err
+	}
+	id := session.nextID
+	session.nextID += 2
+	stream := newMuxStream(session, id)
+	session.streams[id] = stream
+	session.lock.Unlock()
+
+	if err := session.writeFrame(sudoku.FrameOpen, id, nil); err != nil {
+		return nil, err
+	}
+	return stream, nil
+}
+
+// 会话关闭后 Done 返回的 channel 会被关闭
+func (session *muxSession) Done() <-chan struct{} {
+	return session.done
+}
+
+func (session *muxSession) IsClosed() bool {
+	select {
+	case <-session.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// 当前承载的流的数量
+func (session *muxSession) NumStreams() int {
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	return len(session.streams)
+}
+
+func (session *muxSession) Close() error {
+	session.closeWithError(ErrSessionClosed)
+	return nil
+}
+
+// 关闭底层隧道，所有的流都会以 err 结束
+func (session *muxSession) closeWithError(err error) {
+	session.lock.Lock()
+	if session.err != nil {
+		session.lock.Unlock()
+		return
+	}
+	session.err = err
+	streams := session.streams
+	session.streams = make(map[uint32]*muxStream)
+	close(session.done)
+	session.lock.Unlock()
+
+	session.conn.Close()
+	for _, stream := range streams {
+		stream.sessionClosed(err)
+	}
+}
+
+func (session *muxSession) writeFrame(frameType uint8, id uint32, payload []byte) error {
+	session.writeLock.Lock()
+	defer session.writeLock.Unlock()
+	frame := &sudoku.Frame{Type: frameType, StreamID: id, Payload: payload}
+	if _, err := frame.WriteTo(session.conn); err != nil {
+		session.closeWithError(err)
+		return err
+	}
+	return nil
+}
+
+func (session *muxSession) getStream(id uint32) *muxStream {
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	return session.streams[id]
+}
+
+func (session *muxSession) removeStream(id uint32) {
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	if _, ok := session.streams[id]; ok && id%2 != session.nextID%2 {
+		session.remoteStreams--
+	}
+	delete(session.streams, id)
+}
+
+// 登记对端打开的流，流 ID 不合法时返回 ErrBadStreamID，流的数量达到上限时返回 nil
+func (session *muxSession) acceptStream(id uint32) (*muxStream, error) {
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	if session.err != nil {
+		return nil, session.err
+	}
+	if id%2 == session.nextID%2 || id <= session.remoteID {
+		return nil, ErrBadStreamID
+	}
+	session.remoteID = id
+	if session.remoteStreams >= maxMuxStreams {
+		return nil, nil
+	}
+	session.remoteStreams++
+	stream := newMuxStream(session, id)
+	session.streams[id] = stream
+	return stream, nil
+}
+
+// 接收循环从不阻塞在单个流上，数据先放进流的缓冲区，由流的窗口限制缓冲区大小，超出窗口时关闭会话
+// 需要回写的帧都在新的 goroutine 里发送，避免两端同时阻塞在写入上
+func (session *muxSession) recvLoop() {
+	frame := &sudoku.Frame{Payload: make([]byte, 0, sudoku.MaxFramePayload)}
+	for {
+		if _, err := frame.ReadFrom(session.conn); err != nil {
+			session.closeWithError(err)
+			return
+		}
+		switch frame.Type {
+		case sudoku.FrameOpen:
+			stream, err := session.acceptStream(frame.StreamID)
+			if err != nil {
+				if err == ErrBadStreamID {
+					slog.Warn(err.Error(), "stream", frame.StreamID)
+				}
+				session.closeWithError(err)
+				return
+			}
+			if stream == nil {
+				// 对端打开的流太多，拒绝这个流，会话上的其它流不受影响
+				id := frame.StreamID
+				go session.writeFrame(sudoku.FrameClose, id, nil)
+				continue
+			}
+			if session.onStream == nil {
+				go stream.Close()
+			} else {
+				go session.onStream(stream)
+			}
+		case sudoku.FrameData:
+			// 本地已经关闭的流可能还会收到数据，直接丢弃
+			if stream := session.getStream(frame.StreamID); stream != nil {
+				if err := stream.pushData(frame.Payload); err != nil {
+					slog.Warn(err.Error(), "stream", frame.StreamID)
+					session.closeWithError(err)
+					return
+				}
+			}
+		case sudoku.FrameClose:
+			if stream := session.getStream(frame.StreamID); stream != nil {
+				stream.remoteClose()
+			}
+		case sudoku.FrameFin:
+			if stream := session.getStream(frame.StreamID); stream != nil {
+				stream.remoteCloseWrite()
+			}
+		case sudoku.FrameWindow:
+			if len(frame.Payload) != 4 {
+				slog.Warn(ErrBadFrame.Error(), "type", frame.Type)
+				session.closeWithError(ErrBadFrame)
+				return
+			}
+			if stream := session.getStream(frame.StreamID); stream != nil {
+				stream.addWindow(int(binary.BigEndian.Uint32(frame.Payload)))
+			}
+		default:
+			slog.Warn(ErrBadFrame.Error(), "type", frame.Type)
+			session.closeWithError(ErrBadFrame)
+			return
+		}
+	}
+}
+
+// 多路复用会话上的一个流，实现 io.ReadWriteCloser
+type muxStream struct {
+	id      uint32
+	session *muxSession
+
+	lock sync.Mutex
+	cond *sync.Cond
+	// 已收到但还没有被读走的数据
+	buf bytes.Buffer
+	// 已读走但还没有归还给对端的窗口
+	consumed int
+	// 剩余的发送窗口
+	window int
+
+	localClosed  bool
+	remoteClosed bool
+	// 本地和对端已经关闭发送方向
+	localFin  bool
+	remoteFin bool
+	err       error
+
+	// 读写的期限，零值表示没有期限，到期时唤醒等待中的读写
+	deadline      time.Time
+	deadlineTimer *time.Timer
+}
+
+func newMuxStream(session *muxSession, id uint32) *muxStream {
+	stream := &muxStream{
+		id:      id,
+		session: session,
+		window:  sudoku.InitialStreamWindow,
+	}
+	stream.cond = sync.NewCond(&stream.lock)
+	return stream
+}
+
+func (stream *muxStream) Read(bs []byte) (int, error) {
+	if len(bs) == 0 {
+		return 0, nil
+	}
+	stream.lock.Lock()
+	for stream.buf.Len() == 0 && !stream.localClosed && !stream.remoteClosed && !stream.remoteFin && stream.err == nil && !stream.expired() {
+		stream.cond.Wait()
+	}
+	if stream.localClosed {
+		stream.lock.Unlock()
+		return 0, ErrStreamClosed
+	}
+	if stream.buf.Len() == 0 {
+		err := stream.err
+		if stream.remoteClosed || stream.remoteFin {
+			err = io.EOF
+		} else if err == nil {
+			err = os.ErrDeadlineExceeded
+		}
+		stream.lock.Unlock()
+		return 0, err
+	}
+
+	n, _ := stream.buf.Read(bs)
+	stream.consumed += n
+	// 读走的数据超过半个窗口时归还给对端
+	var increment int
+	if stream.consumed >= sudoku.InitialStreamWindow/2 {
+		increment = stream.consumed
+		stream.consumed = 0
+	}
+	stream.lock.Unlock()
+
+	if increment > 0 {
+		var payload [4]byte
+		binary.BigEndian.PutUint32(payload[:], uint32(increment))
+		stream.session.writeFrame(sudoku.FrameWindow, stream.id, payload[:])
+	}
+	return n, nil
+}
+
+func (stream *muxStream) Write(bs []byte) (n int, err error) {
+	for len(bs) > 0 {
+		stream.lock.Lock()
+		for stream.window == 0 && !stream.localClosed && !stream.remoteClosed && stream.err == nil && !stream.expired() {
+			stream.cond.Wait()
+		}
+		if stream.localClosed || stream.remoteClosed || stream.localFin {
+			stream.lock.Unlock()
+			return n, ErrStreamClosed
+		}
+		if stream.err != nil {
+			err = stream.err
+			stream.lock.Unlock()
+			return
+		}
+		if stream.expired() {
+			stream.lock.Unlock()
+			return n, os.ErrDeadlineExceeded
+		}
+		size := len(bs)
+		if size > stream.window {
+			size = stream.window
+		}
+		if size > sudoku.MaxFramePayload {
+			size = sudoku.MaxFramePayload
+		}
+		stream.window -= size
+		stream.lock.Unlock()
+
+		if err = stream.session.writeFrame(sudoku.FrameData, stream.id, bs[:size]); err != nil {
+			return
+		}
+		n += size
+		bs = bs[size:]
+	}
+	return
+}
+
+// 关闭流并通知对端，对端已经关闭时不再发送
+func (stream *muxStream) Close() error {
+	stream.lock.Lock()
+	if stream.localClosed {
+		stream.lock.Unlock()
+		return nil
+	}
+	stream.localClosed = true
+	notify := !stream.remoteClosed && stream.err == nil
+	stream.buf.Reset()
+	if stream.deadlineTimer != nil {
+		stream.deadlineTimer.Stop()
+	}
+	stream.cond.Broadcast()
+	stream.lock.Unlock()
+
+	stream.session.removeStream(stream.id)
+	if notify {
+		return stream.session.writeFrame(sudoku.FrameClose, stream.id, nil)
+	}
+	return nil
+}
+
+// 关闭发送方向并通知对端，此后仍然可以读取对端的数据
+func (stream *muxStream) CloseWrite() error {
+	stream.lock.Lock()
+	if stream.localClosed || stream.localFin {
+		stream.lock.Unlock()
+		return nil
+	}
+	stream.localFin = true
+	notify := !stream.remoteClosed && stream.err == nil
+	stream.cond.Broadcast()
+	stream.lock.Unlock()
+
+	if notify {
+		return stream.session.writeFrame(sudoku.FrameFin, stream.id, nil)
+	}
+	return nil
+}
+
+// 设置读写的期限，和 net.Conn 一致，到期后读写返回 os.ErrDeadlineExceeded
+func (stream *muxStream) SetDeadline(t time.Time) error {
+	stream.lock.Lock()
+	defer stream.lock.Unlock()
+	if stream.deadlineTimer != nil {
+		stream.deadlineTimer.Stop()
+		stream.deadlineTimer = nil
+	}
+	stream.deadline = t
+	if !t.IsZero() {
+		stream.deadlineTimer = time.AfterFunc(time.Until(t), func() {
+			stream.lock.Lock()
+			stream.cond.Broadcast()
+			stream.lock.Unlock()
+		})
+	}
+	stream.cond.Broadcast()
+	return nil
+}
+
+// 调用时必须持有 lock
+func (stream *muxStream) expired() bool {
+	return !stream.deadline.IsZero() && !time.Now().Before(stream.deadline)
+}
+
+// 缓冲的数据加上还没有归还的窗口不能超过初始窗口，超过时对端没有遵守流量控制
+func (stream *muxStream) pushData(payload []byte) error {
+	stream.lock.Lock()
+	defer stream.lock.Unlock()
+	if stream.localClosed {
+		return nil
+	}
+	if stream.buf.Len()+stream.consumed+len(payload) > sudoku.InitialStreamWindow {
+		return ErrFlowControl
+	}
+	stream.buf.Write(payload)
+	stream.cond.Broadcast()
+	return nil
+}
+
+func (stream *muxStream) remoteClose() {
+	stream.lock.Lock()
+	defer stream.lock.Unlock()
+	stream.remoteClosed = true
+	stream.cond.Broadcast()
+}
+
+func (stream *muxStream) remoteCloseWrite() {
+	stream.lock.Lock()
+	defer stream.lock.Unlock()
+	stream.remoteFin = true
+	stream.cond.Broadcast()
+}
+
+func (stream *muxStream) addWindow(increment int) {
+	stream.lock.Lock()
+	defer stream.lock.Unlock()
+	stream.window += increment
+	stream.cond.Broadcast()
+}
+
+func (stream *muxStream) sessionClosed(err error) {
+	stream.lock.Lock()
+	defer stream.lock.Unlock()
+	stream.err = err
+	stream.cond.Broadcast()
+}
+
+// 客户端的多路复用隧道池
+// 最多保持 size 条隧道，新的流分配到承载流最少的隧道上，断开的隧道会被移除并重新建立
+type muxPool struct {
+	size int
+	dial func() (*muxSession, error)
+
+	lock     sync.Mutex
+	cond     *sync.Cond
+	sessions []*muxSession
+	// 正在建立的隧道，和已经建立的隧道一起不超过 size
+	dialing int
+}
+
+func newMuxPool(size int, dial func() (*muxSession, error)) *muxPool {
+	pool := &muxPool{
+		size: size,
+		dial: dial,
+	}
+	pool.cond = sync.NewCond(&pool.lock)
+	return pool
+}
+
+func (pool *muxPool) OpenStream() (*muxStream, error) {
+	session, err := pool.pick()
+	if err != nil {
+		return nil, err
+	}
+	return session.OpenStream()
+}
+
+func (pool *muxPool) pick() (*muxSession, error) {
+	pool.lock.Lock()
+	var best *muxSession
+	for {
+		alive := pool.sessions[:0]
+		for _, session := range pool.sessions {
+			if !session.IsClosed() {
+				alive = append(alive, session)
+			}
+		}
+		pool.sessions = alive
+
+		best = nil
+		for _, session := range pool.sessions {
+			if best == nil || session.NumStreams() < best.NumStreams() {
+				best = session
+			}
+		}
+		// 隧道没有建满时优先新建隧道
+		if len(pool.sessions)+pool.dialing < pool.size {
+			break
+		}
+		if best != nil {
+			pool.lock.Unlock()
+			return best, nil
+		}
+		// 所有的名额都在建立隧道，等待其中一条建立完成或者失败
+		pool.cond.Wait()
+	}
+	// 在锁内占用名额，并发的调用不会建立超过 size 条隧道
+	pool.dialing++
+	pool.lock.Unlock()
+
+	session, err := pool.dial()
+	pool.lock.Lock()
+	pool.dialing--
+	if err == nil {
+		pool.sessions = append(pool.sessions, session)
+	}
+	pool.cond.Broadcast()
+	pool.lock.Unlock()
+	if err != nil {
+		if best != nil {
+			return best, nil
+		}
+		return nil, err
+	}
+	return session, nil
+}
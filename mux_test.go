@@ -0,0 +1,318 @@
+package sudoku_go
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sudoku_go/sudoku"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// 手工收发帧的对端，用于构造不守规矩的对端
+type rawPeer struct {
+	t      *testing.T
+	conn   net.Conn
+	frames chan sudoku.Frame
+}
+
+func newRawPeer(t *testing.T, conn net.Conn) *rawPeer {
+	peer := &rawPeer{t: t, conn: conn, frames: make(chan sudoku.Frame, 4096)}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		defer close(peer.frames)
+		for {
+			frame := sudoku.Frame{}
+			if _, err := frame.ReadFrom(conn); err != nil {
+				return
+			}
+			peer.frames <- frame
+		}
+	}()
+	return peer
+}
+
+func (peer *rawPeer) send(frameType uint8, id uint32, payload []byte) {
+	frame := &sudoku.Frame{Type: frameType, StreamID: id, Payload: payload}
+	if _, err := frame.WriteTo(peer.conn); err != nil {
+		peer.t.Fatalf("send frame %d on stream %d: %v", frameType, id, err)
+	}
+}
+
+// 等待一个指定类型的帧，跳过其它帧
+func (peer *rawPeer) expect(frameType uint8) sudoku.Frame {
+	peer.t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case frame, ok := <-peer.frames:
+			if !ok {
+				peer.t.Fatalf("connection closed while waiting for frame %d", frameType)
+			}
+			if frame.Type == frameType {
+				return frame
+			}
+		case <-timeout:
+			peer.t.Fatalf("timed out waiting for frame %d", frameType)
+		}
+	}
+}
+
+func waitClosed(t *testing.T, session *muxSession) {
+	t.Helper()
+	select {
+	case <-session.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("session was not closed")
+	}
+}
+
+func TestMuxStreamLifecycle(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	// 服务端把流上的数据原样写回，读到 FIN 之后关闭发送方向
+	server := newMuxSession(serverConn, false, func(stream *muxStream) {
+		io.Copy(stream, stream)
+		stream.CloseWrite()
+		io.Copy(io.Discard, stream)
+		stream.Close()
+	})
+	client := newMuxSession(clientConn, true, nil)
+	defer client.Close()
+	defer server.Close()
+
+	msg := bytes.Repeat([]byte("mux"), 3*sudoku.MaxFramePayload)
+	var streams []*muxStream
+	for i := 0; i < 3; i++ {
+		stream, err := client.OpenStream()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stream.id != uint32(2*i+1) {
+			t.Fatalf("client stream id = %d, want %d", stream.id, 2*i+1)
+		}
+		streams = append(streams, stream)
+	}
+	for _, stream := range streams {
+		if _, err := stream.Write(msg); err != nil {
+			t.Fatal(err)
+		}
+		stream.CloseWrite()
+		if _, err := stream.Write(msg); !errors.Is(err, ErrStreamClosed) {
+			t.Fatalf("write after CloseWrite: %v", err)
+		}
+		echo, err := io.ReadAll(stream)
+		if err != nil || !bytes.Equal(echo, msg) {
+			t.Fatalf("echo of %d bytes, err = %v", len(echo), err)
+		}
+		stream.Close()
+		if _, err := stream.Read(make([]byte, 1)); !errors.Is(err, ErrStreamClosed) {
+			t.Fatalf("read after Close: %v", err)
+		}
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for client.NumStreams() != 0 || server.NumStreams() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("streams left: client %d, server %d", client.NumStreams(), server.NumStreams())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// 关闭会话后所有的流都结束
+	stream, err := client.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+	if _, err := stream.Read(make([]byte, 1)); !errors.Is(err, ErrSessionClosed) {
+		t.Fatalf("read after session close: %v", err)
+	}
+	if _, err := client.OpenStream(); !errors.Is(err, ErrSessionClosed) {
+		t.Fatalf("open after session close: %v", err)
+	}
+}
+
+func TestMuxWriteBlocksOnWindow(t *testing.T) {
+	clientConn, peerConn := net.Pipe()
+	client := newMuxSession(clientConn, true, nil)
+	defer client.Close()
+	peer := newRawPeer(t, peerConn)
+
+	stream, err := client.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer.expect(sudoku.FrameOpen)
+
+	const extra = 100
+	written := make(chan error, 1)
+	go func() {
+		_, err := stream.Write(make([]byte, sudoku.InitialStreamWindow+extra))
+		written <- err
+	}()
+	received := 0
+	for received < sudoku.InitialStreamWindow {
+		received += len(peer.expect(sudoku.FrameData).Payload)
+	}
+	if received != sudoku.InitialStreamWindow {
+		t.Fatalf("received %d bytes, want exactly the window", received)
+	}
+	// 窗口用完之后写入阻塞
+	select {
+	case err := <-written:
+		t.Fatalf("write returned before the window was granted: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	var increment [4]byte
+	binary.BigEndian.PutUint32(increment[:], extra)
+	peer.send(sudoku.FrameWindow, stream.id, increment[:])
+	if n := len(peer.expect(sudoku.FrameData).Payload); n != extra {
+		t.Fatalf("sent %d bytes after the window update, want %d", n, extra)
+	}
+	if err := <-written; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// 服务端会话，对端打开的流都保持打开，不读取数据
+func newHoldingServer(t *testing.T) (*muxSession, *rawPeer, chan *muxStream) {
+	serverConn, peerConn := net.Pipe()
+	streams := make(chan *muxStream, 2*maxMuxStreams)
+	server := newMuxSession(serverConn, false, func(stream *muxStream) { streams <- stream })
+	t.Cleanup(func() { server.Close() })
+	return server, newRawPeer(t, peerConn), streams
+}
+
+func TestMuxWindowOverrun(t *testing.T) {
+	server, peer, streams := newHoldingServer(t)
+	peer.send(sudoku.FrameOpen, 1, nil)
+	<-streams
+
+	payload := make([]byte, sudoku.MaxFramePayload)
+	for sent := 0; sent < sudoku.InitialStreamWindow; sent += len(payload) {
+		peer.send(sudoku.FrameData, 1, payload)
+	}
+	if server.IsClosed() {
+		t.Fatal("session closed while the peer stayed within the window")
+	}
+	// 超出窗口的数据关闭整个会话
+	peer.send(sudoku.FrameData, 1, []byte{0})
+	waitClosed(t, server)
+}
+
+func TestMuxBadStreamID(t *testing.T) {
+	for name, ids := range map[string][]uint32{
+		"zero":       {0},
+		"own parity": {2},
+		"reused":     {1, 1},
+		"decreasing": {5, 3},
+	} {
+		server, peer, _ := newHoldingServer(t)
+		for _, id := range ids {
+			peer.send(sudoku.FrameOpen, id, nil)
+		}
+		select {
+		case <-server.Done():
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: session accepted stream ids %v", name, ids)
+		}
+	}
+}
+
+func TestMuxStreamCap(t *testing.T) {
+	server, peer, streams := newHoldingServer(t)
+	for i := 0; i < maxMuxStreams; i++ {
+		peer.send(sudoku.FrameOpen, uint32(2*i+1), nil)
+	}
+	// 超过上限的流被拒绝，会话上的其它流不受影响
+	rejected := uint32(2*maxMuxStreams + 1)
+	peer.send(sudoku.FrameOpen, rejected, nil)
+	if frame := peer.expect(sudoku.FrameClose); frame.StreamID != rejected {
+		t.Fatalf("closed stream %d, want %d", frame.StreamID, rejected)
+	}
+	if server.IsClosed() || server.NumStreams() != maxMuxStreams {
+		t.Fatalf("closed = %v, streams = %d", server.IsClosed(), server.NumStreams())
+	}
+
+	// 关闭一个流之后可以再打开新的流
+	(<-streams).Close()
+	peer.expect(sudoku.FrameClose)
+	peer.send(sudoku.FrameOpen, rejected+2, nil)
+	deadline := time.After(5 * time.Second)
+	for {
+		select {
+		case stream := <-streams:
+			if stream.id == rejected+2 {
+				return
+			}
+		case <-deadline:
+			t.Fatal("stream was not accepted after another one closed")
+		}
+	}
+}
+
+func TestMuxPoolConcurrentDials(t *testing.T) {
+	const size = 3
+	var dialing, maxDialing, dials atomic.Int32
+	var lock sync.Mutex
+	var sessions []*muxSession
+	defer func() {
+		for _, session := range sessions {
+			session.Close()
+		}
+	}()
+	pool := newMuxPool(size, func() (*muxSession, error) {
+		n := dialing.Add(1)
+		defer dialing.Add(-1)
+		for {
+			max := maxDialing.Load()
+			if n <= max || maxDialing.CompareAndSwap(max, n) {
+				break
+			}
+		}
+		dials.Add(1)
+		time.Sleep(20 * time.Millisecond)
+		clientConn, serverConn := net.Pipe()
+		server := newMuxSession(serverConn, false, func(stream *muxStream) {})
+		client := newMuxSession(clientConn, true, nil)
+		lock.Lock()
+		sessions = append(sessions, server, client)
+		lock.Unlock()
+		return client, nil
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := pool.OpenStream(); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if dials.Load() != size || maxDialing.Load() > size || len(pool.sessions) != size {
+		t.Fatalf("dials = %d, concurrent = %d, sessions = %d, want %d", dials.Load(), maxDialing.Load(), len(pool.sessions), size)
+	}
+	// 流平均分配到各条隧道上
+	for _, session := range pool.sessions {
+		if n := session.NumStreams(); n < 50/size-1 || n > 50/size+2 {
+			t.Errorf("session carries %d streams", n)
+		}
+	}
+
+	// 断开的隧道被移除并重新建立
+	pool.sessions[0].Close()
+	if _, err := pool.OpenStream(); err != nil {
+		t.Fatal(err)
+	}
+	if dials.Load() != size+1 || len(pool.sessions) != size {
+		t.Fatalf("dials = %d, sessions = %d after a session closed", dials.Load(), len(pool.sessions))
+	}
+}
@@ -1,10 +1,11 @@
 package sudoku_go
 
 import (
+	"context"
+	stdcipher "crypto/cipher"
 	"io"
-	"log"
+	"log/slog"
 	"net"
-	"sync"
 	"syscall"
 	"time"
 )
@@ -14,83 +15,145 @@ const (
 )
 
 // 加密传输的 TCP Socket
+// 编码器在 sudoku 握手协商出 SB CODE 之后设置
 type SecureTCPConn struct {
 	io.ReadWriteCloser
-	EncodeCipher *cipher
-	DecodeCipher *cipher
+	EncodeCipher Codec
+	DecodeCipher Codec
+
+	decoder io.Reader
+	encoder io.Writer
+
+	// 启用 AEAD 后的读写状态，nil 表示未启用
+	sealState *aeadState
+	openState *aeadState
+	sealer    io.Writer
+	opener    io.Reader
 }
 
-var (
-	Tx     uint64
-	Rx     uint64
-	TxLock sync.RWMutex
-	RxLock sync.RWMutex
-)
+// 设置两个方向的编码器，必须在第一次编码读写之前调用
+func (secureSocket *SecureTCPConn) setCodec(codec Codec) {
+	secureSocket.EncodeCipher = codec
+	secureSocket.DecodeCipher = codec
+}
+
+// 在此之后写入的数据都先经过 AEAD 加密
+func (secureSocket *SecureTCPConn) enableSeal(aead stdcipher.AEAD) {
+	secureSocket.sealState = newAEADState(aead)
+}
+
+// 在此之后读取的数据都先经过 AEAD 校验和解密
+func (secureSocket *SecureTCPConn) enableOpen(aead stdcipher.AEAD) {
+	secureSocket.openState = newAEADState(aead)
+}
+
+// 读取并解码输入流的 io.Reader，跨读取缓存不完整的分组
+// 同一个连接上的解码读取必须都经过它，否则缓存的数据会丢失
+func (secureSocket *SecureTCPConn) DecodeReader() io.Reader {
+	if secureSocket.decoder == nil {
+		secureSocket.decoder = newDecodeReader(secureSocket.ReadWriteCloser, secureSocket.DecodeCipher)
+		if secureSocket.openState != nil {
+			secureSocket.decoder = newAEADReader(secureSocket.decoder, secureSocket.openState)
+		}
+	}
+	return secureSocket.decoder
+}
+
+// 编码后写入输出流的 io.Writer
+func (secureSocket *SecureTCPConn) EncodeWriter() io.Writer {
+	if secureSocket.encoder == nil {
+		secureSocket.encoder = newEncodeWriter(secureSocket.ReadWriteCloser, secureSocket.EncodeCipher)
+		if secureSocket.sealState != nil {
+			secureSocket.encoder = newAEADWriter(secureSocket.encoder, secureSocket.sealState)
+		}
+	}
+	return secureSocket.encoder
+}
+
+// 不经过数独编码直接读取，启用 AEAD 时仍会校验和解密
+func (secureSocket *SecureTCPConn) Read(bs []byte) (int, error) {
+	if secureSocket.openState == nil {
+		return secureSocket.ReadWriteCloser.Read(bs)
+	}
+	if secureSocket.opener == nil {
+		secureSocket.opener = newAEADReader(secureSocket.ReadWriteCloser, secureSocket.openState)
+	}
+	return secureSocket.opener.Read(bs)
+}
+
+// 不经过数独编码直接写入，启用 AEAD 时仍会加密
+func (secureSocket *SecureTCPConn) Write(bs []byte) (int, error) {
+	if secureSocket.sealState == nil {
+		return secureSocket.ReadWriteCloser.Write(bs)
+	}
+	if secureSocket.sealer == nil {
+		secureSocket.sealer = newAEADWriter(secureSocket.ReadWriteCloser, secureSocket.sealState)
+	}
+	return secureSocket.sealer.Write(bs)
+}
 
 // 从输入流里读取加密过的数据，解密后把原数据放到bs里
 func (secureSocket *SecureTCPConn) DecodeRead(bs []byte) (n int, err error) {
-	// 开辟六倍bs的buf
-	buf := make([]byte, len(bs)*6)
-	n, err = secureSocket.Read(buf)
-	if err != nil {
-		return
-	}
-	copy(bs, secureSocket.DecodeCipher.Decode(buf[:n]))
-	n /= 6
-	return
+	return secureSocket.DecodeReader().Read(bs)
 }
 
 // 把放在bs里的数据加密后立即全部写入输出流
 func (secureSocket *SecureTCPConn) EncodeWrite(bs []byte) (int, error) {
-	sixTimeBs := secureSocket.EncodeCipher.Encode(bs)
-	n, err := secureSocket.Write(sixTimeBs)
-	return n / 6, err
+	return secureSocket.EncodeWriter().Write(bs)
 }
 
-// 从src中源源不断的读取原数据加密后写入到dst，直到src中没有数据可以再读取
-func (secureSocket *SecureTCPConn) EncodeCopy(dst io.ReadWriteCloser) error {
-	buf := make([]byte, bufSize)
-	for {
-		readCount, errRead := secureSocket.Read(buf)
-		if errRead != nil {
-			if errRead != io.EOF {
-				return errRead
-			} else {
-				return nil
-			}
-		}
-		if readCount > 0 {
-			writeCount, errWrite := (&SecureTCPConn{
-				ReadWriteCloser: dst,
-				EncodeCipher:    secureSocket.EncodeCipher,
-				DecodeCipher:    secureSocket.DecodeCipher,
-			}).EncodeWrite(buf[0:readCount])
-			if errWrite != nil {
-				return errWrite
-			}
-			if readCount != writeCount {
-				return io.ErrShortWrite
-			}
+// 设置底层连接的读写期限
+func (secureSocket *SecureTCPConn) SetDeadline(t time.Time) error {
+	setDeadline(secureSocket.ReadWriteCloser, t)
+	return nil
+}
 
-			TxLock.Lock()
-			Tx += uint64(readCount)
-			TxLock.Unlock()
-		}
+// 关闭底层连接的写入方向，之前写入的数据都已经编码和加密，对端读到 EOF
+func (secureSocket *SecureTCPConn) CloseWrite() error {
+	return closeWrite(secureSocket.ReadWriteCloser)
+}
+
+// 隧道上的一个方向经过数独编码，另一个方向直接传输
+type tunnelStream struct {
+	io.Reader
+	io.Writer
+	io.Closer
+}
+
+func (stream *tunnelStream) SetDeadline(t time.Time) error {
+	setDeadline(stream.Closer, t)
+	return nil
+}
+
+func (stream *tunnelStream) CloseWrite() error {
+	return closeWrite(stream.Closer)
+}
+
+// 本地端视角的隧道：写入时编码，读取时不解码
+// 隧道请求之后的所有数据都必须经过它，否则编码器和 AEAD 的状态会不一致
+func (secureSocket *SecureTCPConn) ClientStream() io.ReadWriteCloser {
+	return &tunnelStream{
+		Reader: secureSocket,
+		Writer: secureSocket.EncodeWriter(),
+		Closer: secureSocket,
 	}
 }
 
-// 从src中源源不断的读取加密后的数据解密后写入到dst，直到src中没有数据可以再读取
-func (secureSocket *SecureTCPConn) DecodeCopy(dst io.Writer) error {
+// 服务端视角的隧道：读取时解码，写入时不编码
+func (secureSocket *SecureTCPConn) ServerStream() io.ReadWriteCloser {
+	return &tunnelStream{
+		Reader: secureSocket.DecodeReader(),
+		Writer: secureSocket,
+		Closer: secureSocket,
+	}
+}
+
+// 从src中源源不断的读取数据写入到dst，直到src中没有数据可以再读取
+// 每次写入成功后用写入的字节数调用 count
+func copyStream(dst io.Writer, src io.Reader, count func(n int)) error {
 	buf := make([]byte, bufSize)
 	for {
-		readCount, errRead := secureSocket.DecodeRead(buf)
-		if errRead != nil {
-			if errRead != io.EOF {
-				return errRead
-			} else {
-				return nil
-			}
-		}
+		readCount, errRead := src.Read(buf)
 		if readCount > 0 {
 			writeCount, errWrite := dst.Write(buf[0:readCount])
 			if errWrite != nil {
@@ -100,17 +163,8 @@ func (secureSocket *SecureTCPConn) DecodeCopy(dst io.Writer) error {
 				return io.ErrShortWrite
 			}
 
-			RxLock.Lock()
-			Rx += uint64(readCount)
-			RxLock.Unlock()
+			count(readCount)
 		}
-	}
-}
-
-func (srcSocket *SecureTCPConn) DirectEncodeCopy(dst io.Writer) error {
-	for {
-		buf := make([]byte, bufSize)
-		readCount, errRead := srcSocket.Read(buf)
 		if errRead != nil {
 			if errRead != io.EOF {
 				return errRead
@@ -118,108 +172,132 @@ func (srcSocket *SecureTCPConn) DirectEncodeCopy(dst io.Writer) error {
 				return nil
 			}
 		}
-		if readCount > 0 {
-			writeCount, errWrite := dst.Write(buf[0:readCount])
-			//log.Println(buf[0:readCount])
-			if errWrite != nil {
-				return errWrite
-			}
-			if readCount != writeCount {
-				return io.ErrShortWrite
-			}
-		}
-
 	}
 }
 
-func (srcSocket *SecureTCPConn) DirectDEcodeCopy(dst io.Writer) error {
-	for {
-		buf := make([]byte, bufSize)
-		readCount, errRead := srcSocket.Read(buf)
-		if errRead != nil {
-			if errRead != io.EOF {
-				return errRead
-			} else {
-				return nil
-			}
-		}
-		if readCount > 0 {
-			writeCount, errWrite := dst.Write(buf[0:readCount])
-			//log.Println(buf[0:readCount])
-			if errWrite != nil {
-				return errWrite
-			}
-			if readCount != writeCount {
-				return io.ErrShortWrite
+// 在src和dst之间双向转发，src到dst的流量计入 tx，dst到src的流量计入 rx
+// 一个方向读到 EOF 时只关闭另一端的写入，另一个方向继续转发
+// 两个方向都结束、任意一个方向出错，或者两个方向超过 idle 都没有数据时关闭两端
+func relay(src, dst io.ReadWriteCloser, stats *traffic, idle time.Duration, logger *slog.Logger) {
+	closeBoth := func() {
+		src.Close()
+		dst.Close()
+	}
+	timer := newIdleTimer(idle, func() {
+		logger.Debug("Relay idle timeout", "timeout", idle.String())
+		closeBoth()
+	})
+	defer timer.stop()
+
+	// 读到 EOF 时把半关闭传给写入的一端，不支持半关闭时只能关闭两端
+	finish := func(w io.ReadWriteCloser, err error, direction string) {
+		if err == nil {
+			if err = closeWrite(w); err == nil {
+				return
 			}
 		}
-
+		// 在 copy 的过程中可能会存在网络超时等 error 被 return，只要有一个发生了错误就退出本次工作
+		logger.Debug("Relay ended", "direction", direction, "err", err)
+		closeBoth()
 	}
-}
 
-// see net.DialTCP
-func DialTCPSecure(raddr *net.TCPAddr, SBcode uint8) (*SecureTCPConn, error) {
-	var dialer = net.Dialer{Timeout: 5 * time.Second, KeepAlive: 5 * time.Second, Control: func(network, address string, c syscall.RawConn) error {
-		c.Control(func(fd uintptr) {
-			//Outbound connection needs to be protected in Android VPN mode
-			protect(int(fd))
+	upstream := make(chan struct{})
+	go func() {
+		defer close(upstream)
+		err := copyStream(dst, src, func(n int) {
+			timer.touch()
+			stats.addTx(n)
 		})
-		return nil
-	}}
-	remoteConn, err := dialer.Dial("tcp", raddr.String())
+		finish(dst, err, directionTx)
+	}()
+
+	err := copyStream(src, dst, func(n int) {
+		timer.touch()
+		stats.addRx(n)
+	})
+	finish(src, err, directionRx)
+	<-upstream
+	closeBoth()
+}
+
+// see net.DialTCP，超过 timeout 视为超时
+func DialTCPSecure(raddr *net.TCPAddr, timeout time.Duration) (*SecureTCPConn, error) {
+	start := time.Now()
+	remoteConn, err := dialProtected("tcp", raddr.String(), timeout)
+	observeDial(dialRemote, start, err)
 	//remoteConn, err := net.DialTCP("tcp", nil, raddr)
 	if err != nil {
 		return nil, err
 	}
 	return &SecureTCPConn{
 		ReadWriteCloser: remoteConn,
-		EncodeCipher: &cipher{
-			SBcode: SBcode,
-		},
-		DecodeCipher: &cipher{
-			SBcode: SBcode,
-		},
 	}, nil
 }
 
+// 本地端发起的出站连接，Android VPN 模式下需要保护 socket 不被 VPN 捕获
+func dialProtected(network, address string, timeout time.Duration) (net.Conn, error) {
+	var dialer = net.Dialer{Timeout: timeout, KeepAlive: 5 * time.Second, Control: func(network, address string, c syscall.RawConn) error {
+		c.Control(func(fd uintptr) {
+			//Outbound connection needs to be protected in Android VPN mode
+			protect(int(fd))
+		})
+		return nil
+	}}
+	return dialer.Dial(network, address)
+}
+
 // see net.ListenTCP
-func ListenSecureTCP(laddr *net.TCPAddr, SBCode uint8, handleConn func(localConn *SecureTCPConn), didListen func(listenAddr net.Addr)) error {
+// 每个连接分配一个连接 ID，handleConn 收到带有该 ID 的日志
+// ctx 结束后停止接受新连接，等待正在处理的连接最多 drainTimeout，之后强制关闭它们
+func ListenSecureTCP(ctx context.Context, laddr *net.TCPAddr, drainTimeout time.Duration, handleConn func(localConn *SecureTCPConn, logger *slog.Logger), didListen func(listenAddr net.Addr)) error {
 	listener, err := net.ListenTCP("tcp", laddr)
 	if err != nil {
 		return err
 	}
 
 	defer listener.Close()
+	stop := context.AfterFunc(ctx, func() {
+		listener.Close()
+	})
+	defer stop()
 
 	if didListen != nil {
 		didListen(listener.Addr())
 	}
 
+	conns := newConnTracker()
 	for {
 		localConn, err := listener.AcceptTCP()
 		if err != nil {
-			log.Println(err)
+			if ctx.Err() != nil {
+				break
+			}
+			slog.Error("Failed to accept", "err", err)
 			continue
 		}
-		log.Println("Accept client connection : ", localConn.RemoteAddr())
-		// localConn被关闭时直接清除所有数据 不管没有发送的数据
-		localConn.SetLinger(0)
-		go handleConn(&SecureTCPConn{
-			ReadWriteCloser: localConn,
-			EncodeCipher: &cipher{
-				SBcode: SBCode,
-			},
-			DecodeCipher: &cipher{
-				SBcode: SBCode,
-			},
-		})
+		logger := newConnLogger()
+		logger.Debug("Accept client connection", "client", localConn.RemoteAddr().String())
+		metricConns.add(1)
+		metricActiveConns.add(1)
+		conns.add(localConn)
+		go func() {
+			defer conns.done(localConn)
+			defer metricActiveConns.add(-1)
+			handleConn(&SecureTCPConn{
+				ReadWriteCloser: localConn,
+			}, logger)
+		}()
 	}
+
+	slog.Info("Stopped accepting connections", "addr", listener.Addr().String())
+	conns.drain(drainTimeout)
+	return nil
 }
 
 func protect(fd int) {
 	addr, err := net.ResolveUnixAddr("unix", "protect_path")
 	if err != nil {
-		log.Printf("Failed to resolve: %v\n", err)
+		slog.Warn("Failed to resolve protect path", "err", err)
 		return
 	}
 
@@ -230,10 +308,10 @@ func protect(fd int) {
 	}
 	defer conn.Close()
 
-	log.Println("Connected to VPN Service")
+	slog.Debug("Connected to VPN service")
 	err = sendFD(conn, fd)
 	if err != nil {
-		log.Printf("Failed to protect socket: %v\n", err)
+		slog.Warn("Failed to protect socket", "err", err)
 		return
 	}
 }
@@ -252,13 +330,13 @@ func sendFD(via *net.UnixConn, fd int) error {
 
 	rights := syscall.UnixRights(fd)
 	err = syscall.Sendmsg(socket, nil, rights, nil, 0)
-	log.Println("Send out protected sockets")
+	slog.Debug("Send out protected sockets")
 	if err != nil {
 		return err
 	}
 	data := make([]byte, 1024)
 	_, _, _, _, err = syscall.Recvmsg(socket, nil, data, 0)
-	log.Println("Recv response from VPN service")
+	slog.Debug("Recv response from VPN service")
 	if err != nil {
 		return err
 	}
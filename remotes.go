@@ -0,0 +1,172 @@
+package sudoku_go
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// 多个服务端的选择策略
+const (
+	// 按配置顺序使用第一个可用的服务端
+	StrategyFailover = "failover"
+	// 在可用的服务端之间轮流使用
+	StrategyRoundRobin = "round-robin"
+	// 使用健康检查测得延迟最低的服务端
+	StrategyLatency = "latency"
+)
+
+var (
+	ErrStrategy      = errors.New("remotes: unknown strategy")
+	ErrNoRemote      = errors.New("remotes: no remote server")
+	ErrAllRemoteDown = errors.New("remotes: all remote servers failed")
+)
+
+type remoteServer struct {
+	addr *net.TCPAddr
+	// 不可用的服务端被排除，健康检查成功后恢复
+	healthy bool
+	// 最近一次健康检查测得的握手延迟，0 表示还没有测得
+	latency time.Duration
+}
+
+// 本地端使用的一组服务端
+type remoteGroup struct {
+	strategy string
+	servers  []*remoteServer
+	// 完成一次握手，用于健康检查
+	probe func(addr *net.TCPAddr) error
+
+	lock sync.Mutex
+	next int
+	// 只有在健康检查运行时才排除服务端，否则被排除的服务端无法恢复
+	checking bool
+}
+
+func newRemoteGroup(addrs []*net.TCPAddr, strategy string, probe func(addr *net.TCPAddr) error) (*remoteGroup, error) {
+	switch strategy {
+	case StrategyFailover, StrategyRoundRobin, StrategyLatency:
+	default:
+		return nil, ErrStrategy
+	}
+	if len(addrs) == 0 {
+		return nil, ErrNoRemote
+	}
+	group := &remoteGroup{
+		strategy: strategy,
+		probe:    probe,
+	}
+	for _, addr := range addrs {
+		group.servers = append(group.servers, &remoteServer{addr: addr, healthy: true})
+	}
+	return group, nil
+}
+
+// 按策略返回尝试连接的顺序，可用的服务端在前
+// 所有服务端都不可用时仍然全部尝试
+func (group *remoteGroup) candidates() []*net.TCPAddr {
+	group.lock.Lock()
+	defer group.lock.Unlock()
+
+	var healthy, unhealthy []*remoteServer
+	for _, server := range group.servers {
+		if server.healthy {
+			healthy = append(healthy, server)
+		} else {
+			unhealthy = append(unhealthy, server)
+		}
+	}
+	switch group.strategy {
+	case StrategyRoundRobin:
+		if len(healthy) > 0 {
+			start := group.next % len(healthy)
+			group.next++
+			healthy = append(append([]*remoteServer(nil), healthy[start:]...), healthy[:start]...)
+		}
+	case StrategyLatency:
+		sort.SliceStable(healthy, func(i, j int) bool {
+			// 还没有测得延迟的排在最后
+			li, lj := healthy[i].latency, healthy[j].latency
+			if li == 0 || lj == 0 {
+				return lj == 0 && li != 0
+			}
+			return li < lj
+		})
+	}
+
+	addrs := make([]*net.TCPAddr, 0, len(group.servers))
+	for _, server := range append(healthy, unhealthy...) {
+		addrs = append(addrs, server.addr)
+	}
+	return addrs
+}
+
+// 记录一次连接的结果，连接失败的服务端被排除，直到健康检查成功
+func (group *remoteGroup) report(addr *net.TCPAddr, err error) {
+	group.lock.Lock()
+	defer group.lock.Unlock()
+	if !group.checking {
+		return
+	}
+	for _, server := range group.servers {
+		if server.addr != addr {
+			continue
+		}
+		if err != nil && server.healthy {
+			slog.Warn("Remote server is down", "remote", addr.String(), "err", err)
+			server.healthy = false
+		}
+	}
+}
+
+// 定期对每个服务端做一次完整的 sudoku 握手，更新可用状态和延迟，ctx 结束时停止
+func (group *remoteGroup) healthCheck(ctx context.Context, interval time.Duration) {
+	group.lock.Lock()
+	group.checking = true
+	group.lock.Unlock()
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			group.checkAll()
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+func (group *remoteGroup) checkAll() {
+	var wg sync.WaitGroup
+	for _, server := range group.servers {
+		wg.Add(1)
+		go func(server *remoteServer) {
+			defer wg.Done()
+			start := time.Now()
+			err := group.probe(server.addr)
+			latency := time.Since(start)
+
+			group.lock.Lock()
+			defer group.lock.Unlock()
+			if err != nil {
+				if server.healthy {
+					slog.Warn("Remote server failed health check", "remote", server.addr.String(), "err", err)
+				}
+				server.healthy = false
+				return
+			}
+			if !server.healthy {
+				slog.Info("Remote server is back", "remote", server.addr.String(), "latency", latency)
+			}
+			server.healthy = true
+			server.latency = latency
+		}(server)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,141 @@
+package sudoku_go
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func testRemotes(n int) []*net.TCPAddr {
+	var addrs []*net.TCPAddr
+	for i := 0; i < n; i++ {
+		addrs = append(addrs, &net.TCPAddr{IP: net.IPv4(192, 0, 2, byte(i+1)), Port: 8388})
+	}
+	return addrs
+}
+
+// 把候选顺序写成服务端下标，例如 "2 0 1"
+func order(addrs, candidates []*net.TCPAddr) string {
+	var names []string
+	for _, candidate := range candidates {
+		for i, addr := range addrs {
+			if candidate == addr {
+				names = append(names, fmt.Sprint(i))
+			}
+		}
+	}
+	return strings.Join(names, " ")
+}
+
+func TestRemoteGroupCandidates(t *testing.T) {
+	addrs := testRemotes(3)
+	if _, err := newRemoteGroup(addrs, "random", nil); !errors.Is(err, ErrStrategy) {
+		t.Fatalf("unknown strategy: err = %v", err)
+	}
+	if _, err := newRemoteGroup(nil, StrategyFailover, nil); !errors.Is(err, ErrNoRemote) {
+		t.Fatalf("no remotes: err = %v", err)
+	}
+
+	for _, tc := range []struct {
+		strategy string
+		// 服务端 1 不可用
+		down bool
+		want []string
+	}{
+		{StrategyFailover, false, []string{"0 1 2", "0 1 2"}},
+		{StrategyFailover, true, []string{"0 2 1", "0 2 1"}},
+		{StrategyRoundRobin, false, []string{"0 1 2", "1 2 0", "2 0 1", "0 1 2"}},
+		// 不可用的服务端不参与轮流，排在最后
+		{StrategyRoundRobin, true, []string{"0 2 1", "2 0 1", "0 2 1"}},
+		// 延迟从低到高，还没有测得延迟的服务端 0 排在可用的服务端之后
+		{StrategyLatency, false, []string{"2 1 0", "2 1 0"}},
+		{StrategyLatency, true, []string{"2 0 1"}},
+	} {
+		group, err := newRemoteGroup(addrs, tc.strategy, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		group.servers[1].latency = 30 * time.Millisecond
+		group.servers[2].latency = 10 * time.Millisecond
+		group.servers[1].healthy = !tc.down
+		for i, want := range tc.want {
+			if got := order(addrs, group.candidates()); got != want {
+				t.Errorf("%s, down = %v: candidates %d = %q, want %q", tc.strategy, tc.down, i, got, want)
+			}
+		}
+	}
+
+	// 所有服务端都不可用时仍然按配置顺序全部尝试
+	group, _ := newRemoteGroup(addrs, StrategyRoundRobin, nil)
+	for _, server := range group.servers {
+		server.healthy = false
+	}
+	if got := order(addrs, group.candidates()); got != "0 1 2" {
+		t.Fatalf("all down: candidates = %q", got)
+	}
+}
+
+func TestRemoteGroupHealth(t *testing.T) {
+	addrs := testRemotes(3)
+	var lock sync.Mutex
+	down := map[*net.TCPAddr]bool{}
+	group, err := newRemoteGroup(addrs, StrategyFailover, func(addr *net.TCPAddr) error {
+		lock.Lock()
+		defer lock.Unlock()
+		if down[addr] {
+			return errors.New("connection refused")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	setDown := func(addr *net.TCPAddr, value bool) {
+		lock.Lock()
+		down[addr] = value
+		lock.Unlock()
+	}
+
+	// 没有健康检查时不排除服务端，否则被排除的服务端无法恢复
+	group.report(addrs[0], errors.New("timeout"))
+	if got := order(addrs, group.candidates()); got != "0 1 2" {
+		t.Fatalf("excluded without health checks: candidates = %q", got)
+	}
+
+	group.checking = true
+	group.report(addrs[0], nil)
+	if got := order(addrs, group.candidates()); got != "0 1 2" {
+		t.Fatalf("successful connection: candidates = %q", got)
+	}
+	// 连接失败的服务端被排除
+	group.report(addrs[0], errors.New("timeout"))
+	if got := order(addrs, group.candidates()); got != "1 2 0" {
+		t.Fatalf("after a failed connection: candidates = %q", got)
+	}
+	// 连接成功不会恢复被排除的服务端，只有健康检查可以
+	group.report(addrs[0], nil)
+	if got := order(addrs, group.candidates()); got != "1 2 0" {
+		t.Fatalf("reinstated by a connection: candidates = %q", got)
+	}
+
+	// 健康检查失败的服务端被排除，成功的恢复并记录延迟
+	setDown(addrs[1], true)
+	group.checkAll()
+	if got := order(addrs, group.candidates()); got != "0 2 1" {
+		t.Fatalf("after a health check: candidates = %q", got)
+	}
+	for i, server := range group.servers {
+		if i != 1 && server.latency == 0 {
+			t.Errorf("server %d: latency was not recorded", i)
+		}
+	}
+	setDown(addrs[1], false)
+	group.checkAll()
+	if got := order(addrs, group.candidates()); got != "0 1 2" {
+		t.Fatalf("after recovery: candidates = %q", got)
+	}
+}
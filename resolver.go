@@ -0,0 +1,464 @@
+package sudoku_go
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 地址族偏好，决定解析结果的顺序和 Happy Eyeballs 先尝试的地址族
+const (
+	PreferIPv4 = "ipv4"
+	PreferIPv6 = "ipv6"
+)
+
+// 上游 DNS 服务器的协议
+const (
+	upstreamUDP = "udp"
+	upstreamTCP = "tcp"
+	upstreamTLS = "tls"
+)
+
+const (
+	// 向一个上游查询的超时
+	dnsQueryTimeout = 3 * time.Second
+	// 系统解析器不返回 TTL，结果缓存固定的时长
+	systemTTL = 30 * time.Second
+	// 域名不存在的结果缓存的时长
+	negativeTTL = 10 * time.Second
+	// TTL 的上限，避免异常的长 TTL 让结果长期不更新
+	maxTTL = time.Hour
+	// 缓存的域名数量上限
+	maxCacheSize = 4096
+	// Happy Eyeballs 两次连接尝试之间的间隔，见 RFC 8305
+	connectionAttemptDelay = 250 * time.Millisecond
+)
+
+var (
+	ErrResolverPrefer   = errors.New("resolver: unknown address preference")
+	ErrResolverUpstream = errors.New("resolver: bad upstream")
+)
+
+// 服务端解析目标域名的解析器
+//
+// 上游按顺序尝试，格式为 udp://、tcp:// 或 tls://（DNS over TLS）加地址，省略协议时为 udp，例如:
+//
+//	1.1.1.1
+//	tcp://8.8.8.8:53
+//	tls://1.1.1.1:853#cloudflare-dns.com
+//
+// tls 上游用 # 之后的名字校验证书，省略时使用地址中的主机名或 IP。没有配置上游时使用系统解析器。
+// A 和 AAAA 记录同时查询，结果按 TTL 缓存，同一个域名同时只有一次查询
+type Resolver struct {
+	upstreams []dnsUpstream
+	prefer    string
+
+	lock     sync.Mutex
+	cache    map[string]*resolverEntry
+	inflight map[string]*resolverCall
+}
+
+type dnsUpstream struct {
+	network    string
+	addr       string
+	serverName string
+}
+
+type resolverEntry struct {
+	addrs   []netip.Addr
+	err     error
+	expires time.Time
+}
+
+type resolverCall struct {
+	done  chan struct{}
+	entry *resolverEntry
+}
+
+// 解析上游列表，prefer 为 PreferIPv4 或 PreferIPv6，为空时为 PreferIPv4
+func NewResolver(upstreams []string, prefer string) (*Resolver, error) {
+	switch prefer {
+	case "":
+		prefer = PreferIPv4
+	case PreferIPv4, PreferIPv6:
+	default:
+		return nil, ErrResolverPrefer
+	}
+	resolver := &Resolver{
+		prefer:   prefer,
+		cache:    make(map[string]*resolverEntry),
+		inflight: make(map[string]*resolverCall),
+	}
+	for _, s := range upstreams {
+		upstream, err := parseUpstream(s)
+		if err != nil {
+			return nil, err
+		}
+		resolver.upstreams = append(resolver.upstreams, upstream)
+	}
+	return resolver, nil
+}
+
+func parseUpstream(s string) (dnsUpstream, error) {
+	if !strings.Contains(s, "://") {
+		s = upstreamUDP + "://" + s
+	}
+	u, err := url.Parse(s)
+	if err != nil || u.Hostname() == "" {
+		return dnsUpstream{}, fmt.Errorf("%w: %q", ErrResolverUpstream, s)
+	}
+	port := u.Port()
+	switch u.Scheme {
+	case upstreamUDP, upstreamTCP:
+		if port == "" {
+			port = "53"
+		}
+	case upstreamTLS:
+		if port == "" {
+			port = "853"
+		}
+	default:
+		return dnsUpstream{}, fmt.Errorf("%w: unknown protocol in %q", ErrResolverUpstream, s)
+	}
+	upstream := dnsUpstream{
+		network:    u.Scheme,
+		addr:       net.JoinHostPort(u.Hostname(), port),
+		serverName: u.Fragment,
+	}
+	if upstream.serverName == "" {
+		upstream.serverName = u.Hostname()
+	}
+	return upstream, nil
+}
+
+// 解析域名，返回按地址族偏好排序的地址，IP 地址直接返回
+// 出错时返回 *net.DNSError
+func (resolver *Resolver) LookupIP(host string) ([]netip.Addr, error) {
+	if ip, err := netip.ParseAddr(host); err == nil {
+		return []netip.Addr{ip.Unmap()}, nil
+	}
+	name := strings.ToLower(strings.TrimSuffix(host, "."))
+	entry := resolver.lookup(name)
+	if entry.err != nil {
+		return nil, entry.err
+	}
+	return resolver.sort(entry.addrs), nil
+}
+
+func (resolver *Resolver) lookup(name string) *resolverEntry {
+	resolver.lock.Lock()
+	if entry, ok := resolver.cache[name]; ok && time.Now().Before(entry.expires) {
+		resolver.lock.Unlock()
+		metricDNSLookups.add(1, "cache")
+		return entry
+	}
+	// 同一个域名正在查询时等待它的结果
+	if call, ok := resolver.inflight[name]; ok {
+		resolver.lock.Unlock()
+		<-call.done
+		return call.entry
+	}
+	call := &resolverCall{done: make(chan struct{})}
+	resolver.inflight[name] = call
+	resolver.lock.Unlock()
+
+	if len(resolver.upstreams) == 0 {
+		call.entry = lookupSystem(name)
+	} else {
+		call.entry = resolver.lookupUpstreams(name)
+	}
+	if call.entry.err != nil {
+		metricDNSLookups.add(1, "error")
+	} else {
+		metricDNSLookups.add(1, "upstream")
+	}
+
+	resolver.lock.Lock()
+	delete(resolver.inflight, name)
+	if time.Now().Before(call.entry.expires) {
+		resolver.store(name, call.entry)
+	}
+	resolver.lock.Unlock()
+	close(call.done)
+	return call.entry
+}
+
+// 调用时必须持有 lock，缓存满时先清理过期的结果，仍然满时随机丢弃一个
+func (resolver *Resolver) store(name string, entry *resolverEntry) {
+	if len(resolver.cache) >= maxCacheSize {
+		now := time.Now()
+		for key, cached := range resolver.cache {
+			if !now.Before(cached.expires) {
+				delete(resolver.cache, key)
+			}
+		}
+	}
+	if len(resolver.cache) >= maxCacheSize {
+		for key := range resolver.cache {
+			delete(resolver.cache, key)
+			break
+		}
+	}
+	resolver.cache[name] = entry
+}
+
+func lookupSystem(name string) *resolverEntry {
+	ctx, cancel := context.WithTimeout(context.Background(), dnsQueryTimeout)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", name)
+	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return &resolverEntry{err: err, expires: time.Now().Add(negativeTTL)}
+		}
+		return &resolverEntry{err: err}
+	}
+	for i := range addrs {
+		addrs[i] = addrs[i].Unmap()
+	}
+	return &resolverEntry{addrs: addrs, expires: time.Now().Add(systemTTL)}
+}
+
+// 依次询问上游，第一个给出回答的上游决定结果
+func (resolver *Resolver) lookupUpstreams(name string) *resolverEntry {
+	var lastErr error
+	var lastServer string
+	for _, upstream := range resolver.upstreams {
+		var answers [2]*dnsAnswer
+		var errs [2]error
+		var wg sync.WaitGroup
+		for i, qtype := range []uint16{dnsTypeA, dnsTypeAAAA} {
+			wg.Add(1)
+			go func(i int, qtype uint16) {
+				defer wg.Done()
+				answers[i], errs[i] = upstream.query(name, qtype)
+			}(i, qtype)
+		}
+		wg.Wait()
+		if errs[0] != nil && errs[1] != nil {
+			lastErr, lastServer = errs[0], upstream.addr
+			continue
+		}
+		// 一种记录查询失败时，另一种记录没有地址不能说明域名不存在，不缓存，改问下一个上游
+		failed := errs[0]
+		if failed == nil {
+			failed = errs[1]
+		}
+		if failed != nil && (answers[0] == nil || len(answers[0].addrs) == 0) && (answers[1] == nil || len(answers[1].addrs) == 0) {
+			lastErr, lastServer = failed, upstream.addr
+			continue
+		}
+
+		entry := &resolverEntry{}
+		ttl := maxTTL
+		for _, answer := range answers {
+			if answer == nil {
+				continue
+			}
+			entry.addrs = append(entry.addrs, answer.addrs...)
+			if len(answer.addrs) > 0 && answer.ttl < ttl {
+				ttl = answer.ttl
+			}
+		}
+		if len(entry.addrs) == 0 {
+			entry.err = &net.DNSError{Err: "no such host", Name: name, Server: upstream.addr, IsNotFound: true}
+			ttl = negativeTTL
+		}
+		entry.expires = time.Now().Add(ttl)
+		return entry
+	}
+
+	var netErr net.Error
+	return &resolverEntry{err: &net.DNSError{
+		Err:       lastErr.Error(),
+		Name:      name,
+		Server:    lastServer,
+		IsTimeout: errors.As(lastErr, &netErr) && netErr.Timeout(),
+	}}
+}
+
+// 查询一种记录，UDP 的回答被截断时改用 TCP 重新查询
+func (upstream *dnsUpstream) query(name string, qtype uint16) (*dnsAnswer, error) {
+	var idBytes [2]byte
+	if _, err := rand.Read(idBytes[:]); err != nil {
+		return nil, err
+	}
+	id := binary.BigEndian.Uint16(idBytes[:])
+	msg, err := dnsQuery(id, name, qtype)
+	if err != nil {
+		return nil, err
+	}
+	answer, err := upstream.exchange(upstream.network, msg)
+	if err == nil && answer.truncated {
+		answer, err = upstream.exchange(upstreamTCP, msg)
+	}
+	return answer, err
+}
+
+func (upstream *dnsUpstream) exchange(network string, msg []byte) (*dnsAnswer, error) {
+	dialer := &net.Dialer{Timeout: dnsQueryTimeout}
+	var conn net.Conn
+	var err error
+	switch network {
+	case upstreamTLS:
+		conn, err = tls.DialWithDialer(dialer, "tcp", upstream.addr, &tls.Config{ServerName: upstream.serverName})
+	default:
+		conn, err = dialer.Dial(network, upstream.addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(dnsQueryTimeout))
+
+	if network == upstreamUDP {
+		if _, err := conn.Write(msg); err != nil {
+			return nil, err
+		}
+		buf := make([]byte, dnsMaxUDPSize)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				return nil, err
+			}
+			// 忽略和查询不匹配的报文，可能是伪造的或者之前查询迟到的回答
+			answer, err := dnsParse(buf[:n], msg)
+			if errors.Is(err, ErrDNSMismatch) {
+				continue
+			}
+			return answer, err
+		}
+	}
+
+	// TCP 和 TLS 上的报文以两字节长度开头
+	framed := binary.BigEndian.AppendUint16(make([]byte, 0, 2+len(msg)), uint16(len(msg)))
+	if _, err := conn.Write(append(framed, msg...)); err != nil {
+		return nil, err
+	}
+	var length [2]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		return nil, err
+	}
+	resp := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return nil, err
+	}
+	return dnsParse(resp, msg)
+}
+
+// 按地址族偏好排序，同一地址族内保持原来的顺序
+func (resolver *Resolver) sort(addrs []netip.Addr) []netip.Addr {
+	preferV6 := resolver.prefer == PreferIPv6
+	sorted := make([]netip.Addr, 0, len(addrs))
+	for _, addr := range addrs {
+		if addr.Is6() == preferV6 {
+			sorted = append(sorted, addr)
+		}
+	}
+	for _, addr := range addrs {
+		if addr.Is6() != preferV6 {
+			sorted = append(sorted, addr)
+		}
+	}
+	return sorted
+}
+
+// 按 RFC 8305 连接 addrs 中的一个地址，addrs 已经按偏好排序
+// 两个地址族交替尝试，上一次尝试失败或者经过 connectionAttemptDelay 之后开始下一次，
+// 第一个建立的连接胜出，其余的尝试被取消，timeout 为 0 时不限制总的连接时间
+func dialHappyEyeballs(addrs []netip.Addr, port uint16, timeout time.Duration) (*net.TCPConn, error) {
+	if len(addrs) == 0 {
+		return nil, &net.DNSError{Err: "no addresses to dial", IsNotFound: true}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	addrs = interleaveFamilies(addrs)
+
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	results := make(chan result, len(addrs))
+	var dialer net.Dialer
+	next, pending := 0, 0
+	var delay <-chan time.Time
+	attempt := func() {
+		addr := netip.AddrPortFrom(addrs[next], port).String()
+		next++
+		pending++
+		go func() {
+			conn, err := dialer.DialContext(ctx, "tcp", addr)
+			results <- result{conn, err}
+		}()
+		delay = nil
+		if next < len(addrs) {
+			delay = time.After(connectionAttemptDelay)
+		}
+	}
+
+	attempt()
+	var firstErr error
+	for pending > 0 {
+		select {
+		case res := <-results:
+			pending--
+			if res.err == nil {
+				cancel()
+				// 关闭同时建立的其它连接
+				go func(n int) {
+					for ; n > 0; n-- {
+						if res := <-results; res.conn != nil {
+							res.conn.Close()
+						}
+					}
+				}(pending)
+				return res.conn.(*net.TCPConn), nil
+			}
+			if firstErr == nil {
+				firstErr = res.err
+			}
+			if next < len(addrs) {
+				attempt()
+			}
+		case <-delay:
+			attempt()
+		}
+	}
+	return nil, firstErr
+}
+
+// 从第一个地址的地址族开始，两个地址族交替排列
+func interleaveFamilies(addrs []netip.Addr) []netip.Addr {
+	var first, second []netip.Addr
+	for _, addr := range addrs {
+		if addr.Is6() == addrs[0].Is6() {
+			first = append(first, addr)
+		} else {
+			second = append(second, addr)
+		}
+	}
+	interleaved := make([]netip.Addr, 0, len(addrs))
+	for i := 0; i < len(first) || i < len(second); i++ {
+		if i < len(first) {
+			interleaved = append(interleaved, first[i])
+		}
+		if i < len(second) {
+			interleaved = append(interleaved, second[i])
+		}
+	}
+	return interleaved
+}
@@ -0,0 +1,445 @@
+package sudoku_go
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type testRecord struct {
+	rtype uint16
+	ttl   uint32
+	rdata []byte
+}
+
+func recordA(ip string, ttl uint32) testRecord {
+	return testRecord{dnsTypeA, ttl, netip.MustParseAddr(ip).AsSlice()}
+}
+
+func recordAAAA(ip string, ttl uint32) testRecord {
+	return testRecord{dnsTypeAAAA, ttl, netip.MustParseAddr(ip).AsSlice()}
+}
+
+// 按查询构建响应，回答的域名用指向问题的压缩指针
+func dnsResponse(query []byte, flags uint16, records ...testRecord) []byte {
+	msg := append([]byte(nil), query...)
+	binary.BigEndian.PutUint16(msg[2:], dnsFlagResponse|dnsFlagRecursion|flags)
+	binary.BigEndian.PutUint16(msg[6:], uint16(len(records)))
+	for _, record := range records {
+		msg = append(msg, 0xc0, dnsHeaderSize)
+		msg = binary.BigEndian.AppendUint16(msg, record.rtype)
+		msg = binary.BigEndian.AppendUint16(msg, dnsClassIN)
+		msg = binary.BigEndian.AppendUint32(msg, record.ttl)
+		msg = binary.BigEndian.AppendUint16(msg, uint16(len(record.rdata)))
+		msg = append(msg, record.rdata...)
+	}
+	return msg
+}
+
+func queryType(query []byte) uint16 {
+	return binary.BigEndian.Uint16(query[len(query)-4:])
+}
+
+func TestDNSParse(t *testing.T) {
+	query, err := dnsQuery(0x1234, "Example.test.", dnsTypeA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := dnsResponse(query, 0,
+		testRecord{rtype: 5, ttl: 10, rdata: []byte{0xc0, dnsHeaderSize}},
+		recordA("192.0.2.1", 300),
+		recordA("192.0.2.2", 60),
+		recordAAAA("2001:db8::1", 5),
+	)
+	answer, err := dnsParse(resp, query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []netip.Addr{netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("192.0.2.2")}
+	if len(answer.addrs) != 2 || answer.addrs[0] != want[0] || answer.addrs[1] != want[1] {
+		t.Fatalf("addrs = %v, want %v", answer.addrs, want)
+	}
+	if answer.ttl != 60*time.Second {
+		t.Fatalf("ttl = %v, want the shortest address ttl 1m0s", answer.ttl)
+	}
+
+	// 服务器可能改变域名的大小写
+	upper := append([]byte(nil), resp...)
+	upper[dnsHeaderSize+1] = 'E'
+	upper[dnsHeaderSize+2] = 'X'
+	if _, err := dnsParse(upper, query); err != nil {
+		t.Fatalf("case-changed question: %v", err)
+	}
+
+	mismatched := map[string]func(msg []byte){
+		"id":       func(msg []byte) { msg[1]++ },
+		"response": func(msg []byte) { msg[2] &^= dnsFlagResponse >> 8 },
+		"name":     func(msg []byte) { msg[dnsHeaderSize+1] = 'z' },
+		"qtype":    func(msg []byte) { msg[len(query)-3] = dnsTypeAAAA },
+		"qdcount":  func(msg []byte) { msg[5] = 2 },
+	}
+	for name, mutate := range mismatched {
+		msg := append([]byte(nil), resp...)
+		mutate(msg)
+		if _, err := dnsParse(msg, query); !errors.Is(err, ErrDNSMismatch) {
+			t.Errorf("%s: err = %v, want ErrDNSMismatch", name, err)
+		}
+	}
+
+	if _, err := dnsParse(resp[:len(resp)-3], query); !errors.Is(err, ErrDNSBadMessage) {
+		t.Errorf("short answer: err = %v, want ErrDNSBadMessage", err)
+	}
+	if answer, err := dnsParse(dnsResponse(query, dnsRcodeNXDomain), query); err != nil || !answer.nxdomain {
+		t.Errorf("nxdomain: answer = %+v, err = %v", answer, err)
+	}
+	if answer, err := dnsParse(dnsResponse(query, dnsFlagTruncated), query); err != nil || !answer.truncated {
+		t.Errorf("truncated: answer = %+v, err = %v", answer, err)
+	}
+	if _, err := dnsParse(dnsResponse(query, 2), query); !errors.Is(err, ErrDNSServerError) {
+		t.Errorf("servfail: err = %v, want ErrDNSServerError", err)
+	}
+}
+
+// 本地的 DNS 服务器替身，handle 返回 nil 时不回答
+type dnsStandIn struct {
+	handle  func(network string, query []byte) [][]byte
+	queries atomic.Int32
+}
+
+func (standIn *dnsStandIn) answer(network string, query []byte) [][]byte {
+	standIn.queries.Add(1)
+	return standIn.handle(network, query)
+}
+
+func (standIn *dnsStandIn) serveUDP(t *testing.T, conn net.PacketConn) {
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			for _, resp := range standIn.answer(upstreamUDP, append([]byte(nil), buf[:n]...)) {
+				conn.WriteTo(resp, addr)
+			}
+		}
+	}()
+}
+
+func (standIn *dnsStandIn) serveStream(t *testing.T, network string, listener net.Listener) {
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				for {
+					var length [2]byte
+					if _, err := io.ReadFull(conn, length[:]); err != nil {
+						return
+					}
+					query := make([]byte, binary.BigEndian.Uint16(length[:]))
+					if _, err := io.ReadFull(conn, query); err != nil {
+						return
+					}
+					for _, resp := range standIn.answer(network, query) {
+						conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(resp))), resp...))
+					}
+				}
+			}()
+		}
+	}()
+}
+
+// 在同一个端口上监听 UDP 和 TCP，返回地址
+func (standIn *dnsStandIn) listen(t *testing.T) string {
+	for i := 0; i < 10; i++ {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn, err := net.ListenPacket("udp", listener.Addr().String())
+		if err != nil {
+			listener.Close()
+			continue
+		}
+		standIn.serveStream(t, upstreamTCP, listener)
+		standIn.serveUDP(t, conn)
+		return listener.Addr().String()
+	}
+	t.Fatal("no free port for udp and tcp")
+	return ""
+}
+
+var (
+	dotOnce sync.Once
+	dotCert tls.Certificate
+	dotErr  error
+)
+
+// DoT 替身的自签名证书，系统根证书只加载一次，证书通过 SSL_CERT_FILE 在第一次使用 TLS 之前加入
+func dotCertificate(t *testing.T) tls.Certificate {
+	dotOnce.Do(func() {
+		var key *ecdsa.PrivateKey
+		if key, dotErr = ecdsa.GenerateKey(elliptic.P256(), rand.Reader); dotErr != nil {
+			return
+		}
+		template := &x509.Certificate{
+			SerialNumber:          big.NewInt(1),
+			Subject:               pkix.Name{CommonName: "dns.test"},
+			DNSNames:              []string{"dns.test"},
+			NotBefore:             time.Now().Add(-time.Hour),
+			NotAfter:              time.Now().Add(time.Hour),
+			KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+			ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+			BasicConstraintsValid: true,
+			IsCA:                  true,
+		}
+		var der []byte
+		if der, dotErr = x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key); dotErr != nil {
+			return
+		}
+		path := filepath.Join(os.TempDir(), "sudoku-dot-test.pem")
+		if dotErr = os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); dotErr != nil {
+			return
+		}
+		os.Setenv("SSL_CERT_FILE", path)
+		dotCert = tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	})
+	if dotErr != nil {
+		t.Fatal(dotErr)
+	}
+	return dotCert
+}
+
+func (standIn *dnsStandIn) listenTLS(t *testing.T) string {
+	config := &tls.Config{Certificates: []tls.Certificate{dotCertificate(t)}}
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	standIn.serveStream(t, upstreamTLS, listener)
+	return listener.Addr().String()
+}
+
+// 回答 A 和 AAAA 查询的替身
+func addressStandIn() *dnsStandIn {
+	return &dnsStandIn{handle: func(_ string, query []byte) [][]byte {
+		if queryType(query) == dnsTypeA {
+			return [][]byte{dnsResponse(query, 0, recordA("192.0.2.1", 60))}
+		}
+		return [][]byte{dnsResponse(query, 0, recordAAAA("2001:db8::1", 30))}
+	}}
+}
+
+func TestResolverUpstreams(t *testing.T) {
+	standIn := addressStandIn()
+	addr := standIn.listen(t)
+	dotAddr := standIn.listenTLS(t)
+	v4, v6 := netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("2001:db8::1")
+
+	for _, tc := range []struct {
+		upstream string
+		prefer   string
+		want     []netip.Addr
+	}{
+		{addr, PreferIPv4, []netip.Addr{v4, v6}},
+		{"tcp://" + addr, PreferIPv4, []netip.Addr{v4, v6}},
+		{"tls://" + dotAddr + "#dns.test", PreferIPv6, []netip.Addr{v6, v4}},
+	} {
+		resolver, err := NewResolver([]string{tc.upstream}, tc.prefer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		addrs, err := resolver.LookupIP("www.example.test")
+		if err != nil {
+			t.Fatalf("%s: %v", tc.upstream, err)
+		}
+		if len(addrs) != 2 || addrs[0] != tc.want[0] || addrs[1] != tc.want[1] {
+			t.Errorf("%s: addrs = %v, want %v", tc.upstream, addrs, tc.want)
+		}
+	}
+
+	// 证书的名字不匹配时 DoT 查询失败
+	resolver, _ := NewResolver([]string{"tls://" + dotAddr + "#other.test"}, "")
+	if _, err := resolver.LookupIP("www.example.test"); err == nil {
+		t.Error("DoT with a mismatched server name succeeded")
+	}
+}
+
+func TestResolverTruncatedFallsBackToTCP(t *testing.T) {
+	standIn := &dnsStandIn{handle: func(network string, query []byte) [][]byte {
+		if network == upstreamUDP {
+			return [][]byte{dnsResponse(query, dnsFlagTruncated)}
+		}
+		if queryType(query) == dnsTypeA {
+			return [][]byte{dnsResponse(query, 0, recordA("192.0.2.7", 60))}
+		}
+		return [][]byte{dnsResponse(query, 0)}
+	}}
+	resolver, _ := NewResolver([]string{standIn.listen(t)}, "")
+	addrs, err := resolver.LookupIP("big.example.test")
+	if err != nil || len(addrs) != 1 || addrs[0] != netip.MustParseAddr("192.0.2.7") {
+		t.Fatalf("addrs = %v, err = %v", addrs, err)
+	}
+}
+
+func TestResolverIgnoresMismatchedAnswers(t *testing.T) {
+	standIn := &dnsStandIn{handle: func(_ string, query []byte) [][]byte {
+		// 先发一个 ID 相同但问题不同的伪造回答
+		forged := dnsResponse(query, 0, recordA("203.0.113.66", 60), recordAAAA("2001:db8::66", 60))
+		forged[dnsHeaderSize+1] = 'z'
+		if queryType(query) == dnsTypeA {
+			return [][]byte{forged, dnsResponse(query, 0, recordA("192.0.2.1", 60))}
+		}
+		return [][]byte{forged, dnsResponse(query, 0)}
+	}}
+	resolver, _ := NewResolver([]string{standIn.listen(t)}, "")
+	addrs, err := resolver.LookupIP("www.example.test")
+	if err != nil || len(addrs) != 1 || addrs[0] != netip.MustParseAddr("192.0.2.1") {
+		t.Fatalf("addrs = %v, err = %v", addrs, err)
+	}
+}
+
+func TestResolverCache(t *testing.T) {
+	standIn := addressStandIn()
+	resolver, _ := NewResolver([]string{standIn.listen(t)}, "")
+	if _, err := resolver.LookupIP("www.example.test"); err != nil {
+		t.Fatal(err)
+	}
+	if n := standIn.queries.Load(); n != 2 {
+		t.Fatalf("queries = %d, want one A and one AAAA", n)
+	}
+	// 缓存时长为两种记录中最短的 TTL
+	entry := resolver.cache["www.example.test"]
+	if ttl := time.Until(entry.expires); ttl > 30*time.Second || ttl < 25*time.Second {
+		t.Fatalf("cached for %v, want the shortest ttl 30s", ttl)
+	}
+	if _, err := resolver.LookupIP("WWW.example.test."); err != nil {
+		t.Fatal(err)
+	}
+	if n := standIn.queries.Load(); n != 2 {
+		t.Fatalf("queries = %d after a cached lookup, want 2", n)
+	}
+	// 过期之后重新查询
+	resolver.lock.Lock()
+	entry.expires = time.Now().Add(-time.Second)
+	resolver.lock.Unlock()
+	if _, err := resolver.LookupIP("www.example.test"); err != nil {
+		t.Fatal(err)
+	}
+	if n := standIn.queries.Load(); n != 4 {
+		t.Fatalf("queries = %d after expiry, want 4", n)
+	}
+}
+
+func TestResolverNegativeCache(t *testing.T) {
+	var failA atomic.Bool
+	standIn := &dnsStandIn{handle: func(_ string, query []byte) [][]byte {
+		if queryType(query) == dnsTypeA && failA.Load() {
+			return [][]byte{dnsResponse(query, 2)}
+		}
+		return [][]byte{dnsResponse(query, dnsRcodeNXDomain)}
+	}}
+	resolver, _ := NewResolver([]string{standIn.listen(t)}, "")
+
+	// 两种记录都没有时缓存域名不存在的结果
+	_, err := resolver.LookupIP("missing.example.test")
+	var dnsErr *net.DNSError
+	if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+		t.Fatalf("err = %v, want not found", err)
+	}
+	resolver.LookupIP("missing.example.test")
+	if n := standIn.queries.Load(); n != 2 {
+		t.Fatalf("queries = %d, want the negative result cached", n)
+	}
+
+	// 一种记录查询失败时不缓存，也不是域名不存在
+	failA.Store(true)
+	for i := 0; i < 2; i++ {
+		_, err = resolver.LookupIP("flaky.example.test")
+		if !errors.As(err, &dnsErr) || dnsErr.IsNotFound {
+			t.Fatalf("err = %v, want a server failure", err)
+		}
+	}
+	if n := standIn.queries.Load(); n != 6 {
+		t.Fatalf("queries = %d, want the failed lookup queried again", n)
+	}
+}
+
+func TestDialHappyEyeballs(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	port := uint16(listener.Addr().(*net.TCPAddr).Port)
+	local := netip.MustParseAddr("127.0.0.1")
+
+	// 前面的地址失败或者没有响应时尝试下一个地址，不必等到前面的地址超时
+	for _, first := range []string{"::1", "127.0.0.2", "192.0.2.1"} {
+		start := time.Now()
+		conn, err := dialHappyEyeballs([]netip.Addr{netip.MustParseAddr(first), local}, port, 5*time.Second)
+		if err != nil {
+			t.Fatalf("%s first: %v", first, err)
+		}
+		if got := conn.RemoteAddr().(*net.TCPAddr).AddrPort().Addr(); got != local {
+			t.Errorf("%s first: connected to %v", first, got)
+		}
+		conn.Close()
+		if elapsed := time.Since(start); elapsed > 2*time.Second {
+			t.Errorf("%s first: took %v", first, elapsed)
+		}
+	}
+
+	if _, err := dialHappyEyeballs(nil, port, time.Second); err == nil {
+		t.Error("dialing no addresses succeeded")
+	}
+	listener.Close()
+	if _, err := dialHappyEyeballs([]netip.Addr{local}, port, time.Second); err == nil {
+		t.Error("dialing a closed port succeeded")
+	}
+}
+
+func TestInterleaveFamilies(t *testing.T) {
+	var addrs []netip.Addr
+	for _, s := range []string{"2001:db8::1", "2001:db8::2", "192.0.2.1", "2001:db8::3", "192.0.2.2"} {
+		addrs = append(addrs, netip.MustParseAddr(s))
+	}
+	got := interleaveFamilies(addrs)
+	want := []string{"2001:db8::1", "192.0.2.1", "2001:db8::2", "192.0.2.2", "2001:db8::3"}
+	for i, s := range want {
+		if got[i] != netip.MustParseAddr(s) {
+			t.Fatalf("interleaved = %v, want %v", got, want)
+		}
+	}
+}
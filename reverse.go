@@ -0,0 +1,330 @@
+package sudoku_go
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"sudoku_go/sudoku"
+	"sync"
+	"time"
+)
+
+// 反向隧道，把客户端一侧的服务暴露在服务端的地址上
+//
+// 客户端完成握手后发送 CmdReverse 隧道请求，服务端在请求的地址上监听，此后隧道上承载多路复用帧。
+// 服务端每接受一个连接就打开一个流，客户端连接本地目标后在流上转发。隧道断开后客户端重新连接并注册
+
+const (
+	// 反向隧道断开或者注册失败之后重连的等待时间，每次失败加倍，注册成功后恢复
+	reverseMinBackoff = time.Second
+	reverseMaxBackoff = 30 * time.Second
+)
+
+var (
+	ErrReverseForward   = errors.New("reverse: bad forward, want listen=target")
+	ErrReverseForbidden = errors.New("reverse: listen address not allowed")
+	ErrReverseClosed    = errors.New("reverse: server is shutting down")
+)
+
+// 客户端的一条反向隧道
+type ReverseForward struct {
+	// 服务端监听的地址，必须是服务端允许的地址之一
+	Listen *sudoku.Addr
+	// 客户端一侧的目标地址
+	Target string
+}
+
+// 解析 服务端监听地址=本地目标地址，例如 127.0.0.1:8022=192.168.1.10:22
+func ParseReverse(s string) (*ReverseForward, error) {
+	listen, target, found := strings.Cut(s, "=")
+	if !found {
+		return nil, fmt.Errorf("%w: %q", ErrReverseForward, s)
+	}
+	listenAddr, err := sudoku.ParseAddr(strings.TrimSpace(listen))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %q: %v", ErrReverseForward, s, err)
+	}
+	target = strings.TrimSpace(target)
+	if _, _, err := net.SplitHostPort(target); err != nil {
+		return nil, fmt.Errorf("%w: %q: %v", ErrReverseForward, s, err)
+	}
+	return &ReverseForward{Listen: listenAddr, Target: target}, nil
+}
+
+// 保持一条反向隧道，断开后按退避时间重连，ctx 结束后等待正在转发的连接结束再返回
+func (local *LsLocal) runReverse(ctx context.Context, forward *ReverseForward) {
+	logger := slog.With("listen", forward.Listen.String())
+	backoff := reverseMinBackoff
+	for {
+		registered, err := local.serveReverse(ctx, forward, logger)
+		if ctx.Err() != nil {
+			return
+		}
+		if registered {
+			backoff = reverseMinBackoff
+		}
+		logger.Warn("Reverse tunnel failed, reconnecting", "err", err, "retry_in", backoff.String())
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > reverseMaxBackoff {
+			backoff = reverseMaxBackoff
+		}
+	}
+}
+
+// 注册反向隧道并处理服务端打开的流，直到隧道断开或者 ctx 结束
+// 返回是否注册成功，以及隧道断开的原因
+func (local *LsLocal) serveReverse(ctx context.Context, forward *ReverseForward, logger *slog.Logger) (bool, error) {
+	proxyServer, err := local.dialTunnel()
+	if err != nil {
+		return false, err
+	}
+	tunnel := proxyServer.ClientStream()
+	setDeadline(tunnel, deadlineAfter(local.HandshakeTimeout))
+	tunnelReq := &sudoku.TunnelRequest{Cmd: sudoku.CmdReverse, Addr: *forward.Listen}
+	if _, err := tunnelReq.WriteTo(tunnel); err != nil {
+		tunnel.Close()
+		return false, err
+	}
+	tunnelResp := &sudoku.TunnelResponse{}
+	if _, err := tunnelResp.ReadFrom(tunnel); err != nil {
+		tunnel.Close()
+		return false, err
+	}
+	if tunnelResp.Status != sudoku.StatusOK {
+		tunnel.Close()
+		return false, fmt.Errorf("server refused reverse tunnel, status: %#x", tunnelResp.Status)
+	}
+	setDeadline(tunnel, time.Time{})
+
+	// 停止之后拒绝新的流，已经登记的流在排空时等待
+	var lock sync.Mutex
+	stopping := false
+	streams := newConnTracker()
+	session := newMuxSession(tunnel, true, func(stream *muxStream) {
+		lock.Lock()
+		if stopping {
+			lock.Unlock()
+			stream.Close()
+			return
+		}
+		streams.add(stream)
+		lock.Unlock()
+		defer streams.done(stream)
+		local.handleReverseStream(stream, forward, logger.With("stream", stream.id))
+	})
+	logger.Info("Reverse tunnel registered", "target", redact(forward.Target))
+
+	select {
+	case <-session.Done():
+		return true, ErrSessionClosed
+	case <-ctx.Done():
+	}
+	lock.Lock()
+	stopping = true
+	lock.Unlock()
+	streams.drain(local.DrainTimeout)
+	session.Close()
+	return true, nil
+}
+
+// 服务端为接受的连接打开的流，隧道请求中是连接的来源，连接本地目标后返回状态码并转发
+func (local *LsLocal) handleReverseStream(stream *muxStream, forward *ReverseForward, logger *slog.Logger) {
+	defer stream.Close()
+	stream.SetDeadline(deadlineAfter(local.HandshakeTimeout))
+	tunnelReq := &sudoku.TunnelRequest{}
+	if _, err := tunnelReq.ReadFrom(stream); err != nil {
+		logger.Warn("Failed to read tunnel request", "err", err)
+		return
+	}
+
+	tunnelResp := &sudoku.TunnelResponse{Status: sudoku.StatusOK}
+	start := time.Now()
+	conn, err := dialProtected("tcp", forward.Target, local.DialTimeout)
+	observeDial(dialReverse, start, err)
+	if err != nil {
+		logger.Info("Failed to connect reverse target", "target", redact(forward.Target), "err", redact(err))
+		tunnelResp.Status = dialStatus(err)
+		tunnelResp.WriteTo(stream)
+		return
+	}
+	defer conn.Close()
+	if _, err := tunnelResp.WriteTo(stream); err != nil {
+		logger.Warn("Failed to write tunnel response", "err", err)
+		return
+	}
+	stream.SetDeadline(time.Time{})
+	logger.Info("Reverse connection", "source", redact(&tunnelReq.Addr), "target", redact(forward.Target))
+
+	sess := newSession(tunnelReq.Addr.String(), local.User)
+	local.sessions.add(sess, forward.Target, stream, conn)
+	defer local.sessions.remove(sess)
+	relay(stream, conn, sess.traffic, local.IdleTimeout, logger)
+}
+
+// 服务端的反向隧道监听，同一个地址同时只有一条反向隧道
+type reverseTable struct {
+	// 允许客户端请求监听的地址到可以注册的用户
+	allowed map[string]string
+
+	lock      sync.Mutex
+	listeners map[string]net.Listener
+	closed    bool
+}
+
+func newReverseTable(addrs map[string]string) (*reverseTable, error) {
+	table := &reverseTable{
+		allowed:   make(map[string]string),
+		listeners: make(map[string]net.Listener),
+	}
+	for s, user := range addrs {
+		addr, err := sudoku.ParseAddr(s)
+		if err != nil {
+			return nil, fmt.Errorf("reverse: bad listen address %q: %v", s, err)
+		}
+		table.allowed[addr.String()] = user
+	}
+	return table, nil
+}
+
+// 以 user 的身份在 addr 上监听，每个地址只有配置中的用户可以注册
+// 同一个地址上已有的反向隧道属于同一个用户，停止接受连接，客户端重连时服务端可能还没有发现旧的隧道已经断开
+func (table *reverseTable) listen(addr, user string) (net.Listener, error) {
+	table.lock.Lock()
+	defer table.lock.Unlock()
+	if table.closed {
+		return nil, ErrReverseClosed
+	}
+	if owner, ok := table.allowed[addr]; !ok || owner != user {
+		return nil, ErrReverseForbidden
+	}
+	if old, ok := table.listeners[addr]; ok {
+		old.Close()
+		delete(table.listeners, addr)
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	table.listeners[addr] = listener
+	return listener, nil
+}
+
+func (table *reverseTable) remove(addr string, listener net.Listener) {
+	table.lock.Lock()
+	defer table.lock.Unlock()
+	if table.listeners[addr] == listener {
+		delete(table.listeners, addr)
+	}
+}
+
+// 停止所有反向隧道的监听，此后不再接受注册
+func (table *reverseTable) close() {
+	table.lock.Lock()
+	defer table.lock.Unlock()
+	table.closed = true
+	for addr, listener := range table.listeners {
+		listener.Close()
+		delete(table.listeners, addr)
+	}
+}
+
+// 处理客户端注册的反向隧道，停止监听之后等待正在转发的连接结束再关闭隧道
+func (lsServer *LsServer) handleReverse(tunnel io.ReadWriteCloser, addr *sudoku.Addr, user string, logger *slog.Logger) {
+	tunnelResp := &sudoku.TunnelResponse{Status: sudoku.StatusOK}
+	listen := addr.String()
+	listener, err := lsServer.reverse.listen(listen, user)
+	if err != nil {
+		logger.Warn("Can't register reverse tunnel", "listen", listen, "err", err)
+		tunnelResp.Status = sudoku.StatusServiceUnavailable
+		if errors.Is(err, ErrReverseForbidden) {
+			tunnelResp.Status = sudoku.StatusForbidden
+		}
+		tunnelResp.WriteTo(tunnel)
+		return
+	}
+	defer listener.Close()
+	defer lsServer.reverse.remove(listen, listener)
+	if _, err := tunnelResp.WriteTo(tunnel); err != nil {
+		logger.Warn("Failed to write tunnel response", "err", err)
+		return
+	}
+
+	// 客户端不能在反向隧道上打开流
+	session := newMuxSession(tunnel, false, nil)
+	defer session.Close()
+	go func() {
+		<-session.Done()
+		listener.Close()
+	}()
+	logger.Info("Reverse tunnel registered", "listen", listener.Addr().String())
+
+	var forwards sync.WaitGroup
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			// 监听出错时断开隧道，由客户端重新注册
+			if !errors.Is(err, net.ErrClosed) {
+				logger.Warn("Failed to accept", "err", err)
+			}
+			break
+		}
+		forwards.Add(1)
+		go func() {
+			defer forwards.Done()
+			lsServer.forwardReverse(session, conn, listen, user, logger)
+		}()
+	}
+	forwards.Wait()
+	logger.Info("Reverse tunnel closed", "listen", listen)
+}
+
+// 为反向隧道上接受的连接打开一个流，客户端连接本地目标成功后转发
+func (lsServer *LsServer) forwardReverse(session *muxSession, conn net.Conn, listen, user string, logger *slog.Logger) {
+	defer conn.Close()
+	metricConns.add(1)
+	metricActiveConns.add(1)
+	defer metricActiveConns.add(-1)
+
+	stream, err := session.OpenStream()
+	if err != nil {
+		return
+	}
+	defer stream.Close()
+	logger = logger.With("stream", stream.id)
+
+	// 客户端收到请求后才开始连接本地目标
+	if lsServer.HandshakeTimeout > 0 && lsServer.DialTimeout > 0 {
+		stream.SetDeadline(deadlineAfter(lsServer.HandshakeTimeout + lsServer.DialTimeout))
+	}
+	remoteAddr := conn.RemoteAddr().(*net.TCPAddr)
+	source := sudoku.NewIPAddr(remoteAddr.IP, remoteAddr.Port)
+	tunnelReq := &sudoku.TunnelRequest{Cmd: sudoku.CmdConnect, Addr: *source}
+	if _, err := tunnelReq.WriteTo(stream); err != nil {
+		logger.Warn("Failed to write tunnel request", "err", err)
+		return
+	}
+	tunnelResp := &sudoku.TunnelResponse{}
+	if _, err := tunnelResp.ReadFrom(stream); err != nil {
+		logger.Warn("Failed to read tunnel response", "err", err)
+		return
+	}
+	if tunnelResp.Status != sudoku.StatusOK {
+		logger.Info("Client failed to connect reverse target", "source", redact(source), "status", tunnelResp.Status)
+		return
+	}
+	stream.SetDeadline(time.Time{})
+	logger.Info("Reverse connection", "source", redact(source), "listen", listen)
+
+	sess := newSession(source.String(), user)
+	lsServer.sessions.add(sess, "reverse "+listen, conn, stream)
+	defer lsServer.sessions.remove(sess)
+	relay(stream, conn, sess.traffic, lsServer.IdleTimeout, logger)
+}
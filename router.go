@@ -0,0 +1,350 @@
+package sudoku_go
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sudoku_go/sudoku"
+)
+
+// 路由动作
+const (
+	ActionProxy  = "proxy"
+	ActionDirect = "direct"
+	ActionReject = "reject"
+)
+
+// 规则类型
+const (
+	RuleDomain        = "domain"
+	RuleDomainSuffix  = "domain-suffix"
+	RuleDomainKeyword = "domain-keyword"
+	RuleIPCIDR        = "ip-cidr"
+	RulePort          = "port"
+	RuleGeoIP         = "geoip"
+	// 兜底规则，没有值，例如 final,direct
+	RuleFinal = "final"
+)
+
+var ErrBadRule = errors.New("router: bad rule")
+
+// 按顺序匹配的路由规则，第一条匹配的规则决定动作，都不匹配时走代理
+//
+// 规则格式为 类型,值,动作[,no-resolve]，例如:
+//
+//	domain-suffix,cn,direct
+//	domain-keyword,ads,reject
+//	ip-cidr,192.168.0.0/16,direct
+//	port,25,reject
+//	port,8000-9000,direct
+//	geoip,CN,direct
+//	final,proxy
+//
+// 目标为域名时，IP 类规则会在本地解析域名后匹配，加上 no-resolve 则跳过域名目标
+// 解析使用带超时和缓存的系统解析器，一个慢的解析器不会让每次握手都等待
+type Router struct {
+	rules    []*rule
+	geoIP    *geoIPDB
+	resolver *Resolver
+}
+
+type rule struct {
+	kind      string
+	value     string
+	action    string
+	noResolve bool
+
+	prefix    netip.Prefix
+	portStart uint16
+	portEnd   uint16
+}
+
+// 解析规则，规则中使用 geoip 时需要提供 GeoIP 数据库文件
+func NewRouter(rules []string, geoIPPath string) (*Router, error) {
+	resolver, err := NewResolver(nil, PreferIPv4)
+	if err != nil {
+		return nil, err
+	}
+	router := &Router{resolver: resolver}
+	for _, line := range rules {
+		r, err := parseRule(line, ActionProxy, ActionDirect, ActionReject)
+		if err != nil {
+			return nil, err
+		}
+		if r.kind == RuleGeoIP && geoIPPath == "" {
+			return nil, fmt.Errorf("%w: %q needs a geoip database", ErrBadRule, line)
+		}
+		router.rules = append(router.rules, r)
+	}
+	if geoIPPath != "" {
+		db, err := loadGeoIP(geoIPPath)
+		if err != nil {
+			return nil, err
+		}
+		router.geoIP = db
+	}
+	return router, nil
+}
+
+// 解析一条规则，动作必须是 actions 之一
+func parseRule(line string, actions ...string) (*rule, error) {
+	fields := strings.Split(line, ",")
+	for i := range fields {
+		fields[i] = strings.TrimSpace(fields[i])
+	}
+	r := &rule{kind: strings.ToLower(fields[0])}
+	if r.kind == RuleFinal {
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%w: %q", ErrBadRule, line)
+		}
+		r.action = strings.ToLower(fields[1])
+	} else {
+		if len(fields) < 3 || len(fields) > 4 {
+			return nil, fmt.Errorf("%w: %q", ErrBadRule, line)
+		}
+		r.value = fields[1]
+		r.action = strings.ToLower(fields[2])
+		if len(fields) == 4 {
+			if strings.ToLower(fields[3]) != "no-resolve" {
+				return nil, fmt.Errorf("%w: %q", ErrBadRule, line)
+			}
+			r.noResolve = true
+		}
+	}
+	if !slices.Contains(actions, r.action) {
+		return nil, fmt.Errorf("%w: unknown action in %q", ErrBadRule, line)
+	}
+
+	switch r.kind {
+	case RuleDomain, RuleDomainSuffix, RuleDomainKeyword:
+		r.value = strings.ToLower(strings.TrimSuffix(r.value, "."))
+	case RuleIPCIDR:
+		prefix, err := netip.ParsePrefix(r.value)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %q: %v", ErrBadRule, line, err)
+		}
+		r.prefix = prefix.Masked()
+	case RulePort:
+		start, end, found := strings.Cut(r.value, "-")
+		if !found {
+			end = start
+		}
+		portStart, err1 := strconv.ParseUint(start, 10, 16)
+		portEnd, err2 := strconv.ParseUint(end, 10, 16)
+		if err1 != nil || err2 != nil || portStart > portEnd {
+			return nil, fmt.Errorf("%w: %q", ErrBadRule, line)
+		}
+		r.portStart, r.portEnd = uint16(portStart), uint16(portEnd)
+	case RuleGeoIP:
+		r.value = strings.ToUpper(r.value)
+	case RuleFinal:
+	default:
+		return nil, fmt.Errorf("%w: unknown type in %q", ErrBadRule, line)
+	}
+	return r, nil
+}
+
+// 返回目标地址对应的动作
+func (router *Router) Route(addr *sudoku.Addr) string {
+	if router == nil {
+		return ActionProxy
+	}
+	var ip netip.Addr
+	resolved := false
+	if addr.Atyp != sudoku.AtypDomain {
+		ip, _ = netip.ParseAddr(addr.Host)
+		resolved = true
+	}
+	host := strings.ToLower(strings.TrimSuffix(addr.Host, "."))
+
+	for _, r := range router.rules {
+		switch r.kind {
+		case RuleDomain, RuleDomainSuffix, RuleDomainKeyword, RulePort:
+			if r.matchName(addr, host) {
+				return r.action
+			}
+		case RuleIPCIDR, RuleGeoIP:
+			if addr.Atyp == sudoku.AtypDomain && r.noResolve {
+				continue
+			}
+			// 域名只在第一次遇到 IP 类规则时解析一次
+			if !resolved {
+				resolved = true
+				if ips, err := router.resolver.LookupIP(addr.Host); err == nil && len(ips) > 0 {
+					ip = ips[0]
+				}
+			}
+			if !ip.IsValid() {
+				continue
+			}
+			ip = ip.Unmap()
+			if r.kind == RuleIPCIDR && r.prefix.Contains(ip) {
+				return r.action
+			}
+			if r.kind == RuleGeoIP && router.geoIP.lookup(ip) == r.value {
+				return r.action
+			}
+		case RuleFinal:
+			return r.action
+		}
+	}
+	return ActionProxy
+}
+
+// 匹配域名类和端口规则，host 为小写并去掉末尾的点的域名
+func (r *rule) matchName(addr *sudoku.Addr, host string) bool {
+	switch r.kind {
+	case RuleDomain:
+		return addr.Atyp == sudoku.AtypDomain && host == r.value
+	case RuleDomainSuffix:
+		return addr.Atyp == sudoku.AtypDomain && (host == r.value || strings.HasSuffix(host, "."+r.value))
+	case RuleDomainKeyword:
+		return addr.Atyp == sudoku.AtypDomain && strings.Contains(host, r.value)
+	case RulePort:
+		return addr.Port >= r.portStart && addr.Port <= r.portEnd
+	}
+	return false
+}
+
+// 匹配服务端解析之后的目标，ip 为实际要连接的地址，无效时 ip-cidr 规则不匹配
+func (r *rule) matchResolved(addr *sudoku.Addr, host string, ip netip.Addr) bool {
+	switch r.kind {
+	case RuleIPCIDR:
+		return ip.IsValid() && r.prefix.Contains(ip)
+	case RuleFinal:
+		return true
+	}
+	return r.matchName(addr, host)
+}
+
+// GeoIP 风格的数据库，文本文件每行为 CIDR 和国家代码，例如:
+//
+//	1.0.1.0/24 CN
+//	2001:250::/35,CN
+//
+// 空行和以 # 开头的行被忽略
+type geoIPDB struct {
+	entries []geoIPEntry
+}
+
+type geoIPEntry struct {
+	start netip.Addr
+	end   netip.Addr
+	code  string
+}
+
+func loadGeoIP(path string) (*geoIPDB, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	db := &geoIPDB{}
+	scanner := bufio.NewScanner(file)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.FieldsFunc(line, func(r rune) bool {
+			return r == ',' || r == ' ' || r == '\t'
+		})
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("geoip %s:%d: bad line", path, lineNo)
+		}
+		prefix, err := netip.ParsePrefix(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("geoip %s:%d: %v", path, lineNo, err)
+		}
+		prefix = prefix.Masked()
+		db.entries = append(db.entries, geoIPEntry{
+			start: prefix.Addr(),
+			end:   lastAddr(prefix),
+			code:  strings.ToUpper(fields[1]),
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	db.entries = flattenGeoIP(db.entries)
+	return db, nil
+}
+
+// 把嵌套的网段拆分成互不重叠的区间，地址属于包含它的最小的网段
+// CIDR 网段之间只有包含和不相交两种关系，相同的网段以后出现的为准
+func flattenGeoIP(entries []geoIPEntry) []geoIPEntry {
+	// 起始地址相同时外层的网段在前
+	sort.SliceStable(entries, func(i, j int) bool {
+		if c := entries[i].start.Compare(entries[j].start); c != 0 {
+			return c < 0
+		}
+		return entries[j].end.Less(entries[i].end)
+	})
+	var flat []geoIPEntry
+	emit := func(start, end netip.Addr, code string) {
+		if start.IsValid() && end.IsValid() && !end.Less(start) {
+			flat = append(flat, geoIPEntry{start: start, end: end, code: code})
+		}
+	}
+	// 包含当前网段的外层网段，next 为还没有输出的第一个地址
+	type openEntry struct {
+		geoIPEntry
+		next netip.Addr
+	}
+	var stack []*openEntry
+	pop := func() {
+		top := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		emit(top.next, top.end, top.code)
+	}
+	for _, entry := range entries {
+		for len(stack) > 0 && stack[len(stack)-1].end.Less(entry.start) {
+			pop()
+		}
+		if len(stack) > 0 {
+			parent := stack[len(stack)-1]
+			emit(parent.next, entry.start.Prev(), parent.code)
+			parent.next = entry.end.Next()
+		}
+		stack = append(stack, &openEntry{geoIPEntry: entry, next: entry.start})
+	}
+	for len(stack) > 0 {
+		pop()
+	}
+	sort.Slice(flat, func(i, j int) bool {
+		return flat[i].start.Less(flat[j].start)
+	})
+	return flat
+}
+
+// 返回 IP 所属的国家代码，查不到时返回空字符串
+func (db *geoIPDB) lookup(ip netip.Addr) string {
+	if db == nil {
+		return ""
+	}
+	// 区间互不重叠，只需要检查最后一个起始地址不大于 ip 的区间
+	i := sort.Search(len(db.entries), func(i int) bool {
+		return ip.Less(db.entries[i].start)
+	}) - 1
+	if i >= 0 && !db.entries[i].end.Less(ip) && db.entries[i].start.BitLen() == ip.BitLen() {
+		return db.entries[i].code
+	}
+	return ""
+}
+
+// 网段中的最后一个地址
+func lastAddr(prefix netip.Prefix) netip.Addr {
+	bs := prefix.Addr().AsSlice()
+	for bit := prefix.Bits(); bit < len(bs)*8; bit++ {
+		bs[bit/8] |= 0x80 >> (bit % 8)
+	}
+	addr, _ := netip.AddrFromSlice(bs)
+	return addr
+}
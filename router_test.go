@@ -0,0 +1,243 @@
+package sudoku_go
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sudoku_go/sudoku"
+	"testing"
+	"time"
+)
+
+func writeGeoIP(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "geoip.txt")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestGeoIPNestedRanges(t *testing.T) {
+	db, err := loadGeoIP(writeGeoIP(t, `
+# 外层网段在内层网段之后出现
+10.1.2.0/24 CC
+10.0.0.0/8 AA
+10.1.0.0/16,BB
+10.1.0.0/24 DD
+10.2.0.0/16 EE
+192.168.1.0/24 XX
+192.168.1.0/24 YY
+2001:db8::/32 V6
+2001:db8:1::/48 V7
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ip, want := range map[string]string{
+		"9.255.255.255":    "",
+		"10.0.0.1":         "AA",
+		"10.1.0.5":         "DD",
+		"10.1.1.1":         "BB",
+		"10.1.2.3":         "CC",
+		"10.1.3.1":         "BB",
+		"10.1.255.255":     "BB",
+		"10.2.0.0":         "EE",
+		"10.2.255.255":     "EE",
+		"10.3.0.0":         "AA",
+		"10.255.255.255":   "AA",
+		"11.0.0.0":         "",
+		"192.168.1.1":      "YY",
+		"2001:db8::1":      "V6",
+		"2001:db8:1::1":    "V7",
+		"2001:db8:2::1":    "V6",
+		"2001:db9::":       "",
+		"::ffff:10.1.2.3":  "",
+		"::a01:203":        "",
+		"255.255.255.255":  "",
+		"0.0.0.0":          "",
+		"ffff::":           "",
+		"2001:db7:ffff::1": "",
+	} {
+		if got := db.lookup(netip.MustParseAddr(ip)); got != want {
+			t.Errorf("lookup(%s) = %q, want %q", ip, got, want)
+		}
+	}
+	for i := 1; i < len(db.entries); i++ {
+		if !db.entries[i-1].end.Less(db.entries[i].start) {
+			t.Fatalf("entries %v and %v overlap", db.entries[i-1], db.entries[i])
+		}
+	}
+
+	// 覆盖整个地址空间的网段
+	db, err = loadGeoIP(writeGeoIP(t, "0.0.0.0/0 ZZ\n0.0.0.0/8 LO\n255.255.255.0/24 HI\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ip, want := range map[string]string{
+		"0.0.0.1":         "LO",
+		"1.0.0.0":         "ZZ",
+		"255.255.254.255": "ZZ",
+		"255.255.255.255": "HI",
+	} {
+		if got := db.lookup(netip.MustParseAddr(ip)); got != want {
+			t.Errorf("lookup(%s) = %q, want %q", ip, got, want)
+		}
+	}
+
+	if _, err := loadGeoIP(writeGeoIP(t, "10.0.0.0/8\n")); err == nil {
+		t.Error("line without a country code was accepted")
+	}
+	if _, err := loadGeoIP(writeGeoIP(t, "10.0.0.0/33 AA\n")); err == nil {
+		t.Error("bad prefix was accepted")
+	}
+}
+
+func TestParseRule(t *testing.T) {
+	for line, want := range map[string]rule{
+		"domain,Exact.Test.,direct":             {kind: RuleDomain, value: "exact.test", action: ActionDirect},
+		" DOMAIN-SUFFIX , example.com , PROXY ": {kind: RuleDomainSuffix, value: "example.com", action: ActionProxy},
+		"domain-keyword,Ads,reject":             {kind: RuleDomainKeyword, value: "ads", action: ActionReject},
+		"ip-cidr,10.1.2.3/8,direct":             {kind: RuleIPCIDR, value: "10.1.2.3/8", action: ActionDirect, prefix: netip.MustParsePrefix("10.0.0.0/8")},
+		"ip-cidr,2001:db8::/32,direct,no-resolve": {kind: RuleIPCIDR, value: "2001:db8::/32", action: ActionDirect, noResolve: true,
+			prefix: netip.MustParsePrefix("2001:db8::/32")},
+		"port,25,reject":        {kind: RulePort, value: "25", action: ActionReject, portStart: 25, portEnd: 25},
+		"port,8000-9000,direct": {kind: RulePort, value: "8000-9000", action: ActionDirect, portStart: 8000, portEnd: 9000},
+		"geoip,cn,direct":       {kind: RuleGeoIP, value: "CN", action: ActionDirect},
+		"final,Reject":          {kind: RuleFinal, action: ActionReject},
+	} {
+		got, err := parseRule(line, ActionProxy, ActionDirect, ActionReject)
+		if err != nil {
+			t.Errorf("%q: %v", line, err)
+			continue
+		}
+		if *got != want {
+			t.Errorf("%q: got %+v, want %+v", line, *got, want)
+		}
+	}
+
+	for _, line := range []string{
+		"",
+		"domain",
+		"domain,example.com",
+		"domain,example.com,proxy,no-resolve,extra",
+		"domain,example.com,proxy,resolve",
+		"domain,example.com,allow",
+		"final",
+		"final,proxy,extra",
+		"ip-cidr,10.0.0.0/33,direct",
+		"ip-cidr,example.com,direct",
+		"port,70000,reject",
+		"port,9000-8000,reject",
+		"port,http,reject",
+		"port,-25,reject",
+		"port,25-,reject",
+		"regexp,.*,reject",
+	} {
+		if _, err := parseRule(line, ActionProxy, ActionDirect, ActionReject); !errors.Is(err, ErrBadRule) {
+			t.Errorf("%q: err = %v, want ErrBadRule", line, err)
+		}
+	}
+
+	if _, err := NewRouter([]string{"geoip,cn,direct"}, ""); !errors.Is(err, ErrBadRule) {
+		t.Errorf("geoip rule without a database: err = %v", err)
+	}
+}
+
+// 把域名的解析结果放进路由器的缓存，测试不依赖系统解析器
+func cacheHost(router *Router, name string, ips ...string) {
+	entry := &resolverEntry{expires: time.Now().Add(time.Hour)}
+	for _, ip := range ips {
+		entry.addrs = append(entry.addrs, netip.MustParseAddr(ip))
+	}
+	if len(ips) == 0 {
+		entry.err = &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	router.resolver.cache[name] = entry
+}
+
+func mustAddr(t *testing.T, hostport string) *sudoku.Addr {
+	addr, err := sudoku.ParseAddr(hostport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return addr
+}
+
+func TestRouterRoute(t *testing.T) {
+	router, err := NewRouter([]string{
+		"domain,exact.test,direct",
+		"domain-suffix,example.com,direct",
+		"domain-keyword,ads,reject",
+		"port,25,reject",
+		"port,8000-8010,direct",
+		"ip-cidr,192.168.0.0/16,direct,no-resolve",
+		"ip-cidr,10.0.0.0/8,direct",
+		"geoip,cn,direct",
+		"final,reject",
+	}, writeGeoIP(t, "1.0.1.0/24 CN\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cacheHost(router, "sub.exact.test", "203.0.113.9")
+	cacheHost(router, "badexample.com", "203.0.113.9")
+	cacheHost(router, "lan.test", "192.168.1.1")
+	cacheHost(router, "intranet.test", "10.1.2.3")
+	cacheHost(router, "cn.test", "1.0.1.5")
+	cacheHost(router, "missing.test")
+
+	for _, tc := range []struct {
+		addr string
+		want string
+	}{
+		{"exact.test:80", ActionDirect},
+		{"EXACT.Test.:80", ActionDirect},
+		// domain 只匹配完整的域名
+		{"sub.exact.test:80", ActionReject},
+		{"example.com:443", ActionDirect},
+		{"www.Example.com:443", ActionDirect},
+		// domain-suffix 按标签匹配
+		{"badexample.com:443", ActionReject},
+		// 先出现的规则优先
+		{"ads.example.com:80", ActionDirect},
+		{"myads.test:80", ActionReject},
+		{"203.0.113.9:25", ActionReject},
+		{"203.0.113.9:8000", ActionDirect},
+		{"203.0.113.9:8010", ActionDirect},
+		{"203.0.113.9:8011", ActionReject},
+		{"192.168.1.1:80", ActionDirect},
+		// no-resolve 跳过域名目标，其它 IP 类规则仍然解析
+		{"lan.test:80", ActionReject},
+		{"10.1.2.3:80", ActionDirect},
+		{"[::ffff:10.1.2.3]:80", ActionDirect},
+		{"intranet.test:80", ActionDirect},
+		{"1.0.1.5:80", ActionDirect},
+		{"cn.test:80", ActionDirect},
+		{"1.0.2.5:80", ActionReject},
+		// 解析失败时 IP 类规则不匹配
+		{"missing.test:80", ActionReject},
+	} {
+		if got := router.Route(mustAddr(t, tc.addr)); got != tc.want {
+			t.Errorf("Route(%s) = %s, want %s", tc.addr, got, tc.want)
+		}
+	}
+
+	// 规则按顺序匹配，不按类型
+	router, err = NewRouter([]string{"ip-cidr,10.0.0.0/8,reject", "domain,intranet.test,direct"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cacheHost(router, "intranet.test", "10.1.2.3")
+	if got := router.Route(mustAddr(t, "intranet.test:80")); got != ActionReject {
+		t.Errorf("ip rule before domain rule: Route = %s", got)
+	}
+	// 没有 final 规则时默认走代理
+	if got := router.Route(mustAddr(t, "203.0.113.9:80")); got != ActionProxy {
+		t.Errorf("no matching rule: Route = %s", got)
+	}
+	var nilRouter *Router
+	if got := nilRouter.Route(mustAddr(t, "exact.test:80")); got != ActionProxy {
+		t.Errorf("nil router: Route = %s", got)
+	}
+}
@@ -1,237 +1,430 @@
 package sudoku_go
 
 import (
-	"encoding/binary"
-	"log"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"io"
+	"log/slog"
 	"net"
+	"net/netip"
 	"sudoku_go/sudoku"
+	"syscall"
+	"time"
 )
 
 type LsServer struct {
 	ListenAddr *net.TCPAddr
+	// 预共享密钥，用于派生码本和 AEAD 密钥
+	Key string
+	// 是否强制客户端启用 AEAD
+	AEAD bool
+	// 客户端提议的编码器不受支持时使用的 SB CODE
+	Code uint8
+	// 握手失败时转交连接的诱饵服务地址，为空时直接断开
+	Fallback string
+	// 用户 ID 到用户密钥的映射，不为空时要求客户端认证
+	Users map[string]string
+	// 认证失败时不返回 StatusUnauthorized，直接断开或转交给诱饵服务
+	Silent bool
+	// 导出 /metrics 的 HTTP 地址，为空时不启用
+	MetricsAddr string
+	// 管理接口的地址，只能是回环地址或者 unix socket，为空时不启用
+	AdminAddr string
+	// 停止监听之后等待连接结束的时长，超时后强制关闭
+	DrainTimeout time.Duration
+	// 出站访问控制，默认拒绝内部网段，为 nil 时不限制
+	ACL *ACL
+	// 解析目标域名的解析器，默认使用系统解析器并缓存结果
+	Resolver *Resolver
+	// 按规则选择直连或者经过上游代理连接目标，为 nil 时全部直连
+	Outbounds *Outbounds
+	// 允许客户端注册反向隧道的监听地址到可以注册的用户 ID，用户 ID 为空时任何客户端都可以注册
+	// 为空时不允许反向隧道
+	ReverseAddrs map[string]string
+	// 从接受连接到读完隧道请求的超时，连接目标的超时，以及转发时两个方向都没有数据的超时，为 0 时不限制
+	HandshakeTimeout time.Duration
+	DialTimeout      time.Duration
+	IdleTimeout      time.Duration
+
+	replay   *replayCache
+	sessions *sessionTable
+	reverse  *reverseTable
 }
 
 // 新建一个服务端
 // 服务端的职责是:
 // 1. 监听来自本地代理客户端的请求
-// 2. 解密本地代理客户端请求的数据，解析 SOCKS5 协议，连接用户浏览器真正想要连接的远程服务器
+// 2. 解密本地代理客户端请求的数据，解析隧道请求，连接用户浏览器真正想要连接的远程服务器
 // 3. 转发用户浏览器真正想要连接的远程服务器返回的数据的加密后的内容到本地代理客户端
-func NewLsServer(listenAddr string) (*LsServer, error) {
+func NewLsServer(listenAddr, key string) (*LsServer, error) {
 	structListenAddr, err := net.ResolveTCPAddr("tcp", listenAddr)
 	if err != nil {
 		return nil, err
 	}
+	acl, err := NewACL(nil, false)
+	if err != nil {
+		return nil, err
+	}
+	resolver, err := NewResolver(nil, PreferIPv4)
+	if err != nil {
+		return nil, err
+	}
 	return &LsServer{
-		ListenAddr: structListenAddr,
+		ListenAddr:   structListenAddr,
+		Key:          key,
+		Code:         sudoku.DefaultRequest.Code,
+		replay:       newReplayCache(replayCacheSize),
+		sessions:     newSessionTable(),
+		ACL:          acl,
+		Resolver:     resolver,
+		DrainTimeout: 30 * time.Second,
+
+		HandshakeTimeout: DefaultHandshakeTimeout,
+		DialTimeout:      DefaultDialTimeout,
+		IdleTimeout:      DefaultIdleTimeout,
 	}, nil
 
 }
 
 // 运行服务端并且监听来自本地代理客户端的请求
-func (lsServer *LsServer) Listen(didListen func(listenAddr net.Addr)) error {
-	return ListenSecureTCP(lsServer.ListenAddr, sudoku.DefaultRequest.Code, lsServer.handleConn, didListen)
+// ctx 结束后停止接受新连接，排空正在处理的连接后返回
+func (lsServer *LsServer) Listen(ctx context.Context, didListen func(listenAddr net.Addr)) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	defer lsServer.sessions.killAfter(ctx, lsServer.DrainTimeout)()
+
+	reverse, err := newReverseTable(lsServer.ReverseAddrs)
+	if err != nil {
+		return err
+	}
+	lsServer.reverse = reverse
+	// 停止接受新连接时反向隧道也停止监听
+	defer context.AfterFunc(ctx, reverse.close)()
+
+	if lsServer.MetricsAddr != "" {
+		if err := serveMetrics(ctx, lsServer.MetricsAddr); err != nil {
+			return err
+		}
+	}
+	if lsServer.AdminAddr != "" {
+		if err := serveAdmin(ctx, lsServer.AdminAddr, lsServer.sessions); err != nil {
+			return err
+		}
+	}
+	return ListenSecureTCP(ctx, lsServer.ListenAddr, lsServer.DrainTimeout, lsServer.handleConn, didListen)
 }
 
-// 解 SOCKS5 协议
-// https://www.ietf.org/rfc/rfc1928.txt
-func (lsServer *LsServer) handleConn(localConn *SecureTCPConn) {
+// 处理 sudoku 握手和隧道请求，SOCKS5 协议已经在本地端处理
+func (lsServer *LsServer) handleConn(localConn *SecureTCPConn, logger *slog.Logger) {
 	defer localConn.Close()
+	source := remoteAddrOf(localConn)
+	// 握手和隧道请求必须在 HandshakeTimeout 内完成，之后由转发的空闲超时接管
+	setDeadline(localConn, deadlineAfter(lsServer.HandshakeTimeout))
 
 	// 构建sudoku响应
 	sudokuResp := &sudoku.Response{
 		TlsObf:  [3]byte{0x16, 0x03, 0x03},
 		Version: sudoku.Version1,
 		Status:  sudoku.StatusOK,
-		Code:    0x01,
+		Code:    lsServer.Code,
 	}
 
-	// 首先处理sudoku请求
-	sudokuReq := &sudoku.Request{}
-	if _, err := sudokuReq.ReadFrom(localConn); err != nil {
-		log.Printf("Failed to read sudoku request: %v", err)
+	// 首先处理sudoku请求，记录读到的数据以便握手失败时转交给诱饵服务
+	var handshake bytes.Buffer
+	sudokuReq, clientHello, err := lsServer.readRequest(io.TeeReader(localConn.ReadWriteCloser, &handshake))
+	if err != nil {
+		logger.Warn("Failed to read sudoku request", "err", err)
+		metricHandshakeFailures.add(1, handshakeBadRequest)
+		setDeadline(localConn, time.Time{})
+		lsServer.fallback(localConn.ReadWriteCloser, handshake.Bytes(), logger)
 		return
 	}
+	logger.Debug("Sudoku request", "request", redact(sudokuReq.Bytes()))
+	if clientHello != nil {
+		logger.Debug("TLS client hello", "sni", clientHello.ServerName)
+	}
+	// 按请求的握手模式返回响应
+	writeResponse := func() error {
+		if clientHello != nil {
+			return writeServerHello(localConn.ReadWriteCloser, sudokuResp, lsServer.Key, clientHello)
+		}
+		_, err := sudokuResp.WriteTo(localConn.ReadWriteCloser)
+		return err
+	}
 
-	maskCode := sudokuReq.Code
-	if maskCode != 0x01 && maskCode != 0x00 {
-		sudokuResp.Status = sudoku.StatusBadRequest
-		sudokuResp.WriteTo(localConn)
+	sudokuResp.Version = sudokuReq.Version
+	user := string(sudokuReq.UserID)
+	if user != "" {
+		logger = logger.With("user", user)
+	}
+
+	if err := lsServer.authenticate(sudokuReq); err != nil {
+		logger.Warn("Authentication failed", "err", err)
+		if errors.Is(err, ErrReplay) {
+			metricHandshakeFailures.add(1, handshakeReplay)
+		} else {
+			metricHandshakeFailures.add(1, handshakeUnauthorized)
+		}
+		if lsServer.Silent {
+			setDeadline(localConn, time.Time{})
+			lsServer.fallback(localConn.ReadWriteCloser, handshake.Bytes(), logger)
+			return
+		}
+		sudokuResp.Status = sudoku.StatusUnauthorized
+		writeResponse()
 		return
 	}
 
-	// 返回sudoku响应
-	sudokuResp.WriteTo(localConn)
-
-	//Version identifier/method selection request from client
-	buf := make([]byte, 3)
-	/**
-	   The localConn connects to the dstServer, and sends a ver
-	   identifier/method selection message:
-		          +----+----------+----------+
-		          |VER | NMETHODS | METHODS  |
-		          +----+----------+----------+
-		          | 1  |    1     | 1 to 255 |
-		          +----+----------+----------+
-	   The VER field is set to X'05' for this ver of the protocol.  The
-	   NMETHODS field contains the number of method identifier octets that
-	   appear in the METHODS field.
-	*/
-	// 第一个字段VER代表Socks的版本，Socks5默认为0x05，其固定长度为1个字节
-	n, err := localConn.DecodeRead(buf)
-	//n, err := localConn.Read(buf)
-	log.Printf("first request: %v", buf)
-	// 只支持版本5
-	if err != nil || buf[0] != 0x05 || n < 3 {
-		log.Printf("Can't handle the request: %v %v", buf, err)
+	// 客户端提议的编码器不受支持时改用服务端首选的编码器，通过响应告知客户端
+	maskCode := sudokuReq.Code &^ sudoku.CodeAEAD
+	if !SupportedCodec(maskCode) {
+		maskCode = lsServer.Code
+	}
+	codec, err := NewCodec(maskCode, lsServer.Key)
+	if err != nil {
+		logger.Error("Failed to create codec", "code", maskCode, "err", err)
+		metricHandshakeFailures.add(1, handshakeCodec)
+		sudokuResp.Status = sudoku.StatusInternalServerError
+		writeResponse()
 		return
 	}
-	/**
-	   The dstServer selects from one of the methods given in METHODS, and
-	   sends a METHOD selection message:
-
-		          +----+--------+
-		          |VER | METHOD |
-		          +----+--------+
-		          | 1  |   1    |
-		          +----+--------+
-	*/
-	// 不需要验证，直接验证通过
-	//localConn.EncodeWrite([]byte{0x05, 0x00})
-	localConn.Write([]byte{0x05, 0x00})
-
-	/**
-	  +----+-----+-------+------+----------+----------+
-	  |VER | CMD |  RSV  | ATYP | DST.ADDR | DST.PORT |
-	  +----+-----+-------+------+----------+----------+
-	  | 1  |  1  | X'00' |  1   | Variable |    2     |
-	  +----+-----+-------+------+----------+----------+
-	*/
-
-	//Connect request
-	buf = make([]byte, 4)
-	n, err = localConn.DecodeRead(buf)
-	//n, err = localConn.Read(buf)
-	log.Printf("first half of second request: %v", buf)
-	if err != nil || n < 4 {
-		log.Printf("Can't handle the request: %v %v", buf, err)
+	sudokuResp.Code = maskCode
+	localConn.setCodec(codec)
+
+	aeadOn := sudokuReq.Code&sudoku.CodeAEAD != 0
+	if lsServer.AEAD && !aeadOn {
+		logger.Warn("Client did not offer AEAD")
+		metricHandshakeFailures.add(1, handshakeAEADRequired)
+		if lsServer.Fallback != "" {
+			setDeadline(localConn, time.Time{})
+			lsServer.fallback(localConn.ReadWriteCloser, handshake.Bytes(), logger)
+			return
+		}
+		sudokuResp.Status = sudoku.StatusUnauthorized
+		writeResponse()
 		return
 	}
+	if aeadOn {
+		sudokuResp.Code |= sudoku.CodeAEAD
+		sudokuResp.Nonce = make([]byte, sudoku.NonceSize)
+		if _, err := rand.Read(sudokuResp.Nonce); err != nil {
+			logger.Error("Failed to generate nonce", "err", err)
+			return
+		}
+	}
 
-	// CMD代表客户端请求的类型，值长度也是1个字节，有三种类型
-	// CONNECT X'01'
-	if buf[1] != 0x01 {
-		// 目前只支持 CONNECT
-		log.Println("Can't handle command: ", buf[1])
+	// 返回sudoku响应
+	if err := writeResponse(); err != nil {
+		logger.Warn("Failed to write sudoku response", "err", err)
+		metricHandshakeFailures.add(1, handshakeIO)
 		return
 	}
+	// TLS 握手模式下此后的数据都放在 application_data 记录里
+	if clientHello != nil {
+		localConn.ReadWriteCloser = newRecordConn(localConn.ReadWriteCloser, false)
+	}
 
-	var addrLength int
-	addrType := buf[3]
-	switch addrType {
-	case 0x01:
-		//	IP V4 address: X'01'
-		addrLength = net.IPv4len
-	case 0x03:
-		//	DOMAINNAME: X'03'
-		buf = make([]byte, 1)
-		localConn.DecodeRead(buf)
-		//localConn.Read(buf)
-		addrLength = int(buf[0])
-	case 0x04:
-		//	IP V6 address: X'04'
-		addrLength = net.IPv6len
-	default:
-		log.Println("Invalid address type: ", addrType)
+	// 此后两个方向的数据都经过 AEAD
+	if aeadOn {
+		openAEAD, err := clientAEAD(lsServer.Key, sudokuReq.Nonce, sudokuResp.Nonce)
+		if err != nil {
+			logger.Error("Failed to derive key", "err", err)
+			return
+		}
+		sealAEAD, err := serverAEAD(lsServer.Key, sudokuReq.Nonce, sudokuResp.Nonce)
+		if err != nil {
+			logger.Error("Failed to derive key", "err", err)
+			return
+		}
+		localConn.enableOpen(openAEAD)
+		localConn.enableSeal(sealAEAD)
+	}
+
+	// 读取隧道请求，编码数据可能被任意分段，统一经过流式解码器
+	tunnel := localConn.ServerStream()
+	tunnelReq := &sudoku.TunnelRequest{}
+	if _, err := tunnelReq.ReadFrom(tunnel); err != nil {
+		logger.Warn("Failed to read tunnel request", "err", err)
 		return
 	}
-	addrLength += 2
+	setDeadline(localConn, time.Time{})
 
-	buf = make([]byte, addrLength)
-	n, err = localConn.DecodeRead(buf)
-	//n, err = localConn.Read(buf)
-	log.Printf("second half of second request: %v", buf)
-	log.Printf(string(buf[0 : n-2]))
-	if err != nil || n < addrLength {
-		log.Printf("Error reading address, address length: %v, buffer:%v  %v n: %v ", addrLength, buf, err, n)
+	if tunnelReq.Cmd == sudoku.CmdMux {
+		tunnelResp := &sudoku.TunnelResponse{Status: sudoku.StatusOK}
+		if _, err := tunnelResp.WriteTo(tunnel); err != nil {
+			logger.Warn("Failed to write tunnel response", "err", err)
+			return
+		}
+		logger.Debug("Mux session started")
+		session := newMuxSession(tunnel, false, func(stream *muxStream) {
+			lsServer.handleStream(stream, newSession(source, user), logger.With("stream", stream.id))
+		})
+		<-session.Done()
+		logger.Debug("Mux session closed")
 		return
 	}
+	if tunnelReq.Cmd == sudoku.CmdReverse {
+		lsServer.handleReverse(tunnel, &tunnelReq.Addr, user, logger)
+		return
+	}
+	lsServer.handleTunnel(tunnel, tunnelReq, newSession(source, user), logger)
+}
 
-	var dIP []byte
-	// aType 代表请求的远程服务器地址类型，值长度1个字节，有三种类型
-	switch addrType {
-	case 0x01:
-		//	IP V4 address: X'01'
-		dIP = buf[0:net.IPv4len]
-	case 0x03:
-		//	DOMAINNAME: X'03'
-		ipAddr, err := net.ResolveIPAddr("ip", string(buf[0:n-2]))
+// 读取sudoku请求，根据前三个字节区分普通握手和 TLS 握手
+// TLS 握手时同时返回 ClientHello，普通握手时为 nil
+func (lsServer *LsServer) readRequest(r io.Reader) (*sudoku.Request, *sudoku.ClientHello, error) {
+	var prefix [3]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		return nil, nil, err
+	}
+	r = io.MultiReader(bytes.NewReader(prefix[:]), r)
+	if prefix == sudoku.ClientHelloPrefix {
+		clientHello, sudokuReq, err := readClientHello(r, lsServer.Key)
 		if err != nil {
-			log.Println("Can't resolve IP: ", err)
-			return
+			return nil, nil, err
 		}
-		dIP = ipAddr.IP
-	case 0x04:
-		//	IP V6 address: X'04'
-		dIP = buf[0:net.IPv6len]
+		return sudokuReq, clientHello, nil
+	}
+	sudokuReq := &sudoku.Request{}
+	if _, err := sudokuReq.ReadFrom(r); err != nil {
+		return nil, nil, err
+	}
+	return sudokuReq, nil, nil
+}
+
+// 处理多路复用隧道上的一个流，每个流以自己的隧道请求开始
+func (lsServer *LsServer) handleStream(stream *muxStream, sess *session, logger *slog.Logger) {
+	defer stream.Close()
+
+	stream.SetDeadline(deadlineAfter(lsServer.HandshakeTimeout))
+	tunnelReq := &sudoku.TunnelRequest{}
+	if _, err := tunnelReq.ReadFrom(stream); err != nil {
+		logger.Warn("Failed to read tunnel request", "err", err)
+		return
+	}
+	stream.SetDeadline(time.Time{})
+	lsServer.handleTunnel(stream, tunnelReq, sess, logger)
+}
+
+// 连接隧道请求中的目标地址，并在隧道和目标之间转发
+// 连接成功后隧道作为会话登记到管理接口，流量计入会话
+func (lsServer *LsServer) handleTunnel(tunnel io.ReadWriteCloser, tunnelReq *sudoku.TunnelRequest, sess *session, logger *slog.Logger) {
+	tunnelResp := &sudoku.TunnelResponse{Status: sudoku.StatusOK}
+
+	switch tunnelReq.Cmd {
+	case sudoku.CmdConnect:
+	case sudoku.CmdUDPAssociate:
+		lsServer.handleUDPAssociate(tunnel, sess, logger)
+		return
 	default:
-		log.Println("Can't handle address: ", buf[3])
+		logger.Warn("Can't handle command", "cmd", tunnelReq.Cmd)
+		tunnelResp.Status = sudoku.StatusBadRequest
+		tunnelResp.WriteTo(tunnel)
 		return
 	}
-	dPort := buf[n-2:]
-	dstAddr := &net.TCPAddr{
-		IP:   dIP,
-		Port: int(binary.BigEndian.Uint16(dPort)),
+
+	ips, err := lsServer.resolve(&tunnelReq.Addr)
+	var reason string
+	if err == nil {
+		// 检查解析之后的地址，只连接允许的地址，域名指向内网时同样会被拒绝
+		ips, reason = lsServer.ACL.filter(&tunnelReq.Addr, ips)
+	}
+	var ip netip.Addr
+	if len(ips) > 0 {
+		ip = ips[0]
+	}
+	name, outbound := lsServer.Outbounds.route(&tunnelReq.Addr, ip)
+	if err != nil {
+		// 服务端解析不了的域名只能交给上游代理解析，这时访问控制只能按域名检查
+		if name == OutboundDirect || tunnelReq.Addr.Atyp != sudoku.AtypDomain {
+			logger.Info("Can't resolve IP", "dst", redact(&tunnelReq.Addr), "err", redact(err))
+			tunnelResp.Status = dialStatus(err)
+			tunnelResp.WriteTo(tunnel)
+			return
+		}
+		reason = lsServer.ACL.check(&tunnelReq.Addr, netip.Addr{})
+	}
+	if len(ips) == 0 && reason != "" {
+		logger.Info("Outbound denied", "dst", redact(&tunnelReq.Addr), "reason", reason)
+		metricOutboundDenied.add(1, reason)
+		tunnelResp.Status = sudoku.StatusForbidden
+		tunnelResp.WriteTo(tunnel)
+		return
 	}
 
-	// 连接真正的远程服务
-	dstServer, err := net.DialTCP("tcp", nil, dstAddr)
+	// 连接真正的远程服务，直连多个地址时按 Happy Eyeballs 尝试
+	kind := dialTarget
+	if name != OutboundDirect {
+		kind = dialUpstream
+		logger = logger.With("proxy", name)
+	}
+	start := time.Now()
+	dstServer, err := outbound.Dial(&tunnelReq.Addr, ips, lsServer.DialTimeout)
+	observeDial(kind, start, err)
 	if err != nil {
-		log.Println("Error occurred when connecting to real server : ", dstAddr)
+		logger.Info("Failed to connect to real server", "dst", redact(&tunnelReq.Addr), "err", redact(err))
+		tunnelResp.Status = dialStatus(err)
+		tunnelResp.WriteTo(tunnel)
 		return
+	}
+	if name == OutboundDirect {
+		logger.Info("Connected to real server", "dst", redact(remoteAddrOf(dstServer)))
 	} else {
-		log.Println("Connected to real server : ", dstAddr)
-		defer dstServer.Close()
-		// Conn被关闭时直接清除所有数据 不管没有发送的数据
-		dstServer.SetLinger(0)
-
-		// 响应客户端连接成功
-		/**
-		  +----+-----+-------+------+----------+----------+
-		  |VER | REP |  RSV  | ATYP | BND.ADDR | BND.PORT |
-		  +----+-----+-------+------+----------+----------+
-		  | 1  |  1  | X'00' |  1   | Variable |    2     |
-		  +----+-----+-------+------+----------+----------+
-		*/
-		// 响应客户端连接成功
-		//localConn.EncodeWrite([]byte{0x05, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00})
-		localConn.Write([]byte{0x05, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00})
+		logger.Info("Connected through proxy", "dst", redact(&tunnelReq.Addr))
+	}
+	defer dstServer.Close()
+
+	// 响应客户端连接成功
+	if _, err := tunnelResp.WriteTo(tunnel); err != nil {
+		logger.Warn("Failed to write tunnel response", "err", err)
+		return
 	}
 
 	// 进行转发
-	// Decode traffic received from the client side proxy and send it to the real server
-	go func() {
-		//err := localConn.DirectDEcodeCopy(dstServer)
-		err := localConn.DecodeCopy(dstServer)
+	// 客户端发来的流量解码后发给目标，目标返回的流量直接发回客户端
+	lsServer.sessions.add(sess, tunnelReq.Addr.String(), tunnel, dstServer)
+	defer lsServer.sessions.remove(sess)
+	relay(tunnel, dstServer, sess.traffic, lsServer.IdleTimeout, logger)
+}
+
+// 把解析和连接目标时的错误转换为返回给客户端的状态码
+func dialStatus(err error) uint8 {
+	var refused *ProxyRefusedError
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	switch {
+	case errors.As(err, &refused):
+		return refused.Status
+	case errors.As(err, &dnsErr):
+		if dnsErr.IsTimeout {
+			return sudoku.StatusTimeout
+		}
+		return sudoku.StatusHostUnreachable
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return sudoku.StatusConnectionRefused
+	case errors.Is(err, syscall.ENETUNREACH):
+		return sudoku.StatusNetworkUnreachable
+	case errors.Is(err, syscall.EHOSTUNREACH):
+		return sudoku.StatusHostUnreachable
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return sudoku.StatusTimeout
+	case errors.Is(err, sudoku.ErrBadAddr):
+		return sudoku.StatusBadRequest
+	default:
+		return sudoku.StatusServiceUnavailable
+	}
+}
+
+// 解析隧道请求中的地址，IP 地址直接返回
+func (lsServer *LsServer) resolve(addr *sudoku.Addr) ([]netip.Addr, error) {
+	if addr.Atyp != sudoku.AtypDomain {
+		ip, err := netip.ParseAddr(addr.Host)
 		if err != nil {
-			log.Print(err)
-			localConn.Close()
-			dstServer.Close()
+			return nil, sudoku.ErrBadAddr
 		}
-	}()
-
-	// Encode response from the real server adn send it back to the client side proxy
-	//err = (&SecureTCPConn{
-	//	EncodeCipher:    localConn.EncodeCipher,
-	//	DecodeCipher:    localConn.DecodeCipher,
-	//	ReadWriteCloser: dstServer,
-	//}).EncodeCopy(localConn)
-	err = (&SecureTCPConn{
-		EncodeCipher:    localConn.EncodeCipher,
-		DecodeCipher:    localConn.DecodeCipher,
-		ReadWriteCloser: dstServer,
-	}).DirectEncodeCopy(localConn)
-	if err != nil {
-		localConn.Close()
-		dstServer.Close()
+		return []netip.Addr{ip.Unmap()}, nil
 	}
+	return lsServer.Resolver.LookupIP(addr.Host)
 }
@@ -0,0 +1,273 @@
+package sudoku_go
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"sudoku_go/sudoku"
+)
+
+// 本地端的 SOCKS5 协议处理，以及服务端连接上游 SOCKS5 代理的客户端部分
+// https://www.ietf.org/rfc/rfc1928.txt
+
+const (
+	socks5Version = 0x05
+
+	socks5MethodNoAuth       = 0x00
+	socks5MethodUserPass     = 0x02
+	socks5MethodNoAcceptable = 0xff
+
+	// 用户名密码认证的子协商版本，见 RFC 1929
+	socks5UserPassVersion = 0x01
+)
+
+// SOCKS5 REP
+const (
+	socks5Succeeded            = 0x00
+	socks5GeneralFailure       = 0x01
+	socks5NotAllowed           = 0x02
+	socks5NetworkUnreachable   = 0x03
+	socks5HostUnreachable      = 0x04
+	socks5ConnectionRefused    = 0x05
+	socks5TTLExpired           = 0x06
+	socks5CommandNotSupported  = 0x07
+	socks5AddrTypeNotSupported = 0x08
+)
+
+var (
+	ErrSocks5Version = errors.New("socks5: bad version")
+	ErrSocks5NoAuth  = errors.New("socks5: no acceptable authentication method")
+	ErrSocks5Frag    = errors.New("socks5: udp fragmentation not supported")
+	ErrSocks5Auth    = errors.New("socks5: authentication failed")
+)
+
+// 处理版本和认证方法协商，只支持无需认证
+func socks5Negotiate(conn io.ReadWriter) error {
+	/**
+	   The client connects to the server, and sends a version
+	   identifier/method selection message:
+		          +----+----------+----------+
+		          |VER | NMETHODS | METHODS  |
+		          +----+----------+----------+
+		          | 1  |    1     | 1 to 255 |
+		          +----+----------+----------+
+	*/
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return err
+	}
+	if buf[0] != socks5Version {
+		return ErrSocks5Version
+	}
+	methods := make([]byte, buf[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return err
+	}
+
+	/**
+	   The server selects from one of the methods given in METHODS, and
+	   sends a METHOD selection message:
+		          +----+--------+
+		          |VER | METHOD |
+		          +----+--------+
+		          | 1  |   1    |
+		          +----+--------+
+	*/
+	for _, method := range methods {
+		if method == socks5MethodNoAuth {
+			_, err := conn.Write([]byte{socks5Version, socks5MethodNoAuth})
+			return err
+		}
+	}
+	conn.Write([]byte{socks5Version, socks5MethodNoAcceptable})
+	return ErrSocks5NoAuth
+}
+
+// 读取 SOCKS5 请求，返回 CMD 和目标地址
+// 地址类型不受支持时已经向客户端回复了错误
+func socks5ReadRequest(conn io.ReadWriter) (cmd uint8, addr *sudoku.Addr, err error) {
+	/**
+	  +----+-----+-------+------+----------+----------+
+	  |VER | CMD |  RSV  | ATYP | DST.ADDR | DST.PORT |
+	  +----+-----+-------+------+----------+----------+
+	  | 1  |  1  | X'00' |  1   | Variable |    2     |
+	  +----+-----+-------+------+----------+----------+
+	*/
+	buf := make([]byte, 3)
+	if _, err = io.ReadFull(conn, buf); err != nil {
+		return
+	}
+	if buf[0] != socks5Version {
+		err = ErrSocks5Version
+		return
+	}
+	cmd = buf[1]
+	addr = &sudoku.Addr{}
+	if _, err = addr.ReadFrom(conn); err != nil {
+		if err == sudoku.ErrBadAddrType {
+			socks5WriteReply(conn, socks5AddrTypeNotSupported)
+		}
+		return
+	}
+	return
+}
+
+// 回复 SOCKS5 请求，绑定地址固定为 0.0.0.0:0
+func socks5WriteReply(conn io.Writer, rep uint8) error {
+	return socks5WriteReplyBind(conn, rep, &sudoku.Addr{Atyp: sudoku.AtypIPv4, Host: "0.0.0.0"})
+}
+
+// 回复 SOCKS5 请求并告知绑定地址
+func socks5WriteReplyBind(conn io.Writer, rep uint8, bind *sudoku.Addr) error {
+	/**
+	  +----+-----+-------+------+----------+----------+
+	  |VER | REP |  RSV  | ATYP | BND.ADDR | BND.PORT |
+	  +----+-----+-------+------+----------+----------+
+	  | 1  |  1  | X'00' |  1   | Variable |    2     |
+	  +----+-----+-------+------+----------+----------+
+	*/
+	_, err := conn.Write(append([]byte{socks5Version, rep, 0x00}, bind.Bytes()...))
+	return err
+}
+
+// 解析 SOCKS5 UDP 请求头，返回目标地址和数据
+func socks5ParseUDP(bs []byte) (*sudoku.Addr, []byte, error) {
+	/**
+	  +----+------+------+----------+----------+----------+
+	  |RSV | FRAG | ATYP | DST.ADDR | DST.PORT |   DATA   |
+	  +----+------+------+----------+----------+----------+
+	  | 2  |  1   |  1   | Variable |    2     | Variable |
+	  +----+------+------+----------+----------+----------+
+	*/
+	if len(bs) < 3 {
+		return nil, nil, io.ErrUnexpectedEOF
+	}
+	// 不支持分片，分片的数据包直接丢弃
+	if bs[2] != 0x00 {
+		return nil, nil, ErrSocks5Frag
+	}
+	r := bytes.NewReader(bs[3:])
+	addr := &sudoku.Addr{}
+	if _, err := addr.ReadFrom(r); err != nil {
+		return nil, nil, err
+	}
+	return addr, bs[len(bs)-r.Len():], nil
+}
+
+// 为发回客户端的 UDP 数据加上 SOCKS5 UDP 请求头
+func socks5PackUDP(addr *sudoku.Addr, data []byte) []byte {
+	header := addr.Bytes()
+	buf := make([]byte, 0, 3+len(header)+len(data))
+	buf = append(buf, 0x00, 0x00, 0x00)
+	buf = append(buf, header...)
+	return append(buf, data...)
+}
+
+// 作为客户端完成和上游 SOCKS5 代理的协商并发送 CONNECT 请求，返回代理的 REP
+// user 不为空时使用用户名密码认证，域名目标原样交给代理解析
+func socks5Connect(conn io.ReadWriter, addr *sudoku.Addr, user, password string) (uint8, error) {
+	method := byte(socks5MethodNoAuth)
+	if user != "" {
+		method = socks5MethodUserPass
+	}
+	if _, err := conn.Write([]byte{socks5Version, 1, method}); err != nil {
+		return 0, err
+	}
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return 0, err
+	}
+	if buf[0] != socks5Version {
+		return 0, ErrSocks5Version
+	}
+	if buf[1] != method {
+		return 0, ErrSocks5NoAuth
+	}
+
+	if method == socks5MethodUserPass {
+		/**
+		  +----+------+----------+------+----------+
+		  |VER | ULEN |  UNAME   | PLEN |  PASSWD  |
+		  +----+------+----------+------+----------+
+		  | 1  |  1   | 1 to 255 |  1   | 1 to 255 |
+		  +----+------+----------+------+----------+
+		*/
+		if len(user) > 255 || len(password) > 255 {
+			return 0, ErrSocks5Auth
+		}
+		req := []byte{socks5UserPassVersion, byte(len(user))}
+		req = append(req, user...)
+		req = append(req, byte(len(password)))
+		req = append(req, password...)
+		if _, err := conn.Write(req); err != nil {
+			return 0, err
+		}
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			return 0, err
+		}
+		if buf[1] != 0x00 {
+			return 0, ErrSocks5Auth
+		}
+	}
+
+	req := append([]byte{socks5Version, sudoku.CmdConnect, 0x00}, addr.Bytes()...)
+	if _, err := conn.Write(req); err != nil {
+		return 0, err
+	}
+	reply := make([]byte, 3)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return 0, err
+	}
+	if reply[0] != socks5Version {
+		return 0, ErrSocks5Version
+	}
+	// 读掉绑定地址
+	if _, err := (&sudoku.Addr{}).ReadFrom(conn); err != nil {
+		return 0, err
+	}
+	return reply[1], nil
+}
+
+// 把服务端返回的 sudoku 状态码转换为 SOCKS5 REP
+func socks5Rep(status uint8) uint8 {
+	switch status {
+	case sudoku.StatusOK:
+		return socks5Succeeded
+	case sudoku.StatusUnauthorized, sudoku.StatusForbidden:
+		return socks5NotAllowed
+	case sudoku.StatusNetworkUnreachable:
+		return socks5NetworkUnreachable
+	case sudoku.StatusHostUnreachable:
+		return socks5HostUnreachable
+	case sudoku.StatusConnectionRefused:
+		return socks5ConnectionRefused
+	case sudoku.StatusTimeout:
+		return socks5TTLExpired
+	case sudoku.StatusBadRequest:
+		return socks5CommandNotSupported
+	default:
+		return socks5GeneralFailure
+	}
+}
+
+// 把上游 SOCKS5 代理的 REP 转换为 sudoku 状态码
+func statusFromSocks5(rep uint8) uint8 {
+	switch rep {
+	case socks5Succeeded:
+		return sudoku.StatusOK
+	case socks5NotAllowed:
+		return sudoku.StatusForbidden
+	case socks5NetworkUnreachable:
+		return sudoku.StatusNetworkUnreachable
+	case socks5HostUnreachable:
+		return sudoku.StatusHostUnreachable
+	case socks5ConnectionRefused:
+		return sudoku.StatusConnectionRefused
+	case socks5TTLExpired:
+		return sudoku.StatusTimeout
+	case socks5CommandNotSupported, socks5AddrTypeNotSupported:
+		return sudoku.StatusBadRequest
+	default:
+		return sudoku.StatusServiceUnavailable
+	}
+}
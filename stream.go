@@ -0,0 +1,99 @@
+package sudoku_go
+
+import (
+	"io"
+)
+
+// 流式解码器
+// TCP 不保证每次读到的长度是分组长度的倍数，不完整的分组会保留到下一次读取时再拼接解码
+type decodeReader struct {
+	r     io.Reader
+	codec Codec
+	err   error
+
+	// 尚未凑满一个分组的编码数据
+	buf []byte
+	n   int
+
+	// 已解码但还没有被读走的原数据
+	plain []byte
+	out   []byte
+}
+
+func newDecodeReader(r io.Reader, codec Codec) *decodeReader {
+	return &decodeReader{
+		r:     r,
+		codec: codec,
+		buf:   make([]byte, bufSize*codec.Ratio()),
+		plain: make([]byte, bufSize),
+	}
+}
+
+func (d *decodeReader) Read(bs []byte) (int, error) {
+	if len(bs) == 0 {
+		return 0, nil
+	}
+	ratio := d.codec.Ratio()
+	for len(d.out) == 0 {
+		if d.err != nil {
+			if d.err == io.EOF && d.n > 0 {
+				// 流在分组中间结束
+				return 0, io.ErrUnexpectedEOF
+			}
+			return 0, d.err
+		}
+
+		n, err := d.r.Read(d.buf[d.n:])
+		d.n += n
+		d.err = err
+
+		groups := d.n / ratio
+		if groups == 0 {
+			continue
+		}
+		size := groups * ratio
+		m, err := d.codec.Decode(d.plain, d.buf[:size])
+		if err != nil {
+			metricCodecErrors.add(1, "decode")
+			d.err = err
+			d.n = 0
+			return 0, err
+		}
+		d.out = d.plain[:m]
+		d.n = copy(d.buf, d.buf[size:d.n])
+	}
+	n := copy(bs, d.out)
+	d.out = d.out[n:]
+	return n, nil
+}
+
+// 流式编码器，写入的原数据编码后立即全部写入底层输出流
+type encodeWriter struct {
+	w     io.Writer
+	codec Codec
+	buf   []byte
+}
+
+func newEncodeWriter(w io.Writer, codec Codec) *encodeWriter {
+	return &encodeWriter{
+		w:     w,
+		codec: codec,
+		buf:   make([]byte, bufSize*codec.Ratio()),
+	}
+}
+
+func (e *encodeWriter) Write(bs []byte) (n int, err error) {
+	for len(bs) > 0 {
+		chunk := bs
+		if len(chunk) > bufSize {
+			chunk = chunk[:bufSize]
+		}
+		size := e.codec.Encode(e.buf, chunk)
+		if _, err = e.w.Write(e.buf[:size]); err != nil {
+			return
+		}
+		n += len(chunk)
+		bs = bs[len(chunk):]
+	}
+	return
+}
@@ -0,0 +1,107 @@
+package sudoku_go
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"sudoku_go/sudoku"
+	"testing"
+	"testing/iotest"
+)
+
+// 每次读取随机长度的 reader，模拟任意的 TCP 分段
+type chunkReader struct {
+	r    io.Reader
+	rand *rand.Rand
+}
+
+func (c *chunkReader) Read(bs []byte) (int, error) {
+	if len(bs) > 1 {
+		bs = bs[:1+c.rand.Intn(len(bs)-1)]
+	}
+	return c.r.Read(bs)
+}
+
+func streamCodec(t *testing.T) Codec {
+	codec, err := NewCodec(0x00, "stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return codec
+}
+
+func encodeStream(t *testing.T, codec Codec, src []byte) []byte {
+	var wire bytes.Buffer
+	w := newEncodeWriter(&wire, codec)
+	// 分多次写入，其中一次超过 bufSize
+	for _, chunk := range [][]byte{src[:1], src[1 : bufSize+100], src[bufSize+100:]} {
+		if n, err := w.Write(chunk); err != nil || n != len(chunk) {
+			t.Fatalf("write = %d, %v", n, err)
+		}
+	}
+	if wire.Len() != len(src)*codec.Ratio() {
+		t.Fatalf("encoded %d bytes, want %d", wire.Len(), len(src)*codec.Ratio())
+	}
+	return wire.Bytes()
+}
+
+func TestStreamSegmentation(t *testing.T) {
+	codec := streamCodec(t)
+	src := make([]byte, 3*bufSize+7)
+	rand.New(rand.NewSource(1)).Read(src)
+	wire := encodeStream(t, codec, src)
+
+	for name, r := range map[string]io.Reader{
+		"one byte": iotest.OneByteReader(bytes.NewReader(wire)),
+		"half":     iotest.HalfReader(bytes.NewReader(wire)),
+		"random":   &chunkReader{bytes.NewReader(wire), rand.New(rand.NewSource(2))},
+		"data eof": iotest.DataErrReader(bytes.NewReader(wire)),
+	} {
+		got, err := io.ReadAll(newDecodeReader(r, codec))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !bytes.Equal(got, src) {
+			t.Fatalf("%s: decoded %d bytes do not match the %d sent", name, len(got), len(src))
+		}
+	}
+}
+
+func TestStreamTruncated(t *testing.T) {
+	codec := streamCodec(t)
+	wire := encodeStream(t, codec, bytes.Repeat([]byte("sudoku"), bufSize))
+
+	// 流在分组中间结束，之前完整的分组仍然可以读出
+	r := newDecodeReader(iotest.HalfReader(bytes.NewReader(wire[:len(wire)-1])), codec)
+	got, err := io.ReadAll(r)
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("err = %v, want io.ErrUnexpectedEOF", err)
+	}
+	if len(got) != len(wire)/codec.Ratio()-1 {
+		t.Fatalf("read %d bytes before the truncated group, want %d", len(got), len(wire)/codec.Ratio()-1)
+	}
+}
+
+func TestStreamInvalidGroup(t *testing.T) {
+	codec := streamCodec(t)
+	wire := encodeStream(t, codec, bytes.Repeat([]byte("sudoku"), bufSize))
+
+	// 找一个不是码本谜题的分组替换掉中间的一个分组
+	bad := make([]byte, codec.Ratio())
+	for i := 0; ; i++ {
+		for j := range bad {
+			bad[j] = byte(i + j)
+		}
+		if _, err := codec.Decode(make([]byte, 1), bad); err != nil {
+			break
+		}
+	}
+	corrupt := append([]byte(nil), wire...)
+	copy(corrupt[100*codec.Ratio():], bad)
+
+	_, err := io.ReadAll(newDecodeReader(iotest.OneByteReader(bytes.NewReader(corrupt)), codec))
+	if !errors.Is(err, sudoku.ErrBadPuzzle) {
+		t.Fatalf("err = %v, want ErrBadPuzzle", err)
+	}
+}
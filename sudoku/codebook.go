@@ -0,0 +1,218 @@
+package sudoku
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"math/rand"
+	"sync"
+)
+
+// PuzzleSize 每个原始字节编码后的谜题长度
+const PuzzleSize = 6
+
+var ErrBadPuzzle = errors.New("not a codebook puzzle")
+
+// Codebook 预计算的编解码表
+//
+// 编码：字节 -> 该字节对应终盘的全部 4 线索唯一解谜题，已按 SB CODE 打包成 6 字节
+// 解码：打包后的 48 位谜题 -> 字节
+//
+// 编解码都只是查表，不再需要解数独，也不产生内存分配
+//
+// 设置了密钥时，字节对应的终盘由密钥派生，每个终盘也只使用由密钥选出的一半谜题，
+// 不同密钥的部署之间无法互相解码，其他密钥的谜题会被拒绝。
+// 格子的位置不变，编码出的谜题都是合法的数独谜题
+type Codebook struct {
+	sbCode uint8
+	enc    [256][][PuzzleSize]byte
+	dec    map[uint64]byte
+}
+
+var (
+	puzzlesOnce sync.Once
+	gridPuzzles [][][16]int
+
+	codebooksLock sync.Mutex
+	codebooks     = make(map[codebookKey]*Codebook)
+)
+
+type codebookKey struct {
+	sbCode uint8
+	key    string
+}
+
+// 按终盘分组的所有 4 线索唯一解谜题，下标与 solutions() 的顺序一致
+//
+// 4 个线索在所有终盘中只出现一次，就说明它只有唯一解
+func uniquePuzzles() [][][16]int {
+	puzzlesOnce.Do(func() {
+		grids := solutions()
+		clues := comb(16, 4)
+
+		count := make(map[uint64]int, len(grids)*len(clues))
+		for _, grid := range grids {
+			for _, clue := range clues {
+				count[clueKey(grid, clue)]++
+			}
+		}
+
+		gridPuzzles = make([][][16]int, len(grids))
+		for n, grid := range grids {
+			for _, clue := range clues {
+				if count[clueKey(grid, clue)] != 1 {
+					continue
+				}
+				var puzzle [16]int
+				for _, idx := range clue {
+					puzzle[idx] = grid[idx/4][idx%4]
+				}
+				gridPuzzles[n] = append(gridPuzzles[n], puzzle)
+			}
+		}
+	})
+	return gridPuzzles
+}
+
+// 每个格子占 3 位，空格为 0，线索位置和数字一起构成键
+func clueKey(grid [4][4]int, clue []int) (key uint64) {
+	for _, idx := range clue {
+		key |= uint64(grid[idx/4][idx%4]) << (uint(idx) * 3)
+	}
+	return
+}
+
+func packKey(encode []byte) uint64 {
+	_ = encode[5]
+	return uint64(encode[0])<<40 | uint64(encode[1])<<32 | uint64(encode[2])<<24 |
+		uint64(encode[3])<<16 | uint64(encode[4])<<8 | uint64(encode[5])
+}
+
+// 新建一个码本
+//
+// 密钥为空时第 n 个终盘对应字节 n，使用终盘的全部谜题；
+// 否则由密钥派生出 288 个终盘的排列（取前 256 个），以及每个选中终盘的谜题的排列，
+// 只有排列中的前一半谜题是合法的编码，每个终盘至少有 12 个谜题，保留至少 6 个
+func NewCodebook(sbCode uint8, key string) *Codebook {
+	puzzles := uniquePuzzles()
+	grids := identity(len(puzzles))
+	var ks *keyStream
+	if key != "" {
+		ks = newKeyStream(key)
+		ks.shuffle(grids)
+	}
+
+	cb := &Codebook{
+		sbCode: sbCode,
+		dec:    make(map[uint64]byte),
+	}
+	for b := 0; b < 256; b++ {
+		order := identity(len(puzzles[grids[b]]))
+		if ks != nil {
+			ks.shuffle(order)
+			order = order[:(len(order)+1)/2]
+		}
+		variants := make([][PuzzleSize]byte, len(order))
+		for i, n := range order {
+			variants[i] = FlattenSudoTo6Bytes(puzzles[grids[b]][n], sbCode)
+			cb.dec[packKey(variants[i][:])] = byte(b)
+		}
+		cb.enc[b] = variants
+	}
+	return cb
+}
+
+// 获取共享的码本，同一个 SB CODE 和密钥只构建一次
+func DefaultCodebook(sbCode uint8, key string) *Codebook {
+	codebooksLock.Lock()
+	defer codebooksLock.Unlock()
+	cb, ok := codebooks[codebookKey{sbCode, key}]
+	if !ok {
+		cb = NewCodebook(sbCode, key)
+		codebooks[codebookKey{sbCode, key}] = cb
+	}
+	return cb
+}
+
+func identity(n int) []int {
+	perm := make([]int, n)
+	for i := range perm {
+		perm[i] = i
+	}
+	return perm
+}
+
+// 由密钥派生的确定性伪随机流：HMAC-SHA256(key, counter)
+type keyStream struct {
+	mac     []byte
+	key     []byte
+	counter uint64
+	buf     []byte
+}
+
+func newKeyStream(key string) *keyStream {
+	return &keyStream{key: []byte(key)}
+}
+
+func (ks *keyStream) uint32() uint32 {
+	if len(ks.buf) < 4 {
+		h := hmac.New(sha256.New, ks.key)
+		var counter [8]byte
+		binary.BigEndian.PutUint64(counter[:], ks.counter)
+		h.Write([]byte("sudoku codebook"))
+		h.Write(counter[:])
+		ks.mac = h.Sum(ks.mac[:0])
+		ks.buf = ks.mac
+		ks.counter++
+	}
+	v := binary.BigEndian.Uint32(ks.buf)
+	ks.buf = ks.buf[4:]
+	return v
+}
+
+// [0, n) 上的均匀随机数，拒绝采样避免取模偏差
+func (ks *keyStream) intn(n int) int {
+	limit := ^uint32(0) - ^uint32(0)%uint32(n)
+	for {
+		if v := ks.uint32(); v < limit {
+			return int(v % uint32(n))
+		}
+	}
+}
+
+// Fisher-Yates 洗牌
+func (ks *keyStream) shuffle(perm []int) {
+	for i := len(perm) - 1; i > 0; i-- {
+		j := ks.intn(i + 1)
+		perm[i], perm[j] = perm[j], perm[i]
+	}
+}
+
+func (cb *Codebook) SBCode() uint8 {
+	return cb.sbCode
+}
+
+// 把 src 中的每个字节随机编码为一个谜题写入 dst
+// dst 的长度至少为 len(src)*PuzzleSize，返回写入的字节数
+func (cb *Codebook) Encode(dst, src []byte) int {
+	for i, b := range src {
+		variants := cb.enc[b]
+		copy(dst[i*PuzzleSize:], variants[rand.Intn(len(variants))][:])
+	}
+	return len(src) * PuzzleSize
+}
+
+// 把 src 中完整的谜题解码后写入 dst，末尾不足一个谜题的部分会被忽略
+// dst 的长度至少为 len(src)/PuzzleSize，返回写入的字节数
+func (cb *Codebook) Decode(dst, src []byte) (int, error) {
+	n := len(src) / PuzzleSize
+	for i := 0; i < n; i++ {
+		b, ok := cb.dec[packKey(src[i*PuzzleSize:])]
+		if !ok {
+			return i, ErrBadPuzzle
+		}
+		dst[i] = b
+	}
+	return n, nil
+}
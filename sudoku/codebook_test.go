@@ -0,0 +1,228 @@
+package sudoku
+
+import (
+	"math/rand"
+	"strconv"
+	"testing"
+)
+
+// 码本之前的编解码路径：字符串键的全局表，编码时逐位 Atoi，解码时拼接字符串查表再解数独
+type legacyCodec struct {
+	sbCode   uint8
+	byteList [256][]string
+	allPuzz  map[string]int
+	strByte  map[string]int
+}
+
+func newLegacyCodec(sbCode uint8) *legacyCodec {
+	legacy := &legacyCodec{
+		sbCode:  sbCode,
+		allPuzz: make(map[string]int),
+		strByte: make(map[string]int),
+	}
+	grids := solutions()
+	for b, puzzles := range uniquePuzzles()[:256] {
+		solution := ""
+		for _, row := range grids[b] {
+			for _, v := range row {
+				solution += strconv.Itoa(v)
+			}
+		}
+		legacy.strByte[solution] = b
+		for _, puzzle := range puzzles {
+			s := ""
+			for _, v := range puzzle {
+				s += strconv.Itoa(v)
+			}
+			legacy.byteList[b] = append(legacy.byteList[b], s)
+			legacy.allPuzz[s] = b
+		}
+	}
+	return legacy
+}
+
+func (legacy *legacyCodec) encode(bs []byte) []byte {
+	buf := make([]byte, 0, len(bs)*PuzzleSize)
+	for _, b := range bs {
+		s := legacy.byteList[b][rand.Intn(len(legacy.byteList[b]))]
+		var puzzle [16]int
+		for i := 0; i < 16; i++ {
+			puzzle[i], _ = strconv.Atoi(string(s[i]))
+		}
+		packed := FlattenSudoTo6Bytes(puzzle, legacy.sbCode)
+		buf = append(buf, packed[:]...)
+	}
+	return buf
+}
+
+func (legacy *legacyCodec) decode(src []byte) (bs []byte) {
+	for i := 0; i+PuzzleSize <= len(src); i += PuzzleSize {
+		puzzle := UnflattenSudoFrom6Bytes([6]byte(src[i:i+PuzzleSize]), legacy.sbCode)
+		s := ""
+		for _, v := range puzzle {
+			s += strconv.Itoa(v)
+		}
+		if _, ok := legacy.allPuzz[s]; !ok {
+			return nil
+		}
+		var board [4][4]int
+		for j := 0; j < 16; j++ {
+			board[j/4][j%4] = puzzle[j]
+		}
+		solution, _ := SolveSudoku(board)
+		key := ""
+		for _, row := range solution {
+			for _, v := range row {
+				key += strconv.Itoa(v)
+			}
+		}
+		bs = append(bs, byte(legacy.strByte[key]))
+	}
+	return
+}
+
+func benchmarkInput() []byte {
+	src := make([]byte, 4096)
+	rand.New(rand.NewSource(1)).Read(src)
+	return src
+}
+
+func TestLegacyCodecMatches(t *testing.T) {
+	cb := NewCodebook(0x00, "")
+	legacy := newLegacyCodec(0x00)
+	src := benchmarkInput()
+	dst := make([]byte, len(src))
+
+	n, err := cb.Decode(dst, legacy.encode(src))
+	if err != nil || string(dst[:n]) != string(src) {
+		t.Fatalf("codebook failed to decode legacy encoding: %v", err)
+	}
+	encoded := make([]byte, len(src)*PuzzleSize)
+	cb.Encode(encoded, src)
+	if got := legacy.decode(encoded); string(got) != string(src) {
+		t.Fatal("legacy path failed to decode codebook encoding")
+	}
+}
+
+func TestCodebookKeys(t *testing.T) {
+	alice := NewCodebook(0x00, "alice")
+	bob := NewCodebook(0x00, "bob")
+	src := benchmarkInput()
+	aliceWire := make([]byte, len(src)*PuzzleSize)
+	alice.Encode(aliceWire, src)
+	decoded := make([]byte, len(src))
+
+	if n, err := alice.Decode(decoded, aliceWire); err != nil || string(decoded[:n]) != string(src) {
+		t.Fatalf("round trip with the same key: %v", err)
+	}
+	// 换了密钥之后要么拒绝谜题，要么解出不同的字节
+	if n, err := bob.Decode(decoded, aliceWire); err == nil && string(decoded[:n]) == string(src) {
+		t.Fatal("another key decoded the traffic")
+	}
+
+	// 相同的输入在两个密钥下没有相同的谜题
+	bobWire := make([]byte, len(src)*PuzzleSize)
+	bob.Encode(bobWire, src)
+	same := 0
+	for i := 0; i < len(src); i++ {
+		if string(aliceWire[i*PuzzleSize:(i+1)*PuzzleSize]) == string(bobWire[i*PuzzleSize:(i+1)*PuzzleSize]) {
+			same++
+		}
+	}
+	if same > len(src)/100 {
+		t.Fatalf("%d of %d groups are the same under two keys", same, len(src))
+	}
+
+	// 每个选中的终盘只有一半谜题是合法的编码，其他谜题被拒绝
+	// 所有合法的编码都来自唯一解谜题，仍然是合法的数独谜题
+	unused, total := 0, 0
+	for n, puzzles := range uniquePuzzles() {
+		accepted := 0
+		for _, puzzle := range puzzles {
+			packed := FlattenSudoTo6Bytes(puzzle, 0x00)
+			if _, ok := alice.dec[packKey(packed[:])]; ok {
+				accepted++
+			}
+		}
+		total += accepted
+		switch accepted {
+		case 0:
+			unused++
+		case (len(puzzles) + 1) / 2:
+		default:
+			t.Fatalf("grid %d: %d of %d puzzles accepted", n, accepted, len(puzzles))
+		}
+	}
+	if unused != len(uniquePuzzles())-256 {
+		t.Fatalf("%d grids unused, want %d", unused, len(uniquePuzzles())-256)
+	}
+	if total != len(alice.dec) {
+		t.Fatalf("%d of %d codes are unique puzzles", total, len(alice.dec))
+	}
+}
+
+func TestCodebookEncodeDecodeNoAllocs(t *testing.T) {
+	cb := NewCodebook(0x00, "key")
+	src := benchmarkInput()
+	encoded := make([]byte, len(src)*PuzzleSize)
+	decoded := make([]byte, len(src))
+	allocs := testing.AllocsPerRun(10, func() {
+		cb.Encode(encoded, src)
+		if _, err := cb.Decode(decoded, encoded); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if allocs != 0 {
+		t.Fatalf("encode and decode allocated %v times", allocs)
+	}
+}
+
+func BenchmarkEncode(b *testing.B) {
+	src := benchmarkInput()
+	b.Run("codebook", func(b *testing.B) {
+		cb := NewCodebook(0x00, "")
+		dst := make([]byte, len(src)*PuzzleSize)
+		b.SetBytes(int64(len(src)))
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			cb.Encode(dst, src)
+		}
+	})
+	b.Run("legacy", func(b *testing.B) {
+		legacy := newLegacyCodec(0x00)
+		b.SetBytes(int64(len(src)))
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			legacy.encode(src)
+		}
+	})
+}
+
+func BenchmarkDecode(b *testing.B) {
+	src := benchmarkInput()
+	cb := NewCodebook(0x00, "")
+	encoded := make([]byte, len(src)*PuzzleSize)
+	cb.Encode(encoded, src)
+	b.Run("codebook", func(b *testing.B) {
+		dst := make([]byte, len(src))
+		b.SetBytes(int64(len(src)))
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if _, err := cb.Decode(dst, encoded); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("legacy", func(b *testing.B) {
+		legacy := newLegacyCodec(0x00)
+		b.SetBytes(int64(len(src)))
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			legacy.decode(encoded)
+		}
+	})
+}
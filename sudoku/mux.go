@@ -0,0 +1,108 @@
+package sudoku
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// tunnel command, 此后连接上承载的是多路复用帧
+const (
+	CmdMux = 0x7f
+	// 反向隧道，服务端在请求的地址上监听，为每个接受的连接打开一个流，
+	// 流上的隧道请求中的地址为连接的来源，客户端连接本地目标后返回响应
+	CmdReverse = 0x7e
+)
+
+// frame type
+const (
+	// 打开一个流，负载为空
+	FrameOpen = 0x01
+	// 流上的数据
+	FrameData = 0x02
+	// 关闭一个流，此后双方都不再在这个流上发送数据
+	FrameClose = 0x03
+	// 增加对端的发送窗口，负载为 4 字节的增量
+	FrameWindow = 0x04
+	// 关闭流的发送方向，负载为空，对端读完已收到的数据后读到 EOF，另一个方向不受影响
+	FrameFin = 0x05
+)
+
+const (
+	FrameHeaderSize     = 7
+	MaxFramePayload     = 8192
+	InitialStreamWindow = 256 * 1024
+)
+
+var ErrFrameTooLarge = errors.New("frame too large")
+
+// Frame is a multiplexing frame carried inside the tunnel after a CmdMux TunnelRequest.
+// Each stream starts with a TunnelRequest/TunnelResponse exchange, just like a plain tunnel.
+//
+// Protocol spec:
+//
+// +------+-----------+--------+---------+
+// | TYPE | STREAM ID | LENGTH | PAYLOAD |
+// +------+-----------+--------+---------+
+// | 1    | 4         | 2      | LENGTH  |
+// +------+-----------+--------+---------+
+//
+// TYPE - frame type, 1 byte.
+// STREAM ID - stream id, 4 bytes. 客户端打开的流为奇数，服务端打开的流为偶数.
+// LENGTH - payload length, 2 bytes, at most MaxFramePayload.
+// PAYLOAD - frame payload, variable length.
+//
+// 每个流有独立的接收窗口，初始为 InitialStreamWindow。发送方发送的数据不能超过窗口，
+// 接收方读走数据后用 FrameWindow 归还窗口，慢速的流不会阻塞其它流。
+
+type Frame struct {
+	Type     uint8
+	StreamID uint32
+	Payload  []byte
+}
+
+// 读取一帧，Payload 的容量足够时复用它存放负载
+func (frame *Frame) ReadFrom(r io.Reader) (n int64, err error) {
+	var header [FrameHeaderSize]byte
+	nn, err := io.ReadFull(r, header[:])
+	n += int64(nn)
+	if err != nil {
+		return
+	}
+	frame.Type = header[0]
+	frame.StreamID = binary.BigEndian.Uint32(header[1:5])
+	length := int(binary.BigEndian.Uint16(header[5:7]))
+	if length > MaxFramePayload {
+		err = ErrFrameTooLarge
+		return
+	}
+	if cap(frame.Payload) < length {
+		frame.Payload = make([]byte, length, MaxFramePayload)
+	}
+	frame.Payload = frame.Payload[:length]
+	nn, err = io.ReadFull(r, frame.Payload)
+	n += int64(nn)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return
+}
+
+// 把一帧完整的写入 w，头部和负载在一次 Write 中写出
+func (frame *Frame) WriteTo(w io.Writer) (n int64, err error) {
+	if len(frame.Payload) > MaxFramePayload {
+		err = ErrFrameTooLarge
+		return
+	}
+	nn, err := w.Write(frame.Bytes())
+	return int64(nn), err
+}
+
+func (frame *Frame) Bytes() []byte {
+	buf := make([]byte, FrameHeaderSize+len(frame.Payload))
+	buf[0] = frame.Type
+	binary.BigEndian.PutUint32(buf[1:5], frame.StreamID)
+	binary.BigEndian.PutUint16(buf[5:7], uint16(len(frame.Payload)))
+	copy(buf[FrameHeaderSize:], frame.Payload)
+	return buf
+}
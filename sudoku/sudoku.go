@@ -5,11 +5,12 @@ import (
 	"encoding/binary"
 	"errors"
 	"io"
-	"log"
 )
 
 const (
 	Version1 = 0x01
+	// 携带用户认证信息的握手
+	Version2 = 0x02
 )
 
 // response status list
@@ -24,6 +25,7 @@ const (
 	StatusNetworkUnreachable  = 0x07
 	StatusInternalServerError = 0x08
 	NotUnique                 = 0x09
+	StatusConnectionRefused   = 0x0a
 )
 
 const (
@@ -31,6 +33,15 @@ const (
 	ObfPort   = 80
 )
 
+// SB CODE 的最高位，置位表示启用 AEAD，请求和响应末尾各附带一个随机数
+const (
+	CodeAEAD  = 0x80
+	NonceSize = 16
+)
+
+// 认证信息中 HMAC-SHA256 的长度
+const MACSize = 32
+
 var (
 	ErrBadVersion = errors.New("bad version")
 	ErrNotUnique  = "not unique"
@@ -48,10 +59,26 @@ var (
 //
 // TLS OBF - TLS obfuscation, 3 bytes.
 // VER - protocol version, 1 byte.
-// SB CODE - sudoku code, 1 byte.
+// SB CODE - sudoku code, 1 byte. 客户端提议使用的编码器.
 // OBF LEN - obfuscated address length, 1 byte.
 // OBF PORT - obfuscated port, 2 bytes.
 // OBF ADDR - obfuscated address, variable length.
+//
+// SB CODE 置位 CodeAEAD 时，OBF ADDR 之后紧跟 NonceSize 字节的客户端随机数。
+//
+// VER 为 Version2 时总是携带随机数，随后是用户认证信息:
+//
+// +-------+---------+-----+-----------+------+
+// | NONCE | UID LEN | UID | TIMESTAMP | HMAC |
+// +-------+---------+-----+-----------+------+
+// | 16    | 1       | VAR | 8         | 32   |
+// +-------+---------+-----+-----------+------+
+//
+// NONCE - client nonce, 16 bytes. 同时用于 AEAD 密钥派生和防重放.
+// UID LEN - user id length, 1 byte.
+// UID - user id, variable length.
+// TIMESTAMP - unix time in seconds, 8 bytes.
+// HMAC - HMAC-SHA256 over all preceding bytes, keyed by the user's secret, 32 bytes.
 
 type Request struct {
 	TlsObf  [3]byte
@@ -60,6 +87,12 @@ type Request struct {
 	ObfLen  uint8
 	ObfPort uint16
 	ObfAddr []byte
+	Nonce   []byte
+
+	// Version2 的认证信息
+	UserID    []byte
+	Timestamp int64
+	MAC       []byte
 }
 
 // default Request
@@ -82,7 +115,7 @@ func (req *Request) ReadFrom(r io.Reader) (n int64, err error) {
 	// 保存前三个字节到 TlsObf
 	copy(req.TlsObf[:], header[0:3])
 	req.Version = header[3]
-	if req.Version != Version1 {
+	if req.Version != Version1 && req.Version != Version2 {
 		err = ErrBadVersion
 		return
 	}
@@ -95,32 +128,70 @@ func (req *Request) ReadFrom(r io.Reader) (n int64, err error) {
 	if err != nil {
 		return
 	}
-	// 读完之后打log
-	log.Printf("sudoku request: %v", req.Bytes())
+	if req.Code&CodeAEAD != 0 || req.Version == Version2 {
+		req.Nonce = make([]byte, NonceSize)
+		nn, err = io.ReadFull(r, req.Nonce)
+		n += int64(nn)
+		if err != nil {
+			return
+		}
+	}
+	if req.Version == Version2 {
+		var uidLen [1]byte
+		nn, err = io.ReadFull(r, uidLen[:])
+		n += int64(nn)
+		if err != nil {
+			return
+		}
+		auth := make([]byte, int(uidLen[0])+8+MACSize)
+		nn, err = io.ReadFull(r, auth)
+		n += int64(nn)
+		if err != nil {
+			return
+		}
+		req.UserID = auth[:uidLen[0]]
+		req.Timestamp = int64(binary.BigEndian.Uint64(auth[uidLen[0]:]))
+		req.MAC = auth[int(uidLen[0])+8:]
+	}
 	return
 }
 
-func (req *Request) WriteTo(w io.Writer) (n int64, err error) {
-	var buf bytes.Buffer
-
-	buf.Write(req.TlsObf[:])
-	buf.WriteByte(req.Version)
-	buf.WriteByte(req.Code)
-	buf.WriteByte(req.ObfLen)
-	binary.Write(&buf, binary.BigEndian, req.ObfPort)
-	buf.Write(req.ObfAddr)
+// HMAC 覆盖的部分，即去掉末尾 HMAC 的请求
+func (req *Request) AuthBytes() []byte {
+	buf := req.Bytes()
+	if req.Version != Version2 {
+		return buf
+	}
+	return buf[:len(buf)-MACSize]
+}
 
-	return buf.WriteTo(w)
+func (req *Request) WriteTo(w io.Writer) (n int64, err error) {
+	nn, err := w.Write(req.Bytes())
+	return int64(nn), err
 }
 
 func (r *Request) Bytes() []byte {
-	buf := make([]byte, 8+len(r.ObfAddr))
+	size := 8 + len(r.ObfAddr) + len(r.Nonce)
+	if r.Version == Version2 {
+		size += 1 + len(r.UserID) + 8 + MACSize
+	}
+	buf := make([]byte, 8, size)
 	copy(buf[0:3], r.TlsObf[:])
 	buf[3] = r.Version
 	buf[4] = r.Code
 	buf[5] = r.ObfLen
 	binary.BigEndian.PutUint16(buf[6:8], r.ObfPort)
-	copy(buf[8:], r.ObfAddr)
+	buf = append(buf, r.ObfAddr...)
+	buf = append(buf, r.Nonce...)
+	if r.Version == Version2 {
+		buf = append(buf, byte(len(r.UserID)))
+		buf = append(buf, r.UserID...)
+		buf = binary.BigEndian.AppendUint64(buf, uint64(r.Timestamp))
+		// 签名之前 MAC 为空，以零填充
+		mac := make([]byte, MACSize)
+		copy(mac, r.MAC)
+		buf = append(buf, mac...)
+	}
 	return buf
 }
 
@@ -135,15 +206,18 @@ func (r *Request) Bytes() []byte {
 // +---------+-----+------+---------+
 //
 // TLS OBF - TLS obfuscation, 3 bytes.
-// VER - protocol version, 1 byte.
+// VER - protocol version, 1 byte. 与请求的版本一致.
 // STAT - status code, 1 byte.
-// SB CODE - sudoku code, 1 byte.
+// SB CODE - sudoku code, 1 byte. 服务端最终选定的编码器.
+//
+// SB CODE 置位 CodeAEAD 时，末尾紧跟 NonceSize 字节的服务端随机数。
 
 type Response struct {
 	TlsObf  [3]byte
 	Version uint8
 	Status  uint8
 	Code    uint8
+	Nonce   []byte
 }
 
 func (resp *Response) ReadFrom(r io.Reader) (n int64, err error) {
@@ -156,16 +230,21 @@ func (resp *Response) ReadFrom(r io.Reader) (n int64, err error) {
 	// 保存前三个字节到 TlsObf
 	copy(resp.TlsObf[:], header[0:3])
 
-	if header[3] != Version1 {
+	if header[3] != Version1 && header[3] != Version2 {
 		err = ErrBadVersion
 		return
 	}
 	resp.Version = header[3]
 	resp.Status = header[4]
 	resp.Code = header[5]
-
-	// 读完之后打log
-	log.Printf("sudoku response: %v", resp.Bytes())
+	if resp.Code&CodeAEAD != 0 {
+		resp.Nonce = make([]byte, NonceSize)
+		nn, err = io.ReadFull(r, resp.Nonce)
+		n += int64(nn)
+		if err != nil {
+			return
+		}
+	}
 
 	return
 }
@@ -177,15 +256,17 @@ func (resp *Response) WriteTo(w io.Writer) (n int64, err error) {
 	buf.WriteByte(resp.Version)
 	buf.WriteByte(resp.Status)
 	buf.WriteByte(resp.Code)
+	buf.Write(resp.Nonce)
 
 	return buf.WriteTo(w)
 }
 
 func (r *Response) Bytes() []byte {
-	buf := make([]byte, 6)
+	buf := make([]byte, 6+len(r.Nonce))
 	copy(buf[0:3], r.TlsObf[:])
 	buf[3] = r.Version
 	buf[4] = r.Status
 	buf[5] = r.Code
+	copy(buf[6:], r.Nonce)
 	return buf
 }
@@ -0,0 +1,370 @@
+package sudoku
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// TLS record content type
+const (
+	RecordChangeCipherSpec = 0x14
+	RecordAlert            = 0x15
+	RecordHandshake        = 0x16
+	RecordApplicationData  = 0x17
+)
+
+const (
+	// TLS 记录负载的最大长度
+	MaxRecordPayload = 16384
+	RecordHeaderSize = 5
+
+	// X25519MLKEM768 key_share 的长度，用于承载 sudoku 请求
+	HybridShareSize = 1216
+	X25519ShareSize = 32
+)
+
+// TLS 握手模式下 ClientHello 记录的前三个字节，普通握手的 TlsObf 为 {0x16, 0x03, 0x03}
+var ClientHelloPrefix = [3]byte{RecordHandshake, 0x03, 0x01}
+
+var ErrBadHello = errors.New("bad tls hello")
+
+const (
+	handshakeClientHello = 0x01
+	handshakeServerHello = 0x02
+
+	groupX25519         = 0x001d
+	groupX25519MLKEM768 = 0x11ec
+
+	extServerName          = 0x0000
+	extStatusRequest       = 0x0005
+	extSupportedGroups     = 0x000a
+	extECPointFormats      = 0x000b
+	extSignatureAlgorithms = 0x000d
+	extALPN                = 0x0010
+	extSCT                 = 0x0012
+	extExtendedMasterSec   = 0x0017
+	extCompressCert        = 0x001b
+	extSessionTicket       = 0x0023
+	extSupportedVersions   = 0x002b
+	extPSKModes            = 0x002d
+	extKeyShare            = 0x0033
+	extRenegotiationInfo   = 0xff01
+)
+
+// ClientHello is a TLS 1.3 ClientHello in a single handshake record, shaped like a browser's.
+// TLS 握手模式下 sudoku 请求被掩盖后放在 X25519MLKEM768 的 key_share 里，
+// 其它字段都是普通浏览器会发送的值，SNI 为 OBF ADDR。
+//
+// Protocol spec:
+//
+// +-------------+---------+---------+----------+------------+
+// | RECORD TYPE | VERSION | LENGTH  | HS TYPE  | HS LENGTH  |
+// +-------------+---------+---------+----------+------------+
+// | 1 (0x16)    | 2       | 2       | 1 (0x01) | 3          |
+// +-------------+---------+---------+----------+------------+
+//
+// 随后是 RFC 8446 4.1.2 中的 ClientHello 结构:
+// legacy_version, random, legacy_session_id, cipher_suites,
+// legacy_compression_methods, extensions.
+
+type ClientHello struct {
+	Random     [32]byte
+	SessionID  []byte
+	ServerName string
+	// X25519MLKEM768 的 key_share，长度为 HybridShareSize
+	HybridShare []byte
+	// X25519 的 key_share，长度为 X25519ShareSize
+	X25519Share []byte
+}
+
+func (hello *ClientHello) WriteTo(w io.Writer) (n int64, err error) {
+	if len(hello.HybridShare) != HybridShareSize || len(hello.X25519Share) != X25519ShareSize ||
+		len(hello.SessionID) > 32 || len(hello.ServerName) > 255 {
+		err = ErrBadHello
+		return
+	}
+	grease := greaseValue()
+
+	var exts bytes.Buffer
+	writeExt(&exts, grease, nil)
+	sni := binary.BigEndian.AppendUint16(nil, uint16(len(hello.ServerName)+3))
+	sni = append(sni, 0x00)
+	sni = binary.BigEndian.AppendUint16(sni, uint16(len(hello.ServerName)))
+	writeExt(&exts, extServerName, append(sni, hello.ServerName...))
+	writeExt(&exts, extExtendedMasterSec, nil)
+	writeExt(&exts, extRenegotiationInfo, []byte{0x00})
+	writeExt(&exts, extSupportedGroups, u16List(grease, groupX25519MLKEM768, groupX25519, 0x0017, 0x0018))
+	writeExt(&exts, extECPointFormats, []byte{0x01, 0x00})
+	writeExt(&exts, extSessionTicket, nil)
+	writeExt(&exts, extALPN, []byte{0x00, 0x0c, 0x02, 'h', '2', 0x08, 'h', 't', 't', 'p', '/', '1', '.', '1'})
+	writeExt(&exts, extStatusRequest, []byte{0x01, 0x00, 0x00, 0x00, 0x00})
+	writeExt(&exts, extSignatureAlgorithms, u16List(0x0403, 0x0804, 0x0401, 0x0503, 0x0805, 0x0501, 0x0806, 0x0601))
+	writeExt(&exts, extSCT, nil)
+	var shares []byte
+	shares = binary.BigEndian.AppendUint16(shares, grease)
+	shares = append(shares, 0x00, 0x01, 0x00)
+	shares = binary.BigEndian.AppendUint16(shares, groupX25519MLKEM768)
+	shares = binary.BigEndian.AppendUint16(shares, HybridShareSize)
+	shares = append(shares, hello.HybridShare...)
+	shares = binary.BigEndian.AppendUint16(shares, groupX25519)
+	shares = binary.BigEndian.AppendUint16(shares, X25519ShareSize)
+	shares = append(shares, hello.X25519Share...)
+	writeExt(&exts, extKeyShare, append(binary.BigEndian.AppendUint16(nil, uint16(len(shares))), shares...))
+	writeExt(&exts, extPSKModes, []byte{0x01, 0x01})
+	writeExt(&exts, extSupportedVersions, []byte{0x06, byte(grease >> 8), byte(grease), 0x03, 0x04, 0x03, 0x03})
+	writeExt(&exts, extCompressCert, []byte{0x02, 0x00, 0x02})
+	writeExt(&exts, greaseValue(), []byte{0x00})
+
+	var body bytes.Buffer
+	body.Write([]byte{0x03, 0x03})
+	body.Write(hello.Random[:])
+	body.WriteByte(byte(len(hello.SessionID)))
+	body.Write(hello.SessionID)
+	suites := u16List(grease, 0x1301, 0x1302, 0x1303, 0xc02b, 0xc02f, 0xc02c, 0xc030, 0xcca9, 0xcca8, 0xc013, 0xc014, 0x009c, 0x009d, 0x002f, 0x0035)
+	body.Write(suites)
+	body.Write([]byte{0x01, 0x00})
+	binary.Write(&body, binary.BigEndian, uint16(exts.Len()))
+	body.Write(exts.Bytes())
+
+	return writeHandshakeRecord(w, ClientHelloPrefix[1:], handshakeClientHello, body.Bytes())
+}
+
+// 读取一个完整的 ClientHello 记录，只解析 SNI 和 key_share
+func (hello *ClientHello) ReadFrom(r io.Reader) (n int64, err error) {
+	body, n, err := readHandshakeRecord(r, handshakeClientHello)
+	if err != nil {
+		return
+	}
+	p := &helloParser{buf: body}
+	p.skip(2)
+	copy(hello.Random[:], p.next(32))
+	hello.SessionID = p.next(int(p.u8()))
+	p.skip(int(p.u16()))
+	p.skip(int(p.u8()))
+	exts := &helloParser{buf: p.next(int(p.u16()))}
+	if p.err != nil {
+		err = p.err
+		return
+	}
+	for len(exts.buf) > 0 && exts.err == nil {
+		extType := exts.u16()
+		ext := &helloParser{buf: exts.next(int(exts.u16()))}
+		switch extType {
+		case extServerName:
+			ext.skip(3)
+			hello.ServerName = string(ext.next(int(ext.u16())))
+		case extKeyShare:
+			shares := &helloParser{buf: ext.next(int(ext.u16()))}
+			for len(shares.buf) > 0 && shares.err == nil {
+				group := shares.u16()
+				share := shares.next(int(shares.u16()))
+				switch group {
+				case groupX25519MLKEM768:
+					hello.HybridShare = share
+				case groupX25519:
+					hello.X25519Share = share
+				}
+			}
+			if shares.err != nil {
+				ext.err = shares.err
+			}
+		}
+		if ext.err != nil {
+			exts.err = ext.err
+		}
+	}
+	if exts.err != nil {
+		err = exts.err
+		return
+	}
+	if len(hello.HybridShare) != HybridShareSize {
+		err = ErrBadHello
+	}
+	return
+}
+
+// ServerHello is a TLS 1.3 ServerHello followed by a ChangeCipherSpec record.
+// sudoku 响应被掩盖后放在 X25519 的 key_share 里。
+//
+// Protocol spec:
+//
+// +-------------+---------+---------+----------+------------+
+// | RECORD TYPE | VERSION | LENGTH  | HS TYPE  | HS LENGTH  |
+// +-------------+---------+---------+----------+------------+
+// | 1 (0x16)    | 2       | 2       | 1 (0x02) | 3          |
+// +-------------+---------+---------+----------+------------+
+//
+// 随后是 RFC 8446 4.1.3 中的 ServerHello 结构，选择 TLS_AES_128_GCM_SHA256，
+// 扩展只有 supported_versions 和 key_share。
+// 此后双方的数据都放在 application_data 记录里。
+
+type ServerHello struct {
+	Random    [32]byte
+	SessionID []byte
+	// X25519 的 key_share，长度为 X25519ShareSize
+	KeyShare []byte
+}
+
+// ServerHello 和 ChangeCipherSpec 在一次 Write 中写出
+func (hello *ServerHello) WriteTo(w io.Writer) (n int64, err error) {
+	if len(hello.KeyShare) != X25519ShareSize || len(hello.SessionID) > 32 {
+		err = ErrBadHello
+		return
+	}
+	var exts bytes.Buffer
+	writeExt(&exts, extSupportedVersions, []byte{0x03, 0x04})
+	share := binary.BigEndian.AppendUint16(nil, groupX25519)
+	share = binary.BigEndian.AppendUint16(share, X25519ShareSize)
+	writeExt(&exts, extKeyShare, append(share, hello.KeyShare...))
+
+	var body bytes.Buffer
+	body.Write([]byte{0x03, 0x03})
+	body.Write(hello.Random[:])
+	body.WriteByte(byte(len(hello.SessionID)))
+	body.Write(hello.SessionID)
+	body.Write([]byte{0x13, 0x01, 0x00})
+	binary.Write(&body, binary.BigEndian, uint16(exts.Len()))
+	body.Write(exts.Bytes())
+
+	var buf bytes.Buffer
+	writeHandshakeRecord(&buf, []byte{0x03, 0x03}, handshakeServerHello, body.Bytes())
+	buf.Write([]byte{RecordChangeCipherSpec, 0x03, 0x03, 0x00, 0x01, 0x01})
+	return buf.WriteTo(w)
+}
+
+// 读取 ServerHello 记录，之后的 ChangeCipherSpec 由记录层跳过
+func (hello *ServerHello) ReadFrom(r io.Reader) (n int64, err error) {
+	body, n, err := readHandshakeRecord(r, handshakeServerHello)
+	if err != nil {
+		return
+	}
+	p := &helloParser{buf: body}
+	p.skip(2)
+	copy(hello.Random[:], p.next(32))
+	hello.SessionID = p.next(int(p.u8()))
+	p.skip(3)
+	exts := &helloParser{buf: p.next(int(p.u16()))}
+	if p.err != nil {
+		err = p.err
+		return
+	}
+	for len(exts.buf) > 0 && exts.err == nil {
+		extType := exts.u16()
+		ext := &helloParser{buf: exts.next(int(exts.u16()))}
+		if extType == extKeyShare {
+			ext.skip(2)
+			hello.KeyShare = ext.next(int(ext.u16()))
+		}
+		if ext.err != nil {
+			exts.err = ext.err
+		}
+	}
+	if exts.err != nil {
+		err = exts.err
+		return
+	}
+	if len(hello.KeyShare) != X25519ShareSize {
+		err = ErrBadHello
+	}
+	return
+}
+
+func writeHandshakeRecord(w io.Writer, version []byte, hsType uint8, body []byte) (int64, error) {
+	buf := make([]byte, 0, RecordHeaderSize+4+len(body))
+	buf = append(buf, RecordHandshake)
+	buf = append(buf, version...)
+	buf = binary.BigEndian.AppendUint16(buf, uint16(4+len(body)))
+	buf = append(buf, hsType, byte(len(body)>>16), byte(len(body)>>8), byte(len(body)))
+	buf = append(buf, body...)
+	nn, err := w.Write(buf)
+	return int64(nn), err
+}
+
+func readHandshakeRecord(r io.Reader, hsType uint8) (body []byte, n int64, err error) {
+	var header [RecordHeaderSize]byte
+	nn, err := io.ReadFull(r, header[:])
+	n += int64(nn)
+	if err != nil {
+		return
+	}
+	length := int(binary.BigEndian.Uint16(header[3:5]))
+	if header[0] != RecordHandshake || header[1] != 0x03 || length > MaxRecordPayload || length < 4 {
+		err = ErrBadHello
+		return
+	}
+	record := make([]byte, length)
+	nn, err = io.ReadFull(r, record)
+	n += int64(nn)
+	if err != nil {
+		return
+	}
+	hsLength := int(record[1])<<16 | int(record[2])<<8 | int(record[3])
+	if record[0] != hsType || hsLength != length-4 {
+		err = ErrBadHello
+		return
+	}
+	body = record[4:]
+	return
+}
+
+func writeExt(buf *bytes.Buffer, extType uint16, data []byte) {
+	binary.Write(buf, binary.BigEndian, extType)
+	binary.Write(buf, binary.BigEndian, uint16(len(data)))
+	buf.Write(data)
+}
+
+// 带长度前缀的 uint16 列表
+func u16List(values ...uint16) []byte {
+	buf := binary.BigEndian.AppendUint16(nil, uint16(2*len(values)))
+	for _, value := range values {
+		buf = binary.BigEndian.AppendUint16(buf, value)
+	}
+	return buf
+}
+
+// RFC 8701 GREASE 值
+func greaseValue() uint16 {
+	var b [1]byte
+	rand.Read(b[:])
+	v := uint16(b[0]&0xf0 | 0x0a)
+	return v<<8 | v
+}
+
+// 按顺序读取握手消息的字段，越界时记录错误并返回空值
+type helloParser struct {
+	buf []byte
+	err error
+}
+
+func (p *helloParser) next(size int) []byte {
+	if p.err != nil || size > len(p.buf) {
+		p.err = ErrBadHello
+		return nil
+	}
+	bs := p.buf[:size]
+	p.buf = p.buf[size:]
+	return bs
+}
+
+func (p *helloParser) skip(size int) {
+	p.next(size)
+}
+
+func (p *helloParser) u8() uint8 {
+	bs := p.next(1)
+	if bs == nil {
+		return 0
+	}
+	return bs[0]
+}
+
+func (p *helloParser) u16() uint16 {
+	bs := p.next(2)
+	if bs == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint16(bs)
+}
@@ -0,0 +1,246 @@
+package sudoku
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+)
+
+// address type, same as SOCKS5 ATYP
+const (
+	AtypIPv4   = 0x01
+	AtypDomain = 0x03
+	AtypIPv6   = 0x04
+)
+
+// tunnel command, same as SOCKS5 CMD
+const (
+	CmdConnect = 0x01
+)
+
+var (
+	ErrBadAddrType = errors.New("bad address type")
+	ErrBadAddr     = errors.New("bad address")
+)
+
+// Addr is a destination address in SOCKS5 wire format.
+//
+// +------+----------+----------+
+// | ATYP | DST.ADDR | DST.PORT |
+// +------+----------+----------+
+// | 1    | Variable | 2        |
+// +------+----------+----------+
+//
+// ATYP - address type, 1 byte.
+// DST.ADDR - 4 bytes IPv4, 16 bytes IPv6, or 1 byte length followed by a domain name.
+// DST.PORT - port in network byte order, 2 bytes.
+
+type Addr struct {
+	Atyp uint8
+	// IP 地址的字符串形式或者域名
+	Host string
+	Port uint16
+}
+
+// 从 host:port 解析地址，host 不是 IP 时视为域名
+func ParseAddr(hostport string) (*Addr, error) {
+	host, portStr, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, err
+	}
+	addr := &Addr{Host: host, Port: uint16(port)}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) == 0 || len(host) > 255 {
+			return nil, ErrBadAddr
+		}
+		addr.Atyp = AtypDomain
+	} else if ip.To4() != nil {
+		addr.Atyp = AtypIPv4
+	} else {
+		addr.Atyp = AtypIPv6
+	}
+	return addr, nil
+}
+
+// 从 IP 和端口构造地址
+func NewIPAddr(ip net.IP, port int) *Addr {
+	addr := &Addr{Host: ip.String(), Port: uint16(port)}
+	if ip.To4() != nil {
+		addr.Atyp = AtypIPv4
+	} else {
+		addr.Atyp = AtypIPv6
+	}
+	return addr
+}
+
+func (addr *Addr) String() string {
+	return net.JoinHostPort(addr.Host, strconv.Itoa(int(addr.Port)))
+}
+
+func (addr *Addr) ReadFrom(r io.Reader) (n int64, err error) {
+	var atyp [1]byte
+	nn, err := io.ReadFull(r, atyp[:])
+	n += int64(nn)
+	if err != nil {
+		return
+	}
+	addr.Atyp = atyp[0]
+
+	var hostLen int
+	switch addr.Atyp {
+	case AtypIPv4:
+		hostLen = net.IPv4len
+	case AtypIPv6:
+		hostLen = net.IPv6len
+	case AtypDomain:
+		var length [1]byte
+		nn, err = io.ReadFull(r, length[:])
+		n += int64(nn)
+		if err != nil {
+			return
+		}
+		hostLen = int(length[0])
+	default:
+		err = ErrBadAddrType
+		return
+	}
+
+	buf := make([]byte, hostLen+2)
+	nn, err = io.ReadFull(r, buf)
+	n += int64(nn)
+	if err != nil {
+		return
+	}
+	if addr.Atyp == AtypDomain {
+		addr.Host = string(buf[:hostLen])
+	} else {
+		addr.Host = net.IP(buf[:hostLen]).String()
+	}
+	addr.Port = binary.BigEndian.Uint16(buf[hostLen:])
+	return
+}
+
+func (addr *Addr) WriteTo(w io.Writer) (n int64, err error) {
+	buf, err := addr.bytes()
+	if err != nil {
+		return
+	}
+	nn, err := w.Write(buf)
+	return int64(nn), err
+}
+
+func (addr *Addr) Bytes() []byte {
+	buf, _ := addr.bytes()
+	return buf
+}
+
+func (addr *Addr) bytes() ([]byte, error) {
+	var host []byte
+	switch addr.Atyp {
+	case AtypIPv4:
+		host = net.ParseIP(addr.Host).To4()
+	case AtypIPv6:
+		host = net.ParseIP(addr.Host).To16()
+	case AtypDomain:
+		if len(addr.Host) > 255 {
+			return nil, ErrBadAddr
+		}
+		host = append([]byte{byte(len(addr.Host))}, addr.Host...)
+	default:
+		return nil, ErrBadAddrType
+	}
+	if host == nil {
+		return nil, ErrBadAddr
+	}
+	buf := make([]byte, 0, 1+len(host)+2)
+	buf = append(buf, addr.Atyp)
+	buf = append(buf, host...)
+	buf = binary.BigEndian.AppendUint16(buf, addr.Port)
+	return buf, nil
+}
+
+// TunnelRequest is sent by the client after the sudoku handshake,
+// telling the server which destination to connect to.
+// SOCKS5 is handled on the client side, only the destination crosses the wire.
+//
+// Protocol spec:
+//
+// +-----+------+----------+----------+
+// | CMD | ATYP | DST.ADDR | DST.PORT |
+// +-----+------+----------+----------+
+// | 1   | 1    | Variable | 2        |
+// +-----+------+----------+----------+
+//
+// CMD - tunnel command, 1 byte.
+// ATYP, DST.ADDR, DST.PORT - see Addr.
+//
+// CMD 为 CmdMux 时没有地址部分，服务端响应之后连接上承载的是多路复用帧，见 Frame。
+// CMD 为 CmdReverse 时地址为服务端监听的地址，服务端响应之后同样承载多路复用帧，由服务端打开流。
+
+type TunnelRequest struct {
+	Cmd  uint8
+	Addr Addr
+}
+
+func (req *TunnelRequest) ReadFrom(r io.Reader) (n int64, err error) {
+	var cmd [1]byte
+	nn, err := io.ReadFull(r, cmd[:])
+	n += int64(nn)
+	if err != nil {
+		return
+	}
+	req.Cmd = cmd[0]
+	if req.Cmd == CmdMux {
+		return
+	}
+	nAddr, err := req.Addr.ReadFrom(r)
+	n += nAddr
+	return
+}
+
+func (req *TunnelRequest) WriteTo(w io.Writer) (n int64, err error) {
+	if req.Cmd == CmdMux {
+		nn, err := w.Write([]byte{req.Cmd})
+		return int64(nn), err
+	}
+	addr, err := req.Addr.bytes()
+	if err != nil {
+		return
+	}
+	nn, err := w.Write(append([]byte{req.Cmd}, addr...))
+	return int64(nn), err
+}
+
+// TunnelResponse is the server's answer to a TunnelRequest.
+//
+// Protocol spec:
+//
+// +------+
+// | STAT |
+// +------+
+// | 1    |
+// +------+
+//
+// STAT - status code, 1 byte.
+
+type TunnelResponse struct {
+	Status uint8
+}
+
+func (resp *TunnelResponse) ReadFrom(r io.Reader) (n int64, err error) {
+	var stat [1]byte
+	nn, err := io.ReadFull(r, stat[:])
+	resp.Status = stat[0]
+	return int64(nn), err
+}
+
+func (resp *TunnelResponse) WriteTo(w io.Writer) (n int64, err error) {
+	nn, err := w.Write([]byte{resp.Status})
+	return int64(nn), err
+}
@@ -0,0 +1,80 @@
+package sudoku
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// tunnel command, same as SOCKS5 CMD
+const (
+	CmdUDPAssociate = 0x03
+)
+
+// 单个 UDP 数据包的最大长度
+const MaxUDPPayload = 65507
+
+var ErrUDPTooLarge = errors.New("udp packet too large")
+
+// UDPPacket is a datagram carried inside the tunnel after a CmdUDPAssociate TunnelRequest.
+// 客户端发往服务端时 Addr 为目标地址，服务端发往客户端时 Addr 为数据包的来源地址。
+//
+// Protocol spec:
+//
+// +------+----------+----------+--------+----------+
+// | ATYP | DST.ADDR | DST.PORT | LENGTH | DATA     |
+// +------+----------+----------+--------+----------+
+// | 1    | Variable | 2        | 2      | Variable |
+// +------+----------+----------+--------+----------+
+//
+// ATYP, DST.ADDR, DST.PORT - see Addr.
+// LENGTH - data length, 2 bytes, at most MaxUDPPayload.
+// DATA - datagram payload, variable length.
+
+type UDPPacket struct {
+	Addr Addr
+	Data []byte
+}
+
+func (packet *UDPPacket) ReadFrom(r io.Reader) (n int64, err error) {
+	n, err = packet.Addr.ReadFrom(r)
+	if err != nil {
+		return
+	}
+	var length [2]byte
+	nn, err := io.ReadFull(r, length[:])
+	n += int64(nn)
+	if err != nil {
+		return
+	}
+	size := int(binary.BigEndian.Uint16(length[:]))
+	if size > MaxUDPPayload {
+		err = ErrUDPTooLarge
+		return
+	}
+	packet.Data = make([]byte, size)
+	nn, err = io.ReadFull(r, packet.Data)
+	n += int64(nn)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return
+}
+
+// 数据包在一次 Write 中完整写出
+func (packet *UDPPacket) WriteTo(w io.Writer) (n int64, err error) {
+	if len(packet.Data) > MaxUDPPayload {
+		err = ErrUDPTooLarge
+		return
+	}
+	addr, err := packet.Addr.bytes()
+	if err != nil {
+		return
+	}
+	buf := make([]byte, 0, len(addr)+2+len(packet.Data))
+	buf = append(buf, addr...)
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(packet.Data)))
+	buf = append(buf, packet.Data...)
+	nn, err := w.Write(buf)
+	return int64(nn), err
+}
@@ -1,13 +1,5 @@
 package sudoku
 
-import (
-	"log"
-	"math/rand"
-	"strconv"
-	"sudoku_go/global"
-	"time"
-)
-
 // 组合生成器
 func comb(n, k int) [][]int {
 	var result [][]int
@@ -28,74 +20,6 @@ func comb(n, k int) [][]int {
 	return result
 }
 
-// 生成所有可能的 4 个线索的数独谜题
-func generate4CluePuzzles(sudoku [4][4]int) [][16]int {
-	var puzzles [][16]int
-	clues := comb(16, 4) // 4 = number of given clues
-
-	for _, clue := range clues {
-		puzzle := [4][4]int{}
-		for _, c := range clue {
-			puzzle[c/4][c%4] = sudoku[c/4][c%4]
-		}
-		if len(uniqueValues(puzzle)) >= 3 {
-			var pz [16]int
-			for i := 0; i < 4; i++ {
-				for j := 0; j < 4; j++ {
-					pz[i*4+j] = puzzle[i][j]
-				}
-			}
-			puzzles = append(puzzles, pz)
-		}
-	}
-
-	return puzzles
-}
-
-// 提取数独中的唯一值
-func uniqueValues(sudoku [4][4]int) map[int]struct{} {
-	values := make(map[int]struct{})
-	for _, row := range sudoku {
-		for _, val := range row {
-			if val != 0 {
-				values[val] = struct{}{}
-			}
-		}
-	}
-	return values
-}
-
-//func parseSudoDict(filename string) map[int]string {
-//	data, err := ioutil.ReadFile(filename)
-//	if err != nil {
-//		log.Fatalf("Failed to read file: %v", err)
-//	}
-//
-//	var sudoDict map[int]string
-//	err = yaml.Unmarshal(data, &sudoDict)
-//	if err != nil {
-//		log.Fatalf("Failed to parse YAML: %v", err)
-//	}
-//
-//	return sudoDict
-//}
-
-func byteToSudoku(byteValue byte, sudoDict map[int]string) [4][4]int {
-	key := int(byteValue)
-	sudokuStr, exists := sudoDict[key]
-	if !exists {
-		log.Fatalf("Key %d not found in sudo_dict", key)
-	}
-
-	var sudoku [4][4]int
-	for i := 0; i < 16; i++ {
-		val, _ := strconv.Atoi(string(sudokuStr[i]))
-		sudoku[i/4][i%4] = val
-	}
-
-	return sudoku
-}
-
 // 检查数独板上的指定位置是否可以放置数字num
 func isValid(board [4][4]int, row, col, num int) bool {
 	// 检查行
@@ -238,48 +162,6 @@ func getBlock(row, col int) int {
 	return (row/2)*2 + (col / 2)
 }
 
-func ByteToRandSudoku(index byte) [16]int {
-	rand.Seed(time.Now().UnixNano())
-	l := len((*global.ByteList)[int(index)])
-	arrSudoStr := (*global.ByteList)[int(index)][rand.Intn(l)]
-	// arrSudoStr转为16位数组
-	var arrSudo [16]int
-	for i := 0; i < 16; i++ {
-		val, _ := strconv.Atoi(string(arrSudoStr[i]))
-		arrSudo[i] = val
-	}
-	return arrSudo
-}
-
-func ByteToSudokuList(index byte) []string {
-	sudoDict := *global.ByteMap
-	sudoku := byteToSudoku(index, sudoDict)
-	puzzles := generate4CluePuzzles(sudoku)
-	var AllSudoStr []string
-	for _, puzzle := range puzzles {
-		// reshape puzzle
-		var board [4][4]int
-		for i := 0; i < 16; i++ {
-			board[i/4][i%4] = puzzle[i]
-		}
-
-		// 检查是否有多个解
-		if CheckMultipleSolution(board) {
-			continue
-		} else {
-			// 唯一解
-			pf := ""
-			for _, row := range board {
-				for _, val := range row {
-					pf += strconv.Itoa(val)
-				}
-			}
-			AllSudoStr = append(AllSudoStr, pf)
-		}
-	}
-	return AllSudoStr
-}
-
 func FlattenSudoTo6Bytes(sudoku [16]int, sbCode uint8) (encode [6]byte) {
 	var one_positions [16]int
 	if sbCode == 0x01 {
@@ -381,18 +263,3 @@ func UnflattenSudoFrom6Bytes(encode [6]byte, sbCode uint8) (sudoku [16]int) {
 
 	return
 }
-
-func SudokuToByte(sudoku [4][4]int) byte {
-	var byteValue byte
-	var sudoDictNeg map[string]int
-	sudoDictNeg = *global.StrByte
-	pf := ""
-	for _, row := range sudoku {
-		for _, val := range row {
-			pf += strconv.Itoa(val)
-		}
-	}
-	byteValue = byte(sudoDictNeg[pf])
-	return byteValue
-
-}
@@ -0,0 +1,65 @@
+package sudoku_go
+
+import (
+	"errors"
+	"time"
+)
+
+// 连接各个阶段的超时
+// 握手超时限制从接受连接到读完请求的时间，连接超时限制建立出站连接的时间，
+// 空闲超时限制转发时两个方向都没有数据的时间，为 0 时不限制
+const (
+	DefaultHandshakeTimeout = 10 * time.Second
+	DefaultDialTimeout      = 10 * time.Second
+	DefaultIdleTimeout      = 5 * time.Minute
+)
+
+// 经过 timeout 之后的期限，timeout 不大于 0 时为零值，即没有期限
+func deadlineAfter(timeout time.Duration) time.Time {
+	if timeout <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(timeout)
+}
+
+// 设置连接的读写期限，t 为零值时取消期限，连接不支持时忽略
+func setDeadline(conn any, t time.Time) {
+	if conn, ok := conn.(interface{ SetDeadline(time.Time) error }); ok {
+		conn.SetDeadline(t)
+	}
+}
+
+// 关闭连接的写入方向，对端读到 EOF 之后仍然可以继续发送数据，连接不支持时返回 errors.ErrUnsupported
+func closeWrite(conn any) error {
+	if conn, ok := conn.(interface{ CloseWrite() error }); ok {
+		return conn.CloseWrite()
+	}
+	return errors.ErrUnsupported
+}
+
+// 转发的空闲计时，两个方向任意一个有数据时重新计时，超时后调用 onIdle
+type idleTimer struct {
+	timeout time.Duration
+	timer   *time.Timer
+}
+
+// timeout 不大于 0 时不计时
+func newIdleTimer(timeout time.Duration, onIdle func()) *idleTimer {
+	idle := &idleTimer{timeout: timeout}
+	if timeout > 0 {
+		idle.timer = time.AfterFunc(timeout, onIdle)
+	}
+	return idle
+}
+
+func (idle *idleTimer) touch() {
+	if idle.timer != nil {
+		idle.timer.Reset(idle.timeout)
+	}
+}
+
+func (idle *idleTimer) stop() {
+	if idle.timer != nil {
+		idle.timer.Stop()
+	}
+}
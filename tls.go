@@ -0,0 +1,267 @@
+package sudoku_go
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sudoku_go/sudoku"
+	"time"
+)
+
+// TLS 握手模式
+// sudoku 请求和响应掩盖后藏在 ClientHello 和 ServerHello 的 key_share 里，
+// 此后两个方向的数据都放在 application_data 记录里
+
+var ErrBadRecord = errors.New("tls: unexpected record")
+
+// 用预共享密钥和握手随机数派生的密钥流掩盖 buf，再次调用即可还原
+func tlsMask(key, label string, buf []byte, seeds ...[]byte) {
+	var counter [4]byte
+	for i := 0; len(buf) > 0; i++ {
+		mac := hmac.New(sha256.New, []byte(key))
+		mac.Write([]byte(label))
+		for _, seed := range seeds {
+			mac.Write(seed)
+		}
+		binary.BigEndian.PutUint32(counter[:], uint32(i))
+		mac.Write(counter[:])
+		block := mac.Sum(nil)
+		n := len(block)
+		if n > len(buf) {
+			n = len(buf)
+		}
+		for j := 0; j < n; j++ {
+			buf[j] ^= block[j]
+		}
+		buf = buf[n:]
+	}
+}
+
+// X25519MLKEM768 的 key_share 由 ML-KEM-768 公钥和 X25519 公钥组成
+// 公钥的前 1152 字节是 768 个 12 比特的系数，合法的系数小于 3329
+const (
+	mlkemCoefficients = 768
+	mlkemQ            = 3329
+)
+
+// 每个系数承载一个字节，系数为 字节 + 256*k，k 用拒绝采样均匀地取自所有使系数小于 3329 的值
+// 3329 = 13*256 + 1，字节 0 的 k 在 [0, 14) 中取值，其它字节在 [0, 13) 中取值
+// 余下的 seed 和 X25519 公钥保持随机，share 的长度为 HybridShareSize
+func packHybridShare(share, payload []byte) error {
+	random := bufio.NewReaderSize(rand.Reader, mlkemCoefficients)
+	var d [2]uint16
+	for i := 0; i < mlkemCoefficients; i += 2 {
+		for j := range d {
+			b := payload[i+j]
+			n := (mlkemQ-1-int(b))/256 + 1
+			for {
+				r, err := random.ReadByte()
+				if err != nil {
+					return err
+				}
+				// 丢弃 256 除以 n 的余数部分，避免取模偏差
+				if int(r) < 256-256%n {
+					d[j] = uint16(b) + 256*uint16(int(r)%n)
+					break
+				}
+			}
+		}
+		share[3*i/2] = byte(d[0])
+		share[3*i/2+1] = byte(d[0]>>8) | byte(d[1]<<4)
+		share[3*i/2+2] = byte(d[1] >> 4)
+	}
+	return nil
+}
+
+func unpackHybridShare(share []byte) []byte {
+	payload := make([]byte, mlkemCoefficients)
+	for i := 0; i < mlkemCoefficients; i += 2 {
+		payload[i] = share[3*i/2]
+		payload[i+1] = share[3*i/2+1]>>4 | share[3*i/2+2]<<4
+	}
+	return payload
+}
+
+// 把 sudoku 请求藏进 ClientHello 发出，返回 ClientHello 以便读取响应
+func writeClientHello(w io.Writer, req *sudoku.Request, key, serverName string) (*sudoku.ClientHello, error) {
+	hello := &sudoku.ClientHello{
+		SessionID:   make([]byte, 32),
+		ServerName:  serverName,
+		HybridShare: make([]byte, sudoku.HybridShareSize),
+		X25519Share: make([]byte, sudoku.X25519ShareSize),
+	}
+	for _, bs := range [][]byte{hello.Random[:], hello.SessionID, hello.HybridShare, hello.X25519Share} {
+		if _, err := rand.Read(bs); err != nil {
+			return nil, err
+		}
+	}
+	// 两字节长度 + 请求，余下部分保持随机
+	reqBytes := req.Bytes()
+	payload := make([]byte, mlkemCoefficients)
+	if 2+len(reqBytes) > len(payload) {
+		return nil, sudoku.ErrBadHello
+	}
+	if _, err := rand.Read(payload); err != nil {
+		return nil, err
+	}
+	binary.BigEndian.PutUint16(payload, uint16(len(reqBytes)))
+	copy(payload[2:], reqBytes)
+	tlsMask(key, "sudoku tls c2s", payload, hello.Random[:])
+	if err := packHybridShare(hello.HybridShare, payload); err != nil {
+		return nil, err
+	}
+
+	if _, err := hello.WriteTo(w); err != nil {
+		return nil, err
+	}
+	return hello, nil
+}
+
+// 读取 ClientHello 并取出其中的 sudoku 请求
+func readClientHello(r io.Reader, key string) (*sudoku.ClientHello, *sudoku.Request, error) {
+	hello := &sudoku.ClientHello{}
+	if _, err := hello.ReadFrom(r); err != nil {
+		return nil, nil, err
+	}
+	payload := unpackHybridShare(hello.HybridShare)
+	tlsMask(key, "sudoku tls c2s", payload, hello.Random[:])
+	size := int(binary.BigEndian.Uint16(payload))
+	if 2+size > len(payload) {
+		return nil, nil, sudoku.ErrBadHello
+	}
+	req := &sudoku.Request{}
+	if _, err := req.ReadFrom(bytes.NewReader(payload[2 : 2+size])); err != nil {
+		return nil, nil, err
+	}
+	return hello, req, nil
+}
+
+// 把 sudoku 响应藏进 ServerHello 发出
+func writeServerHello(w io.Writer, resp *sudoku.Response, key string, clientHello *sudoku.ClientHello) error {
+	hello := &sudoku.ServerHello{
+		SessionID: clientHello.SessionID,
+		KeyShare:  make([]byte, sudoku.X25519ShareSize),
+	}
+	if _, err := rand.Read(hello.Random[:]); err != nil {
+		return err
+	}
+	if _, err := rand.Read(hello.KeyShare); err != nil {
+		return err
+	}
+	respBytes := resp.Bytes()
+	if len(respBytes) > len(hello.KeyShare) {
+		return sudoku.ErrBadHello
+	}
+	copy(hello.KeyShare, respBytes)
+	tlsMask(key, "sudoku tls s2c", hello.KeyShare, clientHello.Random[:], hello.Random[:])
+	_, err := hello.WriteTo(w)
+	return err
+}
+
+// 读取 ServerHello 并取出其中的 sudoku 响应
+func readServerHello(r io.Reader, key string, clientHello *sudoku.ClientHello) (*sudoku.Response, error) {
+	hello := &sudoku.ServerHello{}
+	if _, err := hello.ReadFrom(r); err != nil {
+		return nil, err
+	}
+	share := append([]byte(nil), hello.KeyShare...)
+	tlsMask(key, "sudoku tls s2c", share, clientHello.Random[:], hello.Random[:])
+	resp := &sudoku.Response{}
+	if _, err := resp.ReadFrom(bytes.NewReader(share)); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// TLS 记录层，读写的数据都放在 application_data 记录里
+// 读取时跳过 ChangeCipherSpec，收到 alert 视为连接结束
+type recordConn struct {
+	io.ReadWriteCloser
+	// 客户端在第一条 application_data 之前补发 ChangeCipherSpec
+	sendCCS bool
+	// 当前记录还没有读完的长度
+	remaining int
+}
+
+func newRecordConn(conn io.ReadWriteCloser, client bool) *recordConn {
+	return &recordConn{
+		ReadWriteCloser: conn,
+		sendCCS:         client,
+	}
+}
+
+func (conn *recordConn) Read(bs []byte) (int, error) {
+	for conn.remaining == 0 {
+		var header [sudoku.RecordHeaderSize]byte
+		if _, err := io.ReadFull(conn.ReadWriteCloser, header[:]); err != nil {
+			return 0, err
+		}
+		length := int(binary.BigEndian.Uint16(header[3:5]))
+		if length > sudoku.MaxRecordPayload+256 {
+			return 0, ErrBadRecord
+		}
+		switch header[0] {
+		case sudoku.RecordApplicationData:
+			conn.remaining = length
+		case sudoku.RecordChangeCipherSpec:
+			if _, err := io.CopyN(io.Discard, conn.ReadWriteCloser, int64(length)); err != nil {
+				return 0, err
+			}
+		case sudoku.RecordAlert:
+			return 0, io.EOF
+		default:
+			return 0, ErrBadRecord
+		}
+	}
+	if len(bs) > conn.remaining {
+		bs = bs[:conn.remaining]
+	}
+	n, err := conn.ReadWriteCloser.Read(bs)
+	conn.remaining -= n
+	if err == io.EOF && conn.remaining > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (conn *recordConn) SetDeadline(t time.Time) error {
+	setDeadline(conn.ReadWriteCloser, t)
+	return nil
+}
+
+// 不发送 close_notify，TLS 1.3 的 alert 也是加密的，对端通过 TCP 的 FIN 读到 EOF
+func (conn *recordConn) CloseWrite() error {
+	return closeWrite(conn.ReadWriteCloser)
+}
+
+// 每条记录在一次 Write 中写出
+func (conn *recordConn) Write(bs []byte) (n int, err error) {
+	var prefix []byte
+	if conn.sendCCS {
+		conn.sendCCS = false
+		prefix = []byte{sudoku.RecordChangeCipherSpec, 0x03, 0x03, 0x00, 0x01, 0x01}
+	}
+	for len(bs) > 0 {
+		size := len(bs)
+		if size > sudoku.MaxRecordPayload {
+			size = sudoku.MaxRecordPayload
+		}
+		buf := make([]byte, 0, len(prefix)+sudoku.RecordHeaderSize+size)
+		buf = append(buf, prefix...)
+		buf = append(buf, sudoku.RecordApplicationData, 0x03, 0x03)
+		buf = binary.BigEndian.AppendUint16(buf, uint16(size))
+		buf = append(buf, bs[:size]...)
+		prefix = nil
+		if _, err = conn.ReadWriteCloser.Write(buf); err != nil {
+			return
+		}
+		n += size
+		bs = bs[size:]
+	}
+	return
+}
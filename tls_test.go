@@ -0,0 +1,69 @@
+package sudoku_go
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+// 按 ML-KEM 公钥的编码取出全部 12 比特的系数
+func hybridCoefficients(share []byte) []uint16 {
+	coefficients := make([]uint16, 0, mlkemCoefficients)
+	for j := 0; j < 3*mlkemCoefficients/2; j += 3 {
+		coefficients = append(coefficients,
+			uint16(share[j])|uint16(share[j+1]&0x0f)<<8,
+			uint16(share[j+1]>>4)|uint16(share[j+2])<<4)
+	}
+	return coefficients
+}
+
+func TestHybridShare(t *testing.T) {
+	source := rand.New(rand.NewSource(1))
+	payload := make([]byte, mlkemCoefficients)
+	share := make([]byte, 3*mlkemCoefficients/2)
+	// 每个字节的高位部分出现的次数
+	counts := make(map[byte][]int)
+	for round := 0; round < 200; round++ {
+		source.Read(payload)
+		// 一半的轮次全是 0，覆盖系数 3328
+		if round%2 == 0 {
+			payload = make([]byte, mlkemCoefficients)
+		}
+		if err := packHybridShare(share, payload); err != nil {
+			t.Fatal(err)
+		}
+		if got := unpackHybridShare(share); !bytes.Equal(got, payload) {
+			t.Fatalf("round %d: payload did not survive the round trip", round)
+		}
+		for i, c := range hybridCoefficients(share) {
+			if c >= mlkemQ {
+				t.Fatalf("round %d: coefficient %d = %d, not below q", round, i, c)
+			}
+			b := payload[i]
+			if counts[b] == nil {
+				counts[b] = make([]int, (mlkemQ-1-int(b))/256+1)
+			}
+			counts[b][c/256]++
+		}
+	}
+
+	// 字节 0 的高位部分在 [0, 14) 上均匀分布，包括系数 3328
+	zeros := counts[0]
+	if len(zeros) != 14 {
+		t.Fatalf("byte 0 has %d high parts, want 14", len(zeros))
+	}
+	total := 0
+	for _, n := range zeros {
+		total += n
+	}
+	for k, n := range zeros {
+		if mean := total / len(zeros); n < mean*8/10 || n > mean*12/10 {
+			t.Errorf("coefficient %d appeared %d times, want about %d", k*256, n, mean)
+		}
+	}
+	for b, ks := range counts {
+		if b != 0 && len(ks) != 13 {
+			t.Errorf("byte %d has %d high parts, want 13", b, len(ks))
+		}
+	}
+}
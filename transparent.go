@@ -0,0 +1,98 @@
+package sudoku_go
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"sudoku_go/sudoku"
+)
+
+// 透明代理模式
+const (
+	// iptables REDIRECT，通过 SO_ORIGINAL_DST 取得原始目标地址
+	TransparentRedirect = "redirect"
+	// iptables TPROXY，监听 socket 设置 IP_TRANSPARENT，本地地址即原始目标地址
+	TransparentTProxy = "tproxy"
+)
+
+var (
+	ErrTransparentMode        = errors.New("transparent: unknown mode")
+	ErrTransparentUnsupported = errors.New("transparent: not supported on this platform")
+	ErrTransparentLoop        = errors.New("transparent: connection to the listener itself")
+)
+
+// 启动透明代理监听，在后台接受连接
+// 被 iptables 转发过来的连接会通过隧道连接到它原本的目标地址
+// ctx 结束后停止监听并和 ListenSecureTCP 一样排空连接，返回的 channel 在排空后关闭
+func (local *LsLocal) listenTransparent(ctx context.Context) (<-chan struct{}, error) {
+	if local.Transparent != TransparentRedirect && local.Transparent != TransparentTProxy {
+		return nil, ErrTransparentMode
+	}
+	listener, err := listenTransparent(local.Transparent, local.TransparentAddr)
+	if err != nil {
+		return nil, err
+	}
+	slog.Info("Transparent proxy listening", "mode", local.Transparent, "addr", listener.Addr().String())
+
+	done := make(chan struct{})
+	stop := context.AfterFunc(ctx, func() {
+		listener.Close()
+	})
+	go func() {
+		defer close(done)
+		defer stop()
+		defer listener.Close()
+		conns := newConnTracker()
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				if ctx.Err() != nil {
+					break
+				}
+				slog.Error("Failed to accept", "err", err)
+				continue
+			}
+			metricConns.add(1)
+			metricActiveConns.add(1)
+			conns.add(conn)
+			go func() {
+				defer conns.done(conn)
+				defer metricActiveConns.add(-1)
+				local.handleTransparent(conn, listener.Addr().(*net.TCPAddr), newConnLogger())
+			}()
+		}
+		conns.drain(local.DrainTimeout)
+	}()
+	return done, nil
+}
+
+func (local *LsLocal) handleTransparent(conn net.Conn, listenAddr *net.TCPAddr, logger *slog.Logger) {
+	defer conn.Close()
+
+	dst, err := originalDst(local.Transparent, conn)
+	if err != nil {
+		logger.Warn("Failed to get original destination", "err", err)
+		return
+	}
+	// 直接连接监听端口的连接，原始目标就是监听地址本身，转发会形成环路
+	if dst.Port == listenAddr.Port && (listenAddr.IP.IsUnspecified() || dst.IP.Equal(listenAddr.IP)) {
+		logger.Warn(ErrTransparentLoop.Error())
+		return
+	}
+	logger.Debug("Transparent connection", "client", conn.RemoteAddr().String(), "dst", redact(dst))
+
+	dstAddr := sudoku.NewIPAddr(dst.IP, dst.Port)
+	tunnel, status, err := local.dial(dstAddr, logger)
+	if err != nil {
+		logger.Error("Failed to open tunnel", "err", err)
+		return
+	}
+	if status != sudoku.StatusOK {
+		logger.Info("Failed to connect", "dst", redact(dstAddr), "status", status)
+		return
+	}
+	defer tunnel.Close()
+
+	local.relaySession(conn, tunnel, dstAddr, logger)
+}
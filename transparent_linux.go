@@ -0,0 +1,93 @@
+//go:build linux
+
+package sudoku_go
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	// linux/netfilter_ipv4.h, linux/netfilter_ipv6/ip6_tables.h
+	soOriginalDst     = 80
+	ip6tSoOriginalDst = 80
+	// linux/in6.h
+	ipv6Transparent = 75
+)
+
+func listenTransparent(mode string, laddr *net.TCPAddr) (net.Listener, error) {
+	lc := net.ListenConfig{}
+	if mode == TransparentTProxy {
+		lc.Control = func(network, address string, c syscall.RawConn) error {
+			var sockErr error
+			err := c.Control(func(fd uintptr) {
+				// 双栈 socket 两个选项都需要设置，只支持其中一个时忽略另一个的错误
+				errV4 := syscall.SetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_TRANSPARENT, 1)
+				errV6 := syscall.SetsockoptInt(int(fd), syscall.SOL_IPV6, ipv6Transparent, 1)
+				if errV4 != nil && errV6 != nil {
+					sockErr = errV4
+				}
+			})
+			if err != nil {
+				return err
+			}
+			return sockErr
+		}
+	}
+	return lc.Listen(context.Background(), "tcp", laddr.String())
+}
+
+// 取得被 iptables 转发的连接的原始目标地址
+func originalDst(mode string, conn net.Conn) (*net.TCPAddr, error) {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil, ErrTransparentUnsupported
+	}
+	// TPROXY 不修改目标地址
+	if mode == TransparentTProxy {
+		return tcpConn.LocalAddr().(*net.TCPAddr), nil
+	}
+
+	rawConn, err := tcpConn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var addr *net.TCPAddr
+	var sockErr error
+	err = rawConn.Control(func(fd uintptr) {
+		if tcpConn.LocalAddr().(*net.TCPAddr).IP.To4() != nil {
+			addr, sockErr = getOriginalDst(fd, syscall.SOL_IP, soOriginalDst)
+		} else {
+			addr, sockErr = getOriginalDst(fd, syscall.SOL_IPV6, ip6tSoOriginalDst)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return addr, sockErr
+}
+
+// 读取 sockaddr_in 或 sockaddr_in6 形式的原始目标地址
+func getOriginalDst(fd uintptr, level, opt int) (*net.TCPAddr, error) {
+	var buf [syscall.SizeofSockaddrInet6]byte
+	size := uint32(len(buf))
+	_, _, errno := syscall.Syscall6(syscall.SYS_GETSOCKOPT, fd, uintptr(level), uintptr(opt),
+		uintptr(unsafe.Pointer(&buf[0])), uintptr(unsafe.Pointer(&size)), 0)
+	if errno != 0 {
+		return nil, os.NewSyscallError("getsockopt SO_ORIGINAL_DST", errno)
+	}
+	// sin_family 为主机字节序，sin_port 为网络字节序
+	port := int(binary.BigEndian.Uint16(buf[2:4]))
+	switch *(*uint16)(unsafe.Pointer(&buf[0])) {
+	case syscall.AF_INET:
+		return &net.TCPAddr{IP: net.IP(append([]byte(nil), buf[4:8]...)), Port: port}, nil
+	case syscall.AF_INET6:
+		return &net.TCPAddr{IP: net.IP(append([]byte(nil), buf[8:24]...)), Port: port}, nil
+	default:
+		return nil, syscall.EAFNOSUPPORT
+	}
+}
@@ -0,0 +1,181 @@
+//go:build linux
+
+package sudoku_go
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// 在新的网络命名空间中运行的子进程通过这个环境变量取得透明代理模式
+const netnsModeEnv = "SUDOKU_TEST_NETNS_MODE"
+
+// 命名空间中客户端和目标的地址，iptables 规则只匹配客户端发出的连接，服务端连接目标时不会再被转发
+var (
+	netnsClientIP = net.IPv4(10, 9, 9, 8)
+	netnsTargetIP = net.IPv4(10, 9, 9, 9)
+)
+
+// 在新的网络命名空间中用 iptables 把连接转发给透明代理，经过隧道到达目标
+// 需要 root 权限以及 ip 和 iptables 命令，否则跳过
+func TestTransparentNetns(t *testing.T) {
+	if mode := os.Getenv(netnsModeEnv); mode != "" {
+		testTransparentInNetns(t, mode)
+		return
+	}
+	if os.Geteuid() != 0 {
+		t.Skip("requires root to create a network namespace")
+	}
+	for _, name := range []string{"ip", "iptables"} {
+		if _, err := exec.LookPath(name); err != nil {
+			t.Skipf("requires %s: %v", name, err)
+		}
+	}
+	for _, mode := range []string{TransparentRedirect, TransparentTProxy} {
+		mode := mode
+		t.Run(mode, func(t *testing.T) {
+			// 命名空间属于线程，新建命名空间需要在子进程中运行整个测试
+			cmd := exec.Command(os.Args[0], "-test.run=^TestTransparentNetns$", "-test.v")
+			cmd.Env = append(os.Environ(), netnsModeEnv+"="+mode)
+			cmd.SysProcAttr = &syscall.SysProcAttr{Cloneflags: syscall.CLONE_NEWNET}
+			out, err := cmd.CombinedOutput()
+			if errors.Is(err, syscall.EPERM) {
+				t.Skipf("cannot create a network namespace: %v", err)
+			}
+			if err != nil {
+				t.Fatalf("%v\n%s", err, out)
+			}
+			if bytes.Contains(out, []byte("--- SKIP")) {
+				t.Skipf("skipped in the namespace:\n%s", out)
+			}
+		})
+	}
+}
+
+func netnsRun(t *testing.T, args ...string) {
+	t.Helper()
+	if out, err := exec.Command(args[0], args[1:]...).CombinedOutput(); err != nil {
+		t.Fatalf("%v: %v\n%s", args, err, out)
+	}
+}
+
+func testTransparentInNetns(t *testing.T, mode string) {
+	netnsRun(t, "ip", "link", "set", "lo", "up")
+	netnsRun(t, "ip", "addr", "add", netnsClientIP.String()+"/32", "dev", "lo")
+	netnsRun(t, "ip", "addr", "add", netnsTargetIP.String()+"/32", "dev", "lo")
+
+	// 目标是一个回显服务，记录每个连接的来源地址
+	target, err := net.ListenTCP("tcp", &net.TCPAddr{IP: netnsTargetIP})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	sources := make(chan net.Addr, 1)
+	go func() {
+		for {
+			conn, err := target.Accept()
+			if err != nil {
+				return
+			}
+			sources <- conn.RemoteAddr()
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	serverDone := make(chan error, 1)
+	localDone := make(chan error, 1)
+	defer func() {
+		cancel()
+		<-serverDone
+		<-localDone
+	}()
+
+	server, err := NewLsServer("127.0.0.1:0", "netns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.ACL = nil
+	server.DrainTimeout = time.Second
+	serverAddr := make(chan net.Addr, 1)
+	go func() {
+		serverDone <- server.Listen(ctx, func(addr net.Addr) { serverAddr <- addr })
+	}()
+
+	local, err := NewLsLocal("127.0.0.1:0", []string{(<-serverAddr).String()}, "netns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 先取得一个空闲端口，iptables 规则需要知道透明代理的端口
+	free, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := free.Addr().(*net.TCPAddr).Port
+	free.Close()
+	local.Transparent = mode
+	local.TransparentAddr = &net.TCPAddr{IP: net.IPv4zero, Port: port}
+	local.DrainTimeout = time.Second
+	localListening := make(chan struct{})
+	go func() {
+		localDone <- local.Listen(ctx, func(net.Addr) { close(localListening) })
+	}()
+	select {
+	case <-localListening:
+	case err := <-localDone:
+		localDone <- err
+		t.Fatalf("local failed to listen: %v", err)
+	}
+
+	targetPort := strconv.Itoa(target.Addr().(*net.TCPAddr).Port)
+	match := []string{"-p", "tcp", "-s", netnsClientIP.String(), "-d", netnsTargetIP.String(), "--dport", targetPort}
+	switch mode {
+	case TransparentRedirect:
+		netnsRun(t, append(append([]string{"iptables", "-t", "nat", "-A", "OUTPUT"}, match...),
+			"-j", "REDIRECT", "--to-ports", strconv.Itoa(port))...)
+	case TransparentTProxy:
+		// 本机发出的连接经过 lo 回到 PREROUTING，由 TPROXY 交给透明代理
+		netnsRun(t, "ip", "rule", "add", "fwmark", "1", "lookup", "100")
+		netnsRun(t, "ip", "route", "add", "local", "0.0.0.0/0", "dev", "lo", "table", "100")
+		args := append(append([]string{"iptables", "-t", "mangle", "-A", "PREROUTING"}, match...),
+			"-j", "TPROXY", "--on-port", strconv.Itoa(port), "--tproxy-mark", "1")
+		if out, err := exec.Command(args[0], args[1:]...).CombinedOutput(); err != nil {
+			t.Skipf("TPROXY is not available: %v\n%s", err, out)
+		}
+	}
+
+	dialer := net.Dialer{LocalAddr: &net.TCPAddr{IP: netnsClientIP}, Timeout: 5 * time.Second}
+	conn, err := dialer.Dial("tcp", net.JoinHostPort(netnsTargetIP.String(), targetPort))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	msg := []byte("transparent proxy in a network namespace")
+	if _, err := conn.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	echo := make([]byte, len(msg))
+	if _, err := io.ReadFull(conn, echo); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(echo, msg) {
+		t.Fatalf("echo = %q, want %q", echo, msg)
+	}
+	// 经过隧道时目标看到的是服务端的连接，而不是客户端的地址
+	if source := <-sources; source.(*net.TCPAddr).IP.Equal(netnsClientIP) {
+		t.Fatalf("connection from %v reached the target directly", source)
+	}
+}
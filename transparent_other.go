@@ -0,0 +1,13 @@
+//go:build !linux
+
+package sudoku_go
+
+import "net"
+
+func listenTransparent(mode string, laddr *net.TCPAddr) (net.Listener, error) {
+	return nil, ErrTransparentUnsupported
+}
+
+func originalDst(mode string, conn net.Conn) (*net.TCPAddr, error) {
+	return nil, ErrTransparentUnsupported
+}
@@ -0,0 +1,315 @@
+package sudoku_go
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"sudoku_go/sudoku"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// 服务端的 UDP 关联在两个方向都没有数据时保持的时长
+const udpNATTimeout = 60 * time.Second
+
+// 本地端一个 UDP 关联里目标的路由结果，直连时 addr 为解析后的地址
+type udpRoute struct {
+	action string
+	addr   *net.UDPAddr
+}
+
+// 处理 SOCKS5 UDP ASSOCIATE
+// 在和 TCP 控制连接相同的 IP 上打开 UDP 中继端口，数据包去掉 SOCKS5 UDP 头后按路由规则处理：
+// 走代理的通过隧道发给服务端，直连的从单独的 socket 发出，拒绝的丢弃
+// 控制连接断开时关联结束
+func (local *LsLocal) handleUDPAssociate(userConn *SecureTCPConn, clientAddr *sudoku.Addr, logger *slog.Logger) {
+	tcpConn, ok := userConn.ReadWriteCloser.(net.Conn)
+	if !ok {
+		socks5WriteReply(userConn, socks5GeneralFailure)
+		return
+	}
+	localAddr := tcpConn.LocalAddr().(*net.TCPAddr)
+	remoteAddr := tcpConn.RemoteAddr().(*net.TCPAddr)
+
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: localAddr.IP})
+	if err != nil {
+		logger.Error("Failed to listen UDP", "err", err)
+		socks5WriteReply(userConn, socks5GeneralFailure)
+		return
+	}
+	defer udpConn.Close()
+
+	// 有路由规则时才可能直连
+	var direct *net.UDPConn
+	if local.Router != nil {
+		if direct, err = listenProtectedUDP(); err != nil {
+			logger.Error("Failed to listen UDP", "err", err)
+			socks5WriteReply(userConn, socks5GeneralFailure)
+			return
+		}
+		defer direct.Close()
+	}
+
+	tunnel, status, err := local.requestTunnel(&sudoku.TunnelRequest{Cmd: sudoku.CmdUDPAssociate, Addr: *clientAddr})
+	if err != nil {
+		logger.Error("Failed to open tunnel", "err", err)
+		socks5WriteReply(userConn, socks5GeneralFailure)
+		return
+	}
+	if status != sudoku.StatusOK {
+		logger.Warn("Server refused UDP associate", "status", status)
+		socks5WriteReply(userConn, socks5Rep(status))
+		return
+	}
+	defer tunnel.Close()
+
+	bind := sudoku.NewIPAddr(localAddr.IP, udpConn.LocalAddr().(*net.UDPAddr).Port)
+	if err := socks5WriteReplyBind(userConn, socks5Succeeded, bind); err != nil {
+		logger.Warn("Failed to write SOCKS5 reply", "err", err)
+		return
+	}
+	logger.Info("UDP associate", "bind", bind.String())
+	sess := newSession(remoteAddr.String(), local.User)
+	closers := []io.Closer{userConn, udpConn, tunnel}
+	if direct != nil {
+		closers = append(closers, direct)
+	}
+	local.sessions.add(sess, "udp", closers...)
+	defer local.sessions.remove(sess)
+	stats := sess.traffic
+
+	// 控制连接上不会再有数据，读到 EOF 或出错时结束关联
+	go func() {
+		io.Copy(io.Discard, userConn)
+		udpConn.Close()
+		tunnel.Close()
+		if direct != nil {
+			direct.Close()
+		}
+	}()
+
+	// 第一个数据包的来源作为客户端的 UDP 地址
+	var clientLock sync.Mutex
+	var client *net.UDPAddr
+
+	// 返回的数据包加上 SOCKS5 UDP 头后发回客户端
+	writeClient := func(addr *sudoku.Addr, data []byte) error {
+		clientLock.Lock()
+		dst := client
+		clientLock.Unlock()
+		if dst == nil {
+			return nil
+		}
+		if _, err := udpConn.WriteToUDP(socks5PackUDP(addr, data), dst); err != nil {
+			logger.Warn("Failed to write UDP packet", "err", err)
+			return err
+		}
+		stats.addRx(len(data))
+		return nil
+	}
+	go func() {
+		defer udpConn.Close()
+		for {
+			packet := &sudoku.UDPPacket{}
+			if _, err := packet.ReadFrom(tunnel); err != nil {
+				return
+			}
+			if writeClient(&packet.Addr, packet.Data) != nil {
+				return
+			}
+		}
+	}()
+	if direct != nil {
+		go func() {
+			defer udpConn.Close()
+			buf := make([]byte, 64*1024)
+			for {
+				n, from, err := direct.ReadFromUDP(buf)
+				if err != nil {
+					return
+				}
+				if writeClient(sudoku.NewIPAddr(from.IP, from.Port), buf[:n]) != nil {
+					return
+				}
+			}
+		}()
+	}
+
+	// 同一个关联里的目标只按规则匹配一次
+	routes := make(map[string]*udpRoute)
+	buf := make([]byte, 64*1024)
+	for {
+		n, from, err := udpConn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		// 只接受发起关联的客户端的数据包
+		if !from.IP.Equal(remoteAddr.IP) {
+			continue
+		}
+		clientLock.Lock()
+		if client == nil {
+			client = from
+		}
+		clientLock.Unlock()
+
+		dstAddr, data, err := socks5ParseUDP(buf[:n])
+		if err != nil {
+			logger.Debug("Dropped UDP packet", "err", err)
+			continue
+		}
+		route := local.routeUDP(routes, dstAddr, logger)
+		switch route.action {
+		case ActionReject:
+			continue
+		case ActionDirect:
+			if route.addr == nil {
+				continue
+			}
+			if _, err := direct.WriteToUDP(data, route.addr); err != nil {
+				logger.Debug("Failed to write UDP packet", "dst", redact(dstAddr), "err", redact(err))
+				continue
+			}
+			stats.addTx(len(data))
+			continue
+		}
+		packet := &sudoku.UDPPacket{Addr: *dstAddr, Data: data}
+		if _, err := packet.WriteTo(tunnel); err != nil {
+			if !errors.Is(err, sudoku.ErrUDPTooLarge) {
+				return
+			}
+			continue
+		}
+		stats.addTx(len(data))
+	}
+}
+
+// 按路由规则决定数据包的去向，直连的目标在本地解析，解析失败时 addr 为 nil，数据包被丢弃
+func (local *LsLocal) routeUDP(routes map[string]*udpRoute, dstAddr *sudoku.Addr, logger *slog.Logger) *udpRoute {
+	key := dstAddr.String()
+	if route, ok := routes[key]; ok {
+		return route
+	}
+	route := &udpRoute{action: local.Router.Route(dstAddr)}
+	switch route.action {
+	case ActionReject:
+		logger.Info("Rejected by rule", "dst", redact(dstAddr))
+	case ActionDirect:
+		if ips, err := local.Router.resolver.LookupIP(dstAddr.Host); err != nil {
+			logger.Info("Can't resolve IP", "dst", redact(dstAddr), "err", redact(err))
+		} else {
+			route.addr = net.UDPAddrFromAddrPort(netip.AddrPortFrom(ips[0], dstAddr.Port))
+		}
+	}
+	routes[key] = route
+	return route
+}
+
+// 本地端直连的 UDP socket，和 dialProtected 一样在 Android VPN 模式下需要保护
+func listenProtectedUDP() (*net.UDPConn, error) {
+	lc := net.ListenConfig{Control: func(network, address string, c syscall.RawConn) error {
+		return c.Control(func(fd uintptr) {
+			protect(int(fd))
+		})
+	}}
+	conn, err := lc.ListenPacket(context.Background(), "udp", ":0")
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*net.UDPConn), nil
+}
+
+// 服务端处理 UDP 关联
+// 每个关联使用一个独立的 UDP socket，两个方向都超过 udpNATTimeout 没有数据时关闭
+func (lsServer *LsServer) handleUDPAssociate(tunnel io.ReadWriteCloser, sess *session, logger *slog.Logger) {
+	tunnelResp := &sudoku.TunnelResponse{Status: sudoku.StatusOK}
+	udpConn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		logger.Error("Failed to listen UDP", "err", err)
+		tunnelResp.Status = sudoku.StatusInternalServerError
+		tunnelResp.WriteTo(tunnel)
+		return
+	}
+	defer udpConn.Close()
+	if _, err := tunnelResp.WriteTo(tunnel); err != nil {
+		logger.Warn("Failed to write tunnel response", "err", err)
+		return
+	}
+	logger.Info("UDP associate", "relay", udpConn.LocalAddr().String())
+	lsServer.sessions.add(sess, "udp", tunnel, udpConn)
+	defer lsServer.sessions.remove(sess)
+	stats := sess.traffic
+
+	var lastActive atomic.Int64
+	lastActive.Store(time.Now().UnixNano())
+
+	// 目标返回的数据包带上来源地址发回客户端
+	go func() {
+		defer tunnel.Close()
+		defer udpConn.Close()
+		buf := make([]byte, 64*1024)
+		for {
+			udpConn.SetReadDeadline(time.Now().Add(udpNATTimeout))
+			n, from, err := udpConn.ReadFromUDP(buf)
+			if err != nil {
+				var netErr net.Error
+				if errors.As(err, &netErr) && netErr.Timeout() {
+					if time.Since(time.Unix(0, lastActive.Load())) < udpNATTimeout {
+						continue
+					}
+					logger.Info("UDP associate timed out")
+				}
+				return
+			}
+			lastActive.Store(time.Now().UnixNano())
+			packet := &sudoku.UDPPacket{Addr: *sudoku.NewIPAddr(from.IP, from.Port), Data: buf[:n]}
+			if _, err := packet.WriteTo(tunnel); err != nil {
+				return
+			}
+			stats.addRx(n)
+		}
+	}()
+
+	// 同一个关联里的域名只解析和检查一次，被拒绝的目标记为 nil
+	resolved := make(map[string]*net.UDPAddr)
+	for {
+		packet := &sudoku.UDPPacket{}
+		if _, err := packet.ReadFrom(tunnel); err != nil {
+			return
+		}
+		lastActive.Store(time.Now().UnixNano())
+
+		key := packet.Addr.String()
+		dstAddr, ok := resolved[key]
+		if !ok {
+			ips, err := lsServer.resolve(&packet.Addr)
+			if err != nil {
+				logger.Info("Can't resolve IP", "dst", redact(&packet.Addr), "err", redact(err))
+				continue
+			}
+			// 使用第一个允许的地址，上游代理不转发 UDP，应该经过上游代理的目标同样丢弃
+			if ips, reason := lsServer.ACL.filter(&packet.Addr, ips); len(ips) == 0 {
+				logger.Info("Outbound denied", "dst", redact(&packet.Addr), "reason", reason)
+				metricOutboundDenied.add(1, reason)
+			} else if name, _ := lsServer.Outbounds.route(&packet.Addr, ips[0]); name != OutboundDirect {
+				logger.Info("Dropped UDP to proxied destination", "dst", redact(&packet.Addr), "proxy", name)
+			} else {
+				dstAddr = net.UDPAddrFromAddrPort(netip.AddrPortFrom(ips[0], packet.Addr.Port))
+			}
+			resolved[key] = dstAddr
+		}
+		if dstAddr == nil {
+			continue
+		}
+		if _, err := udpConn.WriteToUDP(packet.Data, dstAddr); err != nil {
+			logger.Debug("Failed to write UDP packet", "dst", redact(dstAddr), "err", redact(err))
+			continue
+		}
+		stats.addTx(len(packet.Data))
+	}
+}